@@ -1,19 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"internship_backend_2022/internal/api"
 	"internship_backend_2022/internal/app"
+	"internship_backend_2022/internal/billing"
+	"internship_backend_2022/internal/payout"
 	"internship_backend_2022/internal/repository"
 	"internship_backend_2022/internal/service"
+	"internship_backend_2022/internal/storage"
+	"internship_backend_2022/internal/worker"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-
-
 func main() {
-	
+
 	cfg := app.NewConfig()
 
 	db, err := repository.InitDB(cfg.DBConnStr)
@@ -21,17 +29,59 @@ func main() {
 		log.Fatal(err)
 	}
 	defer db.Close()
-	
+
+	reportStorage, err := storage.NewLocal(cfg.ReportStorageDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	Repository := repository.NewRepository(db)
-	Service := service.NewService(Repository)
-	Handler := api.NewHandler(Service)
+	Service := service.NewService(Repository, service.Options{
+		DefaultReservationTTL:  cfg.ReservationTTL,
+		ServiceReservationTTLs: cfg.ServiceReservationTTLs,
+		PayoutProvider:         payout.NewFakeProvider(),
+		BonusPriority:          cfg.BonusPriority,
+		ReportStorage:          reportStorage,
+		ReportTTL:              cfg.ReportTTL,
+	})
+
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		code := runReconcile(Service, os.Args[2:])
+		db.Close()
+		os.Exit(code)
+	}
+
+	var billingVerifier *billing.Verifier
+	if cfg.BillingWebhookSecret != "" {
+		billingVerifier = billing.NewVerifier(cfg.BillingWebhookSecret, cfg.BillingWebhookTolerance)
+	}
+	Handler := api.NewHandler(Service, billingVerifier)
 
 	router := api.SetupRouter(Handler)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go worker.RunReservationSweeper(ctx, Service, cfg.ReservationSweepInterval)
+	go worker.RunPayoutProcessor(ctx, Service, cfg.PayoutProcessInterval)
+	go worker.RunBonusExpirer(ctx, Service, cfg.BonusExpiryInterval)
+	go worker.RunReportGenerator(ctx, Service, cfg.ReportProcessInterval)
+	go worker.RunReportCleaner(ctx, Service, cfg.ReportCleanupInterval)
+	go worker.RunReconciler(ctx, Service, cfg.ReconcileInterval, cfg.ReconcileFix)
+
+	server := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Print(err)
+		}
+	}()
+
 	fmt.Println("Server is running on http://localhost:8080")
-	
 
-	if err := http.ListenAndServe(":8080", router); err != nil {
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
 }
\ No newline at end of file
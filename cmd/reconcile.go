@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"internship_backend_2022/internal/reconcile"
+	"internship_backend_2022/internal/service"
+	"io"
+	"os"
+)
+
+// runReconcile implements the "reconcile" subcommand:
+//
+//	reconcile [-format json|csv] [-output file] [-fix]
+//
+// It exits with 1 when discrepancies were found and 2 on errors. A fix run
+// that fails midway still prints the adjustments it made.
+func runReconcile(svc service.Service, args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	format := flags.String("format", reconcile.FormatJSON, "report format: json or csv")
+	output := flags.String("output", "", "write the report to this file instead of stdout")
+	fix := flags.Bool("fix", false, "write adjustment transactions for every discrepancy")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *format != reconcile.FormatJSON && *format != reconcile.FormatCSV {
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		defer file.Close()
+		w = file
+	}
+
+	report, reconcileErr := svc.Reconcile(context.Background(), *fix)
+	if reconcileErr != nil {
+		fmt.Fprintln(os.Stderr, reconcileErr)
+	}
+	if reconcileErr == nil || len(report.Adjustments) > 0 {
+		if err := reconcile.Write(w, report, *format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	switch {
+	case reconcileErr != nil:
+		return 2
+	case len(report.Discrepancies) > 0:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/service"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Error codes returned in the "code" field of an error response.
+const (
+	codeBadRequest          = "bad_request"
+	codeInvalidAmount       = "invalid_amount"
+	codeValidation          = "validation_error"
+	codeUserNotFound        = "user_not_found"
+	codeReservationNotFound = "reservation_not_found"
+	codeReservationExpired  = "reservation_expired"
+	codeInsufficientFunds   = "insufficient_funds"
+	codePayoutNotFound      = "payout_not_found"
+	codeNothingToRefund     = "nothing_to_refund"
+	codeIdempotencyConflict = "idempotency_key_reused"
+	codeAccountFrozen       = "account_frozen"
+	codeAccountClosed       = "account_closed"
+	codeAccountNotEmpty     = "account_not_empty"
+	codeInvalidTransition   = "invalid_status_transition"
+	codeBatchRejected       = "batch_rejected"
+	codeOrderExists         = "order_exists"
+	codeOrderNotFound       = "order_not_found"
+	codeOrderTransition     = "invalid_order_transition"
+	codeLimitExceeded       = "limit_exceeded"
+	codeLimitNotFound       = "limit_not_found"
+	codeFeeRuleNotFound     = "fee_rule_not_found"
+	codeInvalidSignature    = "invalid_signature"
+	codePaymentConflict     = "external_payment_conflict"
+	codeDepositNotFound     = "deposit_not_found"
+	codeDepositReversed     = "deposit_already_reversed"
+	codeServiceNotFound     = "service_not_found"
+	codeServiceExists       = "service_exists"
+	codeServiceInactive     = "service_inactive"
+	codeReportNotFound      = "report_not_found"
+	codeReportNotReady      = "report_not_ready"
+	codeReportExpired       = "report_expired"
+	codeInternal            = "internal_error"
+)
+
+type errorDetail struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type errorBody struct {
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	Details []errorDetail `json:"details,omitempty"`
+}
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string, details ...errorDetail) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(errorResponse{Error: errorBody{Code: code, Message: message, Details: details}}); err != nil {
+		log.Print(err)
+	}
+}
+
+// writeDecodeError reports a malformed request body, naming amount problems
+// explicitly.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrInvalidAmount) || errors.Is(err, models.ErrAmountPrecision) || errors.Is(err, models.ErrAmountRange) {
+		writeError(w, http.StatusBadRequest, codeInvalidAmount, err.Error())
+		return
+	}
+	writeError(w, http.StatusBadRequest, codeBadRequest, "malformed request body")
+}
+
+// writeServiceError maps an error returned by the service to an HTTP response.
+// Unknown errors are logged and hidden behind a generic 500.
+func writeServiceError(w http.ResponseWriter, err error) {
+	var validationErr *service.ValidationError
+	var batchErr *service.BatchError
+	var limitErr *service.LimitExceededError
+	switch {
+	case errors.As(err, &batchErr):
+		details := make([]errorDetail, 0, len(batchErr.Failed))
+		for _, item := range batchErr.Failed {
+			details = append(details, errorDetail{Field: fmt.Sprintf("operations[%d]", item.Index), Message: item.Error})
+		}
+		writeError(w, http.StatusUnprocessableEntity, codeBatchRejected, err.Error(), details...)
+	case errors.As(err, &limitErr):
+		details := []errorDetail{{Field: "window_seconds", Message: strconv.Itoa(limitErr.Limit.WindowSeconds)}}
+		if limitErr.RemainingAmount != nil {
+			details = append(details, errorDetail{Field: "remaining_amount", Message: limitErr.RemainingAmount.String()})
+		}
+		if limitErr.RemainingCount != nil {
+			details = append(details, errorDetail{Field: "remaining_count", Message: strconv.Itoa(*limitErr.RemainingCount)})
+		}
+		writeError(w, http.StatusTooManyRequests, codeLimitExceeded, err.Error(), details...)
+	case errors.As(err, &validationErr):
+		writeError(w, http.StatusUnprocessableEntity, codeValidation, err.Error(), errorDetail{Field: validationErr.Field, Message: validationErr.Message})
+	case errors.Is(err, service.ErrValidation):
+		writeError(w, http.StatusUnprocessableEntity, codeValidation, err.Error())
+	case errors.Is(err, service.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, codeUserNotFound, err.Error())
+	case errors.Is(err, service.ErrReservationNotFound):
+		writeError(w, http.StatusNotFound, codeReservationNotFound, err.Error())
+	case errors.Is(err, service.ErrReservationExpired):
+		writeError(w, http.StatusConflict, codeReservationExpired, err.Error())
+	case errors.Is(err, service.ErrOrderNotFound):
+		writeError(w, http.StatusNotFound, codeOrderNotFound, err.Error())
+	case errors.Is(err, service.ErrOrderExists):
+		writeError(w, http.StatusConflict, codeOrderExists, err.Error())
+	case errors.Is(err, service.ErrInvalidOrderTransition):
+		writeError(w, http.StatusConflict, codeOrderTransition, err.Error())
+	case errors.Is(err, service.ErrLimitNotFound):
+		writeError(w, http.StatusNotFound, codeLimitNotFound, err.Error())
+	case errors.Is(err, service.ErrFeeRuleNotFound):
+		writeError(w, http.StatusNotFound, codeFeeRuleNotFound, err.Error())
+	case errors.Is(err, service.ErrPayoutNotFound):
+		writeError(w, http.StatusNotFound, codePayoutNotFound, err.Error())
+	case errors.Is(err, service.ErrNothingToRefund):
+		writeError(w, http.StatusConflict, codeNothingToRefund, err.Error())
+	case errors.Is(err, service.ErrServiceNotFound):
+		writeError(w, http.StatusNotFound, codeServiceNotFound, err.Error())
+	case errors.Is(err, service.ErrServiceExists):
+		writeError(w, http.StatusConflict, codeServiceExists, err.Error())
+	case errors.Is(err, service.ErrServiceInactive):
+		writeError(w, http.StatusConflict, codeServiceInactive, err.Error())
+	case errors.Is(err, service.ErrReportNotFound):
+		writeError(w, http.StatusNotFound, codeReportNotFound, err.Error())
+	case errors.Is(err, service.ErrReportNotReady):
+		writeError(w, http.StatusConflict, codeReportNotReady, err.Error())
+	case errors.Is(err, service.ErrReportExpired):
+		writeError(w, http.StatusGone, codeReportExpired, err.Error())
+	case errors.Is(err, service.ErrDepositNotFound):
+		writeError(w, http.StatusNotFound, codeDepositNotFound, err.Error())
+	case errors.Is(err, service.ErrDepositAlreadyReversed):
+		writeError(w, http.StatusConflict, codeDepositReversed, err.Error())
+	case errors.Is(err, service.ErrExternalPaymentConflict):
+		writeError(w, http.StatusConflict, codePaymentConflict, err.Error())
+	case errors.Is(err, service.ErrInsufficientFunds):
+		writeError(w, http.StatusConflict, codeInsufficientFunds, err.Error())
+	case errors.Is(err, service.ErrAccountFrozen):
+		writeError(w, http.StatusConflict, codeAccountFrozen, err.Error())
+	case errors.Is(err, service.ErrAccountClosed):
+		writeError(w, http.StatusConflict, codeAccountClosed, err.Error())
+	case errors.Is(err, service.ErrAccountNotEmpty):
+		writeError(w, http.StatusConflict, codeAccountNotEmpty, err.Error())
+	case errors.Is(err, service.ErrInvalidStatusTransition):
+		writeError(w, http.StatusConflict, codeInvalidTransition, err.Error())
+	case errors.Is(err, service.ErrIdempotencyKeyReused):
+		writeError(w, http.StatusUnprocessableEntity, codeIdempotencyConflict, err.Error())
+	default:
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, codeInternal, "internal server error")
+	}
+}
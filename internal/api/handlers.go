@@ -1,220 +1,443 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"internship_backend_2022/internal/billing"
 	"internship_backend_2022/internal/models"
 	"internship_backend_2022/internal/service"
+	"io"
 	"log"
-	"math/big"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxWebhookBodySize bounds the body read before its signature is checked.
+const maxWebhookBodySize = 1 << 20
+
 type handler struct {
 	service service.Service
+	// billing verifies billing webhooks; nil disables the endpoint.
+	billing *billing.Verifier
 }
 
-func NewHandler(service service.Service) *handler {
+func NewHandler(service service.Service, verifier *billing.Verifier) *handler {
 	return &handler{
 		service: service,
+		billing: verifier,
 	}
 }
 
-
 func (h *handler) Deposit(w http.ResponseWriter, r *http.Request) {
-	
-	type DepositRequestDTO struct {
-    UserID int           `json:"user_id"`
-    Amount json.Number `json:"amount"`
+	var DepositRequest models.DepositRequest
+	ctx := r.Context()
+	err := json.NewDecoder(r.Body).Decode(&DepositRequest)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	DepositRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
+
+	DepositResponse, err := h.service.Deposit(ctx, DepositRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(DepositResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+// BillingWebhook credits a card payment reported by the billing service. The
+// signature is checked against the raw body before it is decoded.
+func (h *handler) BillingWebhook(w http.ResponseWriter, r *http.Request) {
+	if h.billing == nil {
+		writeError(w, http.StatusNotFound, codeBadRequest, "billing webhook is not configured")
+		return
 	}
-	var dto DepositRequestDTO
 	ctx := r.Context()
-	err := json.NewDecoder(r.Body).Decode(&dto)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
 	if err != nil {
-		http.Error(w,"bad request",http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "malformed request body")
+		return
+	}
+	if err := h.billing.Verify(r.Header.Get(billing.TimestampHeader), r.Header.Get(billing.SignatureHeader), body); err != nil {
+		writeError(w, http.StatusUnauthorized, codeInvalidSignature, err.Error())
 		return
 	}
 
-	amount, err := dto.Amount.Float64()
-    if err != nil {
-        http.Error(w, "invalid amount format", http.StatusBadRequest)
-        return
-    }
+	var BillingDepositRequest models.BillingDepositRequest
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&BillingDepositRequest); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
 
-	DepositRequest := models.DepositRequest{
-        UserID: dto.UserID,
-        Amount: big.NewFloat(amount),
-    }
+	DepositResponse, err := h.service.BillingDeposit(ctx, BillingDepositRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
 
-	
-	fmt.Println(DepositRequest)
-	DepositResponse,err := h.service.Deposit(ctx,DepositRequest)
-	if err != nil { 
+	if err := json.NewEncoder(w).Encode(DepositResponse); err != nil {
 		log.Print(err)
-		http.Error(w,"internal server error",http.StatusInternalServerError)
 		return
 	}
-	
+}
 
-	if err := json.NewEncoder(w).Encode(DepositResponse); err != nil {
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+func (h *handler) ReverseDeposit(w http.ResponseWriter, r *http.Request) {
+	var DepositReversalRequest models.DepositReversalRequest
+	ctx := r.Context()
+	depositID, err := strconv.Atoi(mux.Vars(r)["deposit_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid deposit id", errorDetail{Field: "deposit_id", Message: "must be an integer"})
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&DepositReversalRequest); err != nil && !errors.Is(err, io.EOF) {
+		writeDecodeError(w, err)
+		return
+	}
+	DepositReversalRequest.DepositID = depositID
+	DepositReversalRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
+
+	DepositReversalResponse, err := h.service.ReverseDeposit(ctx, DepositReversalRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(DepositReversalResponse); err != nil {
+		log.Print(err)
 		return
 	}
 }
 
 func (h *handler) GetUserBalance(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w,"method not allowed",http.StatusMethodNotAllowed)
-		return 
+		writeError(w, http.StatusMethodNotAllowed, codeBadRequest, "method not allowed")
+		return
 	}
 	ctx := r.Context()
 	params := mux.Vars(r)
-	fmt.Println(params["user_id"])
-	userID,err := strconv.Atoi(params["user_id"])
+	userID, err := strconv.Atoi(params["user_id"])
 	if err != nil {
-		http.Error(w,"bad request",http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid user_id", errorDetail{Field: "user_id", Message: "must be an integer"})
 		return
 	}
 
-	BalanceResponse, err := h.service.GetUserBalance(ctx,userID)
-	if err != nil { 
-		log.Print(err)
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+	var BalanceResponse models.BalanceResponse
+	if at := r.URL.Query().Get("at"); at != "" {
+		atTime, parseErr := time.Parse(time.RFC3339, at)
+		if parseErr != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "invalid at", errorDetail{Field: "at", Message: "must be an RFC 3339 timestamp"})
+			return
+		}
+		BalanceResponse, err = h.service.GetUserBalanceAt(ctx, userID, atTime)
+	} else {
+		BalanceResponse, err = h.service.GetUserBalance(ctx, userID)
+	}
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
 	if err := json.NewEncoder(w).Encode(BalanceResponse); err != nil {
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+		log.Print(err)
 		return
 	}
 }
 
+func (h *handler) Reserve(w http.ResponseWriter, r *http.Request) {
+	var ReserveRequest models.ReserveRequest
+	ctx := r.Context()
+	err := json.NewDecoder(r.Body).Decode(&ReserveRequest)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	ReserveRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
+
+	ReserveResponse, err := h.service.Reserve(ctx, ReserveRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(ReserveResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
 
-func (h *handler)Reserve(w http.ResponseWriter, r *http.Request) {
-	
+func (h *handler) Confirm(w http.ResponseWriter, r *http.Request) {
+	var ConfirmRequest models.ConfirmRequest
+	ctx := r.Context()
+	err := json.NewDecoder(r.Body).Decode(&ConfirmRequest)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	ConfirmRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
 
-	type ReserveRequestDTO struct {
-    UserID    int      `json:"user_id"`
-    ServiceID int      `json:"service_id"`
-    OrderID   int      `json:"order_id"`
-    Amount    json.Number  `json:"amount"`
+	ConfirmResponse, err := h.service.Confirm(ctx, ConfirmRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
 	}
-	var dto ReserveRequestDTO
+	if err := json.NewEncoder(w).Encode(ConfirmResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) Unreserve(w http.ResponseWriter, r *http.Request) {
+	var UnreserveRequest models.UnreserveRequest
 	ctx := r.Context()
-	err := json.NewDecoder(r.Body).Decode(&dto)
+	err := json.NewDecoder(r.Body).Decode(&UnreserveRequest)
 	if err != nil {
-		http.Error(w,"bad request",http.StatusBadRequest)
+		writeDecodeError(w, err)
+		return
+	}
+
+	UnreserveResponse, err := h.service.Unreserve(ctx, UnreserveRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(UnreserveResponse); err != nil {
+		log.Print(err)
 		return
 	}
+}
 
-	amount, err := dto.Amount.Float64()
-    if err != nil {
-        http.Error(w, "invalid amount format", http.StatusBadRequest)
-        return
-    }
+func (h *handler) CreateOrder(w http.ResponseWriter, r *http.Request) {
+	var CreateOrderRequest models.CreateOrderRequest
+	ctx := r.Context()
+	err := json.NewDecoder(r.Body).Decode(&CreateOrderRequest)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	CreateOrderRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
 
-	ReserveRequest := models.ReserveRequest{
-		UserID:    dto.UserID,
-		ServiceID: dto.ServiceID,
-		OrderID:   dto.OrderID,
-		Amount:    big.NewFloat(amount),
+	CreateOrderResponse, err := h.service.CreateOrder(ctx, CreateOrderRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
 	}
-	ReserveResponse,err := h.service.Reserve(ctx,ReserveRequest)
-	if err != nil { 
+	if err := json.NewEncoder(w).Encode(CreateOrderResponse); err != nil {
 		log.Print(err)
-		http.Error(w,"internal server error",http.StatusInternalServerError)
 		return
 	}
-	if err := json.NewEncoder(w).Encode(ReserveResponse); err != nil {
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+}
+
+func (h *handler) GetOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	orderID, err := strconv.Atoi(mux.Vars(r)["order_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid order_id", errorDetail{Field: "order_id", Message: "must be an integer"})
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil || userID <= 0 {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid user_id", errorDetail{Field: "user_id", Message: "must be a positive integer"})
+		return
+	}
+
+	Order, err := h.service.GetOrder(ctx, userID, orderID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(Order); err != nil {
+		log.Print(err)
 		return
 	}
 }
-	
-func (h *handler)Confirm(w http.ResponseWriter, r *http.Request) {
-	
-	type ConfirmRequestDTO struct {
-	UserID    int      `json:"user_id"`
-	ServiceID int      `json:"service_id"`
-	OrderID   int      `json:"order_id"`
-	Amount    json.Number  `json:"amount"`
+
+func (h *handler) GetOrderItem(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+
+	serviceID, err := strconv.Atoi(vars["service_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid service_id", errorDetail{Field: "service_id", Message: "must be an integer"})
+		return
+	}
+	orderID, err := strconv.Atoi(vars["order_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid order_id", errorDetail{Field: "order_id", Message: "must be an integer"})
+		return
 	}
-	var dto ConfirmRequestDTO
+
+	OrderItemResponse, err := h.service.GetOrderItem(ctx, serviceID, orderID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(OrderItemResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) ExtendReservation(w http.ResponseWriter, r *http.Request) {
+	var ExtendRequest models.ExtendReservationRequest
 	ctx := r.Context()
-	err := json.NewDecoder(r.Body).Decode(&dto)
+	err := json.NewDecoder(r.Body).Decode(&ExtendRequest)
 	if err != nil {
-		http.Error(w,"bad request",http.StatusBadRequest)
+		writeDecodeError(w, err)
 		return
 	}
 
-	amount, err := dto.Amount.Float64()
+	ExtendResponse, err := h.service.ExtendReservation(ctx, ExtendRequest)
 	if err != nil {
-		http.Error(w, "invalid amount format", http.StatusBadRequest)
+		writeServiceError(w, err)
 		return
 	}
+	if err := json.NewEncoder(w).Encode(ExtendResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) Captures(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
 
-	ConfirmRequest := models.ConfirmRequest{
-		UserID:    dto.UserID,
-		ServiceID: dto.ServiceID,
-		OrderID:   dto.OrderID,
-		Amount:    big.NewFloat(amount),
+	serviceID, err := strconv.Atoi(vars["service_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid service_id", errorDetail{Field: "service_id", Message: "must be an integer"})
+		return
 	}
-	ConfirmResponse,err := h.service.Confirm(ctx,ConfirmRequest)
-	if err != nil { 
-		log.Print(err)	
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+	orderID, err := strconv.Atoi(vars["order_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid order_id", errorDetail{Field: "order_id", Message: "must be an integer"})
 		return
 	}
-	if err := json.NewEncoder(w).Encode(ConfirmResponse); err != nil {
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+
+	CapturesResponse, err := h.service.Captures(ctx, serviceID, orderID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(CapturesResponse); err != nil {
+		log.Print(err)
 		return
 	}
 }
 
+func (h *handler) Refund(w http.ResponseWriter, r *http.Request) {
+	var RefundRequest models.RefundRequest
+	ctx := r.Context()
+	err := json.NewDecoder(r.Body).Decode(&RefundRequest)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	RefundRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
 
-func (h *handler) Transfer(w http.ResponseWriter, r *http.Request) {
-	
+	RefundResponse, err := h.service.Refund(ctx, RefundRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(RefundResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
 
-	type TransferRequestDTO struct {
-	FromUserID    int      `json:"from_user_id"`
-	ToUserID   int      `json:"to_user_id"`
-	Amount    json.Number  `json:"amount"`
+func (h *handler) Withdraw(w http.ResponseWriter, r *http.Request) {
+	var WithdrawRequest models.WithdrawRequest
+	ctx := r.Context()
+	err := json.NewDecoder(r.Body).Decode(&WithdrawRequest)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
 	}
-	var dto TransferRequestDTO
+	WithdrawRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
+
+	WithdrawResponse, err := h.service.Withdraw(ctx, WithdrawRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(WithdrawResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) GetPayout(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	err := json.NewDecoder(r.Body).Decode(&dto)
+	payoutID, err := strconv.Atoi(mux.Vars(r)["payout_id"])
 	if err != nil {
-		http.Error(w,"bad request",http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid payout_id", errorDetail{Field: "payout_id", Message: "must be an integer"})
 		return
 	}
 
-	amount, err := dto.Amount.Float64()
+	Payout, err := h.service.GetPayout(ctx, payoutID)
 	if err != nil {
-		http.Error(w, "invalid amount format", http.StatusBadRequest)
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(Payout); err != nil {
+		log.Print(err)
 		return
 	}
+}
 
-	TransferRequest := models.TransferRequest{
-		FromUserID:    dto.FromUserID,
-		ToUserID:   dto.ToUserID,
-		Amount:    big.NewFloat(amount),
+func (h *handler) Transfer(w http.ResponseWriter, r *http.Request) {
+	var TransferRequest models.TransferRequest
+	ctx := r.Context()
+	err := json.NewDecoder(r.Body).Decode(&TransferRequest)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
 	}
-	TransferResponse,err := h.service.Transfer(ctx,TransferRequest)
-	if err != nil { 
-		log.Print(err)	
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+	TransferRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
+
+	TransferResponse, err := h.service.Transfer(ctx, TransferRequest)
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
 	if err := json.NewEncoder(w).Encode(TransferResponse); err != nil {
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) Batch(w http.ResponseWriter, r *http.Request) {
+	var BatchRequest models.BatchRequest
+	ctx := r.Context()
+	err := json.NewDecoder(r.Body).Decode(&BatchRequest)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	BatchRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
+
+	BatchResponse, err := h.service.Batch(ctx, BatchRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(BatchResponse); err != nil {
+		log.Print(err)
 		return
 	}
 }
 
-func (h *handler)MonthlyReport(w http.ResponseWriter, r *http.Request) {
-	
+func (h *handler) MonthlyReport(w http.ResponseWriter, r *http.Request) {
 
 	ctx := r.Context()
 	vars := mux.Vars(r)
@@ -223,57 +446,140 @@ func (h *handler)MonthlyReport(w http.ResponseWriter, r *http.Request) {
 
 	year, err := strconv.Atoi(yearStr)
 	if err != nil {
-		http.Error(w, "Invalid year", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid year")
 		return
 	}
 
 	month, err := strconv.Atoi(monthStr)
 	if err != nil {
-		http.Error(w, "Invalid month", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid month")
 		return
 	}
 
 	if year < 1900 || month < 1 || month > 12 {
-		http.Error(w, "Invalid date", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid date")
 		return
 	}
 
 	MonthlyReportRequest := models.MonthlyReportRequest{
-		Year: year,
+		Year:  year,
 		Month: month,
 	}
-	MonthlyReport, err := h.service.MonthlyReport(ctx,MonthlyReportRequest)
-	if err != nil { 
-		log.Print(err)	
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+	MonthlyReport, err := h.service.MonthlyReport(ctx, MonthlyReportRequest)
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
 
-	http.ServeFile(w, r, MonthlyReport.FilePath)
+	w.Header().Set("Content-Type", "text/csv")
+	if _, err := w.Write(MonthlyReport.Content); err != nil {
+		log.Print(err)
+		return
+	}
+}
 
+func (h *handler) CreateReport(w http.ResponseWriter, r *http.Request) {
+	var ReportRequest models.MonthlyReportRequest
+	ctx := r.Context()
+	err := json.NewDecoder(r.Body).Decode(&ReportRequest)
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+
+	Report, err := h.service.CreateReport(ctx, ReportRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.Header().Set("Location", reportStatusURL(Report.ID))
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(newReportJobResponse(Report)); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) GetReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reportID, err := strconv.Atoi(mux.Vars(r)["report_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid report_id", errorDetail{Field: "report_id", Message: "must be an integer"})
+		return
+	}
+
+	Report, err := h.service.GetReport(ctx, reportID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(newReportJobResponse(Report)); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) DownloadReport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	reportID, err := strconv.Atoi(mux.Vars(r)["report_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid report_id", errorDetail{Field: "report_id", Message: "must be an integer"})
+		return
+	}
+
+	Report, file, err := h.service.OpenReport(ctx, reportID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", Report.FileName()))
+	if _, err := io.Copy(w, file); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func reportStatusURL(reportID int) string {
+	return fmt.Sprintf("/reports/%d", reportID)
+}
+
+// newReportJobResponse adds the URLs to poll the job and, once it completed,
+// to download the file.
+func newReportJobResponse(job models.ReportJob) models.ReportJobResponse {
+	response := models.ReportJobResponse{
+		ReportJob: job,
+		StatusURL: reportStatusURL(job.ID),
+	}
+	if job.Status == models.ReportCompleted {
+		response.DownloadURL = reportStatusURL(job.ID) + "/download"
+	}
+	return response
 }
 
 func (h *handler) Transactions(w http.ResponseWriter, r *http.Request) {
 	var TransactionRequest models.TransactionRequest
 	var err error
-	
+
 	ctx := r.Context()
 
 	queryParams := r.URL.Query()
 
-	TransactionRequest.UserId,err = strconv.Atoi(queryParams.Get("user_id")) 
+	TransactionRequest.UserId, err = strconv.Atoi(queryParams.Get("user_id"))
 	if err != nil || TransactionRequest.UserId <= 0 {
-		http.Error(w,"bad request",http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid user_id", errorDetail{Field: "user_id", Message: "must be a positive integer"})
 		return
 	}
-	TransactionRequest.Page,err = strconv.Atoi(queryParams.Get("page")) 
+	TransactionRequest.Page, err = strconv.Atoi(queryParams.Get("page"))
 	if err != nil || TransactionRequest.Page <= 0 {
-		http.Error(w,"bad request",http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid page", errorDetail{Field: "page", Message: "must be a positive integer"})
 		return
 	}
-	TransactionRequest.Limit,err = strconv.Atoi(queryParams.Get("limit")) 
+	TransactionRequest.Limit, err = strconv.Atoi(queryParams.Get("limit"))
 	if err != nil || TransactionRequest.Limit <= 0 {
-		http.Error(w,"bad request",http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid limit", errorDetail{Field: "limit", Message: "must be a positive integer"})
 		return
 	}
 
@@ -286,16 +592,390 @@ func (h *handler) Transactions(w http.ResponseWriter, r *http.Request) {
 		TransactionRequest.SortOrder = "desc"
 	}
 
-	TransactionReposnse,err := h.service.Transactions(ctx,TransactionRequest)
+	TransactionReposnse, err := h.service.Transactions(ctx, TransactionRequest)
 
-	if err != nil { 
-		log.Print(err)	
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+	if err != nil {
+		writeServiceError(w, err)
 		return
 	}
 	if err := json.NewEncoder(w).Encode(TransactionReposnse); err != nil {
-		http.Error(w,"internal server error",http.StatusInternalServerError)
+		log.Print(err)
+		return
+	}
+
+}
+
+func (h *handler) Reservations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	queryParams := r.URL.Query()
+
+	ReservationFilter := models.ReservationFilter{
+		Page:      1,
+		Limit:     50,
+		SortBy:    "created_at",
+		SortOrder: "asc",
+	}
+
+	intParams := []struct {
+		name     string
+		dest     *int
+		positive bool
+	}{
+		{"user_id", &ReservationFilter.UserID, true},
+		{"service_id", &ReservationFilter.ServiceID, false},
+		{"page", &ReservationFilter.Page, true},
+		{"limit", &ReservationFilter.Limit, true},
+	}
+	for _, param := range intParams {
+		value := queryParams.Get(param.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || (param.positive && parsed == 0) {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "invalid "+param.name, errorDetail{Field: param.name, Message: "must be a positive integer"})
+			return
+		}
+		*param.dest = parsed
+	}
+
+	timeParams := []struct {
+		name string
+		dest **time.Time
+	}{
+		{"created_from", &ReservationFilter.CreatedFrom},
+		{"created_to", &ReservationFilter.CreatedTo},
+		{"expires_from", &ReservationFilter.ExpiresFrom},
+		{"expires_to", &ReservationFilter.ExpiresTo},
+	}
+	for _, param := range timeParams {
+		value := queryParams.Get(param.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "invalid "+param.name, errorDetail{Field: param.name, Message: "must be an RFC 3339 timestamp"})
+			return
+		}
+		*param.dest = &parsed
+	}
+
+	if sortBy := queryParams.Get("sort_by"); sortBy != "" {
+		ReservationFilter.SortBy = sortBy
+	}
+	if sortOrder := queryParams.Get("sort_order"); sortOrder != "" {
+		ReservationFilter.SortOrder = sortOrder
+	}
+
+	ReservationsResponse, err := h.service.Reservations(ctx, ReservationFilter)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(ReservationsResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) VerifyLedger(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	LedgerReport, err := h.service.VerifyLedger(ctx)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(LedgerReport); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) FreezeAccount(w http.ResponseWriter, r *http.Request) {
+	h.changeAccountStatus(w, r, h.service.FreezeAccount)
+}
+
+func (h *handler) UnfreezeAccount(w http.ResponseWriter, r *http.Request) {
+	h.changeAccountStatus(w, r, h.service.UnfreezeAccount)
+}
+
+func (h *handler) CloseAccount(w http.ResponseWriter, r *http.Request) {
+	h.changeAccountStatus(w, r, h.service.CloseAccount)
+}
+
+// changeAccountStatus decodes the optional request body and applies one of the
+// account status operations to the user in the path.
+func (h *handler) changeAccountStatus(w http.ResponseWriter, r *http.Request, apply func(context.Context, models.AccountStatusRequest) (models.AccountStatusResponse, error)) {
+	var AccountStatusRequest models.AccountStatusRequest
+	ctx := r.Context()
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid user_id", errorDetail{Field: "user_id", Message: "must be an integer"})
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&AccountStatusRequest); err != nil && !errors.Is(err, io.EOF) {
+		writeDecodeError(w, err)
+		return
+	}
+	AccountStatusRequest.UserID = userID
+
+	AccountStatusResponse, err := apply(ctx, AccountStatusRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(AccountStatusResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) Limits(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var userID *int
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "invalid user_id", errorDetail{Field: "user_id", Message: "must be a non-negative integer"})
+			return
+		}
+		userID = &parsed
+	}
+
+	LimitsResponse, err := h.service.Limits(ctx, userID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(LimitsResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) SetLimit(w http.ResponseWriter, r *http.Request) {
+	var Limit models.Limit
+	ctx := r.Context()
+	if err := json.NewDecoder(r.Body).Decode(&Limit); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+
+	Limit, err := h.service.SetLimit(ctx, Limit)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(Limit); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+// DeleteLimit removes the limit named by the user_id (default 0, the global
+// limit), operation and window_seconds query parameters.
+func (h *handler) DeleteLimit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	queryParams := r.URL.Query()
+
+	Limit := models.Limit{Operation: models.LimitOperation(queryParams.Get("operation"))}
+	intParams := []struct {
+		name     string
+		dest     *int
+		required bool
+	}{
+		{"user_id", &Limit.UserID, false},
+		{"window_seconds", &Limit.WindowSeconds, true},
+	}
+	for _, param := range intParams {
+		value := queryParams.Get(param.name)
+		if value == "" && !param.required {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, codeBadRequest, "invalid "+param.name, errorDetail{Field: param.name, Message: "must be a non-negative integer"})
+			return
+		}
+		*param.dest = parsed
+	}
+
+	if err := h.service.DeleteLimit(ctx, Limit); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) FeeRules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	FeeRulesResponse, err := h.service.FeeRules(ctx)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(FeeRulesResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) SetFeeRule(w http.ResponseWriter, r *http.Request) {
+	var FeeRule models.FeeRule
+	ctx := r.Context()
+	if err := json.NewDecoder(r.Body).Decode(&FeeRule); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+
+	FeeRule, err := h.service.SetFeeRule(ctx, FeeRule)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(FeeRule); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) DeleteFeeRule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	serviceID, err := strconv.Atoi(vars["service_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid service_id", errorDetail{Field: "service_id", Message: "must be an integer"})
+		return
+	}
+
+	if err := h.service.DeleteFeeRule(ctx, models.FeeOperation(vars["operation"]), serviceID); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) GrantBonus(w http.ResponseWriter, r *http.Request) {
+	var BonusGrantRequest models.BonusGrantRequest
+	ctx := r.Context()
+	userID, err := strconv.Atoi(mux.Vars(r)["user_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid user_id", errorDetail{Field: "user_id", Message: "must be an integer"})
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&BonusGrantRequest); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	BonusGrantRequest.UserID = userID
+	BonusGrantRequest.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
+
+	BonusGrantResponse, err := h.service.GrantBonus(ctx, BonusGrantRequest)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(BonusGrantResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) Services(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	ServicesResponse, err := h.service.Services(ctx)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(ServicesResponse); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) GetService(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	serviceID, err := strconv.Atoi(mux.Vars(r)["service_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid service_id", errorDetail{Field: "service_id", Message: "must be an integer"})
+		return
+	}
+
+	Service, err := h.service.GetService(ctx, serviceID)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(Service); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+// CreateService adds a catalog entry; active defaults to true.
+func (h *handler) CreateService(w http.ResponseWriter, r *http.Request) {
+	Service := models.Service{Active: true}
+	ctx := r.Context()
+	if err := json.NewDecoder(r.Body).Decode(&Service); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+
+	Service, err := h.service.CreateService(ctx, Service)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(Service); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+// UpdateService replaces the name, category and active flag of the service in
+// the path; active defaults to true.
+func (h *handler) UpdateService(w http.ResponseWriter, r *http.Request) {
+	Service := models.Service{Active: true}
+	ctx := r.Context()
+	serviceID, err := strconv.Atoi(mux.Vars(r)["service_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid service_id", errorDetail{Field: "service_id", Message: "must be an integer"})
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&Service); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	Service.ID = serviceID
+
+	Service, err = h.service.UpdateService(ctx, Service)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(Service); err != nil {
+		log.Print(err)
+		return
+	}
+}
+
+func (h *handler) DeleteService(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	serviceID, err := strconv.Atoi(mux.Vars(r)["service_id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeBadRequest, "invalid service_id", errorDetail{Field: "service_id", Message: "must be an integer"})
+		return
+	}
+
+	if err := h.service.DeleteService(ctx, serviceID); err != nil {
+		writeServiceError(w, err)
 		return
 	}
-	
+	w.WriteHeader(http.StatusNoContent)
 }
\ No newline at end of file
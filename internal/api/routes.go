@@ -2,16 +2,48 @@ package api
 
 import "github.com/gorilla/mux"
 
-func SetupRouter(handler *handler) *mux.Router{
+func SetupRouter(handler *handler) *mux.Router {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/deposit", handler.Deposit).Methods("POST")
 	router.HandleFunc("/balance/{user_id:[0-9]+}", handler.GetUserBalance).Methods("GET")
-	router.HandleFunc("/reserve",handler.Reserve).Methods("POST")
-	router.HandleFunc("/confirm",handler.Confirm).Methods("POST")
-	router.HandleFunc("/transfer",handler.Transfer).Methods("POST")
-	router.HandleFunc("/MonthlyReport/{year}/{month}",handler.MonthlyReport).Methods("GET")
-	router.HandleFunc("/transactions/",handler.Transactions).Methods("GET")
+	router.HandleFunc("/reserve", handler.Reserve).Methods("POST")
+	router.HandleFunc("/confirm", handler.Confirm).Methods("POST")
+	router.HandleFunc("/unreserve", handler.Unreserve).Methods("POST")
+	router.HandleFunc("/orders", handler.CreateOrder).Methods("POST")
+	router.HandleFunc("/orders/{order_id:[0-9]+}", handler.GetOrder).Methods("GET")
+	router.HandleFunc("/orders/{service_id:[0-9]+}/{order_id:[0-9]+}", handler.GetOrderItem).Methods("GET")
+	router.HandleFunc("/reservations", handler.Reservations).Methods("GET")
+	router.HandleFunc("/reservations/extend", handler.ExtendReservation).Methods("POST")
+	router.HandleFunc("/captures/{service_id:[0-9]+}/{order_id:[0-9]+}", handler.Captures).Methods("GET")
+	router.HandleFunc("/transfer", handler.Transfer).Methods("POST")
+	router.HandleFunc("/batch", handler.Batch).Methods("POST")
+	router.HandleFunc("/refund", handler.Refund).Methods("POST")
+	router.HandleFunc("/webhooks/billing", handler.BillingWebhook).Methods("POST")
+	router.HandleFunc("/deposits/{deposit_id:[0-9]+}/reverse", handler.ReverseDeposit).Methods("POST")
+	router.HandleFunc("/withdraw", handler.Withdraw).Methods("POST")
+	router.HandleFunc("/payouts/{payout_id:[0-9]+}", handler.GetPayout).Methods("GET")
+	router.HandleFunc("/MonthlyReport/{year}/{month}", handler.MonthlyReport).Methods("GET")
+	router.HandleFunc("/reports", handler.CreateReport).Methods("POST")
+	router.HandleFunc("/reports/{report_id:[0-9]+}", handler.GetReport).Methods("GET")
+	router.HandleFunc("/reports/{report_id:[0-9]+}/download", handler.DownloadReport).Methods("GET")
+	router.HandleFunc("/transactions/", handler.Transactions).Methods("GET")
+	router.HandleFunc("/ledger/verify", handler.VerifyLedger).Methods("GET")
+	router.HandleFunc("/admin/users/{user_id:[0-9]+}/freeze", handler.FreezeAccount).Methods("POST")
+	router.HandleFunc("/admin/users/{user_id:[0-9]+}/unfreeze", handler.UnfreezeAccount).Methods("POST")
+	router.HandleFunc("/admin/users/{user_id:[0-9]+}/close", handler.CloseAccount).Methods("POST")
+	router.HandleFunc("/admin/users/{user_id:[0-9]+}/bonus", handler.GrantBonus).Methods("POST")
+	router.HandleFunc("/admin/limits", handler.Limits).Methods("GET")
+	router.HandleFunc("/admin/limits", handler.SetLimit).Methods("PUT")
+	router.HandleFunc("/admin/limits", handler.DeleteLimit).Methods("DELETE")
+	router.HandleFunc("/admin/fees", handler.FeeRules).Methods("GET")
+	router.HandleFunc("/admin/fees", handler.SetFeeRule).Methods("PUT")
+	router.HandleFunc("/admin/fees/{operation}/{service_id:[0-9]+}", handler.DeleteFeeRule).Methods("DELETE")
+	router.HandleFunc("/admin/services", handler.Services).Methods("GET")
+	router.HandleFunc("/admin/services", handler.CreateService).Methods("POST")
+	router.HandleFunc("/admin/services/{service_id:[0-9]+}", handler.GetService).Methods("GET")
+	router.HandleFunc("/admin/services/{service_id:[0-9]+}", handler.UpdateService).Methods("PUT")
+	router.HandleFunc("/admin/services/{service_id:[0-9]+}", handler.DeleteService).Methods("DELETE")
 
 	return router
 }
\ No newline at end of file
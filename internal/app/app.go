@@ -4,12 +4,41 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"internship_backend_2022/internal/models"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
 	DBConnStr string
+	// ReservationTTL is the default lifetime of a hold, zero means no expiry.
+	ReservationTTL time.Duration
+	// ServiceReservationTTLs overrides ReservationTTL per service id.
+	ServiceReservationTTLs map[int]time.Duration
+	// The worker intervals below schedule background jobs; zero disables a job.
+	ReservationSweepInterval time.Duration
+	PayoutProcessInterval    time.Duration
+	// ReconcileInterval schedules the reconciliation job, zero disables it.
+	ReconcileInterval time.Duration
+	// ReconcileFix lets the scheduled job write adjustment transactions.
+	ReconcileFix bool
+	// BonusPriority decides whether holds draw on bonus or real money first.
+	BonusPriority       models.BonusPriority
+	BonusExpiryInterval time.Duration
+	// BillingWebhookSecret signs billing webhooks, empty disables them.
+	BillingWebhookSecret string
+	// BillingWebhookTolerance is how far a webhook timestamp may be from now.
+	BillingWebhookTolerance time.Duration
+	// ReportStorageDir is where generated reports are stored.
+	ReportStorageDir string
+	// ReportTTL is how long a generated report can be downloaded.
+	ReportTTL             time.Duration
+	ReportProcessInterval time.Duration
+	ReportCleanupInterval time.Duration
 }
 
 func NewConfig() *Config {
@@ -30,7 +59,92 @@ func NewConfig() *Config {
 
 	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=%s", dbUser, dbPassword, dbHost, dbPort, dbName, dbSSLMode)
 
+	serviceTTLs, err := parseServiceDurations(os.Getenv("RESERVATION_TTL_BY_SERVICE"))
+	if err != nil {
+		log.Fatalf("RESERVATION_TTL_BY_SERVICE: %v", err)
+	}
+
+	bonusPriority := models.BonusPriority(os.Getenv("BONUS_PRIORITY"))
+	if bonusPriority == "" {
+		bonusPriority = models.BonusFirst
+	}
+	if !bonusPriority.Valid() {
+		log.Fatalf("BONUS_PRIORITY must be %s or %s, got %q", models.BonusFirst, models.RealFirst, bonusPriority)
+	}
+
+	reportStorageDir := os.Getenv("REPORT_STORAGE_DIR")
+	if reportStorageDir == "" {
+		reportStorageDir = "reports"
+	}
+
 	return &Config{
-		DBConnStr: connStr,
+		DBConnStr:                connStr,
+		ReservationTTL:           durationEnv("RESERVATION_TTL", 0),
+		ServiceReservationTTLs:   serviceTTLs,
+		ReservationSweepInterval: durationEnv("RESERVATION_SWEEP_INTERVAL", time.Minute),
+		PayoutProcessInterval:    durationEnv("PAYOUT_PROCESS_INTERVAL", 30*time.Second),
+		ReconcileInterval:        durationEnv("RECONCILE_INTERVAL", 0),
+		ReconcileFix:             boolEnv("RECONCILE_FIX"),
+		BonusPriority:            bonusPriority,
+		BonusExpiryInterval:      durationEnv("BONUS_EXPIRY_INTERVAL", time.Minute),
+		BillingWebhookSecret:     os.Getenv("BILLING_WEBHOOK_SECRET"),
+		BillingWebhookTolerance:  durationEnv("BILLING_WEBHOOK_TOLERANCE", 5*time.Minute),
+		ReportStorageDir:         reportStorageDir,
+		ReportTTL:                durationEnv("REPORT_TTL", 24*time.Hour),
+		ReportProcessInterval:    durationEnv("REPORT_PROCESS_INTERVAL", 5*time.Second),
+		ReportCleanupInterval:    durationEnv("REPORT_CLEANUP_INTERVAL", 10*time.Minute),
+	}
+}
+
+// durationEnv reads a time.ParseDuration value such as "30m" from the
+// environment, falling back to def when the variable is unset.
+func durationEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Fatalf("%s must be a non-negative duration, got %q", name, value)
+	}
+	return d
+}
+
+// boolEnv reads a strconv.ParseBool value from the environment, defaulting to
+// false when the variable is unset.
+func boolEnv(name string) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be a boolean, got %q", name, value)
+	}
+	return b
+}
+
+// parseServiceDurations parses "service_id=duration" pairs separated by
+// commas, e.g. "1=1h,2=15m".
+func parseServiceDurations(value string) (map[int]time.Duration, error) {
+	durations := make(map[int]time.Duration)
+	if value == "" {
+		return durations, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		idStr, durationStr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid pair %q", pair)
+		}
+		serviceID, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service id %q", idStr)
+		}
+		d, err := time.ParseDuration(durationStr)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid duration %q", durationStr)
+		}
+		durations[serviceID] = d
 	}
+	return durations, nil
 }
\ No newline at end of file
@@ -0,0 +1,76 @@
+// Package billing authenticates webhooks sent by the billing service.
+//
+// The billing service signs each request with HMAC-SHA256 over
+// "<timestamp>.<body>", where timestamp is the Unix time in seconds sent in
+// TimestampHeader, and sends the hex digest in SignatureHeader as
+// "sha256=<digest>".
+package billing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TimestampHeader = "X-Billing-Timestamp"
+	SignatureHeader = "X-Billing-Signature"
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStaleTimestamp   = errors.New("webhook timestamp outside the allowed window")
+)
+
+// Verifier checks webhook signatures with a shared secret. Requests whose
+// timestamp is further than Tolerance from now are rejected so a captured
+// request cannot be replayed later.
+type Verifier struct {
+	secret    []byte
+	tolerance time.Duration
+	now       func() time.Time
+}
+
+func NewVerifier(secret string, tolerance time.Duration) *Verifier {
+	return &Verifier{secret: []byte(secret), tolerance: tolerance, now: time.Now}
+}
+
+// Sign returns the signature header value for body sent at timestamp.
+func (v *Verifier) Sign(timestamp int64, body []byte) string {
+	return signaturePrefix + hex.EncodeToString(v.mac(strconv.FormatInt(timestamp, 10), body))
+}
+
+// Verify checks the timestamp and signature header values of a request.
+func (v *Verifier) Verify(timestamp string, signature string, body []byte) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	digest, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil || !strings.HasPrefix(signature, signaturePrefix) {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal(digest, v.mac(timestamp, body)) {
+		return ErrInvalidSignature
+	}
+
+	age := v.now().Sub(time.Unix(seconds, 0))
+	if age > v.tolerance || age < -v.tolerance {
+		return ErrStaleTimestamp
+	}
+	return nil
+}
+
+func (v *Verifier) mac(timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,80 @@
+package billing
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifier_Verify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	verifier := NewVerifier("secret", 5*time.Minute)
+	verifier.now = func() time.Time { return now }
+	body := []byte(`{"external_payment_id":"pay_1","user_id":1,"amount":"10.00"}`)
+	fresh := now.Add(-time.Minute).Unix()
+	stale := now.Add(-10 * time.Minute).Unix()
+
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      []byte
+		wantErr   error
+	}{
+		{
+			name:      "Valid signature",
+			timestamp: strconv.FormatInt(fresh, 10),
+			signature: verifier.Sign(fresh, body),
+			body:      body,
+		},
+		{
+			name:      "Tampered body",
+			timestamp: strconv.FormatInt(fresh, 10),
+			signature: verifier.Sign(fresh, body),
+			body:      []byte(`{"external_payment_id":"pay_1","user_id":1,"amount":"99.00"}`),
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:      "Timestamp not covered by signature",
+			timestamp: strconv.FormatInt(fresh+1, 10),
+			signature: verifier.Sign(fresh, body),
+			body:      body,
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:      "Other secret",
+			timestamp: strconv.FormatInt(fresh, 10),
+			signature: NewVerifier("other", 5*time.Minute).Sign(fresh, body),
+			body:      body,
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:      "Missing prefix",
+			timestamp: strconv.FormatInt(fresh, 10),
+			signature: verifier.Sign(fresh, body)[len(signaturePrefix):],
+			body:      body,
+			wantErr:   ErrInvalidSignature,
+		},
+		{
+			name:    "Missing headers",
+			body:    body,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:      "Stale timestamp",
+			timestamp: strconv.FormatInt(stale, 10),
+			signature: verifier.Sign(stale, body),
+			body:      body,
+			wantErr:   ErrStaleTimestamp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifier.Verify(tt.timestamp, tt.signature, tt.body)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
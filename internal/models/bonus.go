@@ -0,0 +1,76 @@
+package models
+
+import "time"
+
+// BonusPriority decides which balance a reservation draws from first.
+type BonusPriority string
+
+const (
+	BonusFirst BonusPriority = "bonus_first"
+	RealFirst  BonusPriority = "real_first"
+)
+
+func (p BonusPriority) Valid() bool {
+	return p == BonusFirst || p == RealFirst
+}
+
+// Split divides amount between the real and bonus balances available, taking
+// from the preferred one first. The caller checks that real+bonus covers it.
+func (p BonusPriority) Split(amount Money, real Money, bonus Money) (fromReal Money, fromBonus Money) {
+	if p == RealFirst {
+		fromReal = min(amount, real)
+		return fromReal, amount - fromReal
+	}
+	fromBonus = min(amount, bonus)
+	return amount - fromBonus, fromBonus
+}
+
+// NewBucketJournalEntry books real and bonus moving between a user's
+// available and bonus accounts and other. Positive amounts credit the user,
+// negative ones debit them; zero legs are left out.
+func NewBucketJournalEntry(transactionID int, description string, userID int, other Account, real Money, bonus Money) JournalEntry {
+	entry := JournalEntry{TransactionID: transactionID, Description: description}
+	if real != 0 {
+		entry.Postings = append(entry.Postings, Posting{Account: UserAvailable(userID), Amount: real})
+	}
+	if bonus != 0 {
+		entry.Postings = append(entry.Postings, Posting{Account: UserBonus(userID), Amount: bonus})
+	}
+	entry.Postings = append(entry.Postings, Posting{Account: other, Amount: -(real + bonus)})
+	return entry
+}
+
+// BonusGrant is promotional credit given to a user. Remaining is what has not
+// been spent yet; it is forfeited at ExpiresAt.
+type BonusGrant struct {
+	ID            int        `json:"id"`
+	UserID        int        `json:"user_id"`
+	Amount        Money      `json:"amount"`
+	Remaining     Money      `json:"remaining"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	TransactionID int        `json:"transaction_id"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type BonusGrantRequest struct {
+	UserID int   `json:"-"`
+	Amount Money `json:"amount"`
+	// TTLSeconds is the lifetime of the credit; zero means it never expires.
+	TTLSeconds     int    `json:"ttl_seconds,omitempty"`
+	Reason         string `json:"reason"`
+	IdempotencyKey string `json:"-"`
+}
+
+type BonusGrantResponse struct {
+	Status       string     `json:"status"`
+	Message      string     `json:"message"`
+	Grant        BonusGrant `json:"grant"`
+	Balance      Money      `json:"balance"`
+	BonusBalance Money      `json:"bonus_balance"`
+}
+
+// BonusExpiry is the credit a user lost to expired grants.
+type BonusExpiry struct {
+	UserID int
+	Amount Money
+}
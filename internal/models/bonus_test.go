@@ -0,0 +1,51 @@
+package models
+
+import "testing"
+
+func TestBonusPriority_Split(t *testing.T) {
+	tests := []struct {
+		name      string
+		priority  BonusPriority
+		amount    Money
+		real      Money
+		bonus     Money
+		wantReal  Money
+		wantBonus Money
+	}{
+		{name: "bonus first covered by bonus", priority: BonusFirst, amount: 500, real: 1000, bonus: 800, wantReal: 0, wantBonus: 500},
+		{name: "bonus first tops up with real", priority: BonusFirst, amount: 500, real: 1000, bonus: 200, wantReal: 300, wantBonus: 200},
+		{name: "bonus first without bonus", priority: BonusFirst, amount: 500, real: 1000, bonus: 0, wantReal: 500, wantBonus: 0},
+		{name: "real first covered by real", priority: RealFirst, amount: 500, real: 1000, bonus: 800, wantReal: 500, wantBonus: 0},
+		{name: "real first tops up with bonus", priority: RealFirst, amount: 500, real: 300, bonus: 800, wantReal: 300, wantBonus: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fromReal, fromBonus := tt.priority.Split(tt.amount, tt.real, tt.bonus)
+			if fromReal != tt.wantReal || fromBonus != tt.wantBonus {
+				t.Errorf("Split() = (%d, %d), want (%d, %d)", fromReal, fromBonus, tt.wantReal, tt.wantBonus)
+			}
+		})
+	}
+}
+
+func TestNewBucketJournalEntry(t *testing.T) {
+	entry := NewBucketJournalEntry(7, "reserve", 1, UserReserved(1), -300, -200)
+	want := []Posting{
+		{Account: UserAvailable(1), Amount: -300},
+		{Account: UserBonus(1), Amount: -200},
+		{Account: UserReserved(1), Amount: 500},
+	}
+	if len(entry.Postings) != len(want) {
+		t.Fatalf("Postings = %v, want %v", entry.Postings, want)
+	}
+	for i := range want {
+		if entry.Postings[i] != want[i] {
+			t.Errorf("Postings[%d] = %v, want %v", i, entry.Postings[i], want[i])
+		}
+	}
+
+	entry = NewBucketJournalEntry(8, "refund", 1, CompanyRevenue, 500, 0)
+	if len(entry.Postings) != 2 {
+		t.Errorf("Postings = %v, want the bonus leg left out", entry.Postings)
+	}
+}
@@ -0,0 +1,42 @@
+package models
+
+// FeeOperation names the operation a fee rule applies to.
+type FeeOperation string
+
+const (
+	FeeTransfer FeeOperation = "transfer"
+	FeeConfirm  FeeOperation = "confirm"
+)
+
+func (o FeeOperation) Valid() bool {
+	return o == FeeTransfer || o == FeeConfirm
+}
+
+// FeeRule prices an operation at RateBps basis points of its amount, raised to
+// MinFee and capped at MaxFee. ServiceID 0 is the default for the operation;
+// transfer rules always use it.
+type FeeRule struct {
+	Operation FeeOperation `json:"operation"`
+	ServiceID int          `json:"service_id"`
+	RateBps   int          `json:"rate_bps"`
+	MinFee    Money        `json:"min_fee"`
+	MaxFee    *Money       `json:"max_fee,omitempty"`
+}
+
+// Fee returns the fee for amount, rounding half a kopeck up.
+func (r FeeRule) Fee(amount Money) Money {
+	// Split the amount so amount*RateBps cannot overflow for large amounts.
+	rate := Money(r.RateBps)
+	fee := amount/10000*rate + (amount%10000*rate+5000)/10000
+	if fee < r.MinFee {
+		fee = r.MinFee
+	}
+	if r.MaxFee != nil && fee > *r.MaxFee {
+		fee = *r.MaxFee
+	}
+	return fee
+}
+
+type FeeRulesResponse struct {
+	Rules []FeeRule `json:"rules"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "testing"
+
+func TestFeeRule_Fee(t *testing.T) {
+	maxFee := Money(500)
+	tests := []struct {
+		name   string
+		rule   FeeRule
+		amount Money
+		want   Money
+	}{
+		{name: "Percentage", rule: FeeRule{RateBps: 150}, amount: 10000, want: 150},
+		{name: "Rounds half up", rule: FeeRule{RateBps: 150}, amount: 100, want: 2},
+		{name: "Raised to minimum", rule: FeeRule{RateBps: 100, MinFee: 50}, amount: 1000, want: 50},
+		{name: "Capped at maximum", rule: FeeRule{RateBps: 100, MaxFee: &maxFee}, amount: 100000, want: 500},
+		{name: "Flat fee", rule: FeeRule{MinFee: 30}, amount: 100000, want: 30},
+		{name: "Largest amount does not overflow", rule: FeeRule{RateBps: 10000}, amount: MaxMoney, want: MaxMoney},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Fee(tt.amount); got != tt.want {
+				t.Errorf("FeeRule.Fee(%d) = %d, want %d", tt.amount, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// LimitOperation names what a velocity limit caps. Transfer limits count
+// outgoing transfers only.
+type LimitOperation string
+
+const (
+	LimitDeposit  LimitOperation = "deposit"
+	LimitTransfer LimitOperation = "transfer"
+	LimitReserve  LimitOperation = "reserve"
+)
+
+func (o LimitOperation) Valid() bool {
+	return o == LimitDeposit || o == LimitTransfer || o == LimitReserve
+}
+
+// Limit caps the amount and/or number of operations within a sliding window.
+// UserID 0 marks a global default. A nil cap is not enforced.
+type Limit struct {
+	UserID        int            `json:"user_id"`
+	Operation     LimitOperation `json:"operation"`
+	WindowSeconds int            `json:"window_seconds"`
+	MaxAmount     *Money         `json:"max_amount,omitempty"`
+	MaxCount      *int           `json:"max_count,omitempty"`
+}
+
+func (l Limit) Window() time.Duration {
+	return time.Duration(l.WindowSeconds) * time.Second
+}
+
+// LimitUsage is what a user spent on an operation within a window.
+type LimitUsage struct {
+	UserID        int
+	Operation     LimitOperation
+	WindowSeconds int
+	Amount        Money
+	Count         int
+}
+
+type LimitsResponse struct {
+	Limits []Limit `json:"limits"`
+}
@@ -1,43 +1,114 @@
 package models
 
 import (
-	"math/big"
 	"time"
 )
 
+// UserStatus controls which operations an account accepts. Frozen accounts
+// can receive money but not spend it; closed accounts accept nothing.
+type UserStatus string
+
+const (
+    UserActive UserStatus = "active"
+    UserFrozen UserStatus = "frozen"
+    UserClosed UserStatus = "closed"
+)
+
+type User struct {
+    ID              int        `json:"id"`
+    Balance         Money      `json:"balance"`
+    BonusBalance    Money      `json:"bonus_balance"`
+    // Debt is what a reversed deposit took beyond the balance; future
+    // deposits repay it first.
+    Debt            Money      `json:"debt"`
+    Status          UserStatus `json:"status"`
+    StatusReason    string     `json:"status_reason,omitempty"`
+    StatusChangedAt *time.Time `json:"status_changed_at,omitempty"`
+}
+
+type AccountStatusRequest struct {
+    UserID int    `json:"-"`
+    Reason string `json:"reason"`
+    // ForcePayout lets /close withdraw a remaining balance instead of failing.
+    ForcePayout bool `json:"force_payout,omitempty"`
+}
+
+type AccountStatusResponse struct {
+    Status   string `json:"status"`
+    Message  string `json:"message"`
+    User     User   `json:"user"`
+    PayoutID int    `json:"payout_id,omitempty"`
+}
+
 type DepositRequest struct {
     UserID int      `json:"user_id"`
-    Amount *big.Float `json:"amount"`
+    Amount Money `json:"amount"`
+    IdempotencyKey string `json:"-"`
 }
 
 type DepositResponse struct {
     Status        string     `json:"status"`
     Message       string     `json:"message"`
-    Balance       *big.Float `json:"balance"`
+    Balance       Money `json:"balance"`
     TransactionID int        `json:"transaction_id"`
+    ExternalPaymentID string `json:"external_payment_id,omitempty"`
+    // DebtRepaid is the part of the deposit that went to repay debt.
+    DebtRepaid    Money      `json:"debt_repaid,omitempty"`
+    Debt          Money      `json:"debt,omitempty"`
+}
+
+// BillingDepositRequest is the body of the billing service's payment webhook.
+type BillingDepositRequest struct {
+    ExternalPaymentID string `json:"external_payment_id"`
+    UserID            int    `json:"user_id"`
+    Amount            Money  `json:"amount"`
 }
 
 type ReserveRequest struct {
     UserID    int      `json:"user_id"`
     ServiceID int      `json:"service_id"`
     OrderID   int      `json:"order_id"`
-    Amount    *big.Float `json:"amount"`
+    Amount    Money `json:"amount"`
+    // TTLSeconds overrides the configured lifetime of the hold.
+    TTLSeconds int `json:"ttl_seconds,omitempty"`
+    IdempotencyKey string `json:"-"`
 }
 
 
 type ReserveResponse struct {
     Status        string     `json:"status"`
     Message       string     `json:"message"`
-    Balance       *big.Float `json:"balance"`
-    Reserved      *big.Float `json:"reserved"`
+    Balance       Money `json:"balance"`
+    Bonus         Money `json:"bonus"`
+    Reserved      Money `json:"reserved"`
+    // ReservedBonus is the part of Reserved drawn from the bonus balance.
+    ReservedBonus Money `json:"reserved_bonus"`
     TransactionID int        `json:"transaction_id"`
+    ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+}
+
+type ExtendReservationRequest struct {
+    UserID     int `json:"user_id"`
+    ServiceID  int `json:"service_id"`
+    OrderID    int `json:"order_id"`
+    TTLSeconds int `json:"ttl_seconds"`
+}
+
+type ExtendReservationResponse struct {
+    Status    string    `json:"status"`
+    Message   string    `json:"message"`
+    ExpiresAt time.Time `json:"expires_at"`
 }
 
 type ConfirmRequest struct {
     UserID    int      `json:"user_id"`
     ServiceID int      `json:"service_id"`
     OrderID   int      `json:"order_id"`
-    Amount    *big.Float `json:"amount"`
+    Amount    Money `json:"amount"`
+    // ReleaseRemainder returns whatever is still held for the order to the
+    // balance after this capture; otherwise the remainder stays reserved.
+    ReleaseRemainder bool `json:"release_remainder"`
+    IdempotencyKey string `json:"-"`
 }
 
 
@@ -45,25 +116,183 @@ type ConfirmResponse struct {
     Status        string     `json:"status"`
     Message       string     `json:"message"`
     TransactionID int        `json:"transaction_id"`
+    Captured      Money      `json:"captured"`
+    Remaining     Money      `json:"remaining"`
+    Released      Money      `json:"released"`
+    // Fee is the service commission charged to the user's balance on top of
+    // the captured amount.
+    Fee           Money      `json:"fee"`
+    FeeTransactionID int     `json:"fee_transaction_id,omitempty"`
+}
+
+// Reservation is a hold on user funds for a service order.
+type Reservation struct {
+    ID        int       `json:"id"`
+    UserID    int       `json:"user_id"`
+    ServiceID int       `json:"service_id"`
+    OrderID   int       `json:"order_id"`
+    Amount    Money     `json:"amount"`
+    // BonusAmount is the part of Amount drawn from the bonus balance.
+    BonusAmount Money   `json:"bonus_amount,omitempty"`
+    ExpiresAt *time.Time `json:"expires_at,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// Expired reports whether the hold has outlived its TTL at now.
+func (r Reservation) Expired(now time.Time) bool {
+    return r.ExpiresAt != nil && !r.ExpiresAt.After(now)
+}
+
+// ReservationFilter selects holds for GET /reservations. Zero values do not
+// filter.
+type ReservationFilter struct {
+    UserID      int
+    ServiceID   int
+    CreatedFrom *time.Time
+    CreatedTo   *time.Time
+    ExpiresFrom *time.Time
+    ExpiresTo   *time.Time
+    Page        int
+    Limit       int
+    SortBy      string
+    SortOrder   string
+}
+
+// ReservationListItem is a hold as shown to support staff.
+type ReservationListItem struct {
+    Reservation
+    AgeSeconds int64 `json:"age_seconds"`
+    Expired    bool  `json:"expired"`
+}
+
+type ReservationsResponse struct {
+    Reservations []ReservationListItem `json:"reservations"`
+    Total        int                   `json:"total"`
+    Page         int                   `json:"page"`
+    Limit        int                   `json:"limit"`
+}
+
+// Capture is one confirmation of (part of) a reservation.
+type Capture struct {
+    ID            int       `json:"id"`
+    UserID        int       `json:"user_id"`
+    ServiceID     int       `json:"service_id"`
+    OrderID       int       `json:"order_id"`
+    Amount        Money     `json:"amount"`
+    TransactionID int       `json:"transaction_id"`
+    CreatedAt     time.Time `json:"created_at"`
+}
+
+type CapturesResponse struct {
+    Captures      []Capture `json:"captures"`
+    TotalCaptured Money     `json:"total_captured"`
+}
+
+type WithdrawRequest struct {
+    UserID         int    `json:"user_id"`
+    Amount         Money  `json:"amount"`
+    IdempotencyKey string `json:"-"`
+}
+
+type WithdrawResponse struct {
+    Status        string `json:"status"`
+    Message       string `json:"message"`
+    Balance       Money  `json:"balance"`
+    PayoutID      int    `json:"payout_id"`
+    TransactionID int    `json:"transaction_id"`
+}
+
+// PayoutStatus is the lifecycle state of a withdrawal:
+// pending -> sending -> sent -> completed or failed. A sending payout was
+// claimed for the provider and may already have been submitted; a provider
+// rejection fails it directly.
+type PayoutStatus string
+
+const (
+    PayoutPending   PayoutStatus = "pending"
+    PayoutSending   PayoutStatus = "sending"
+    PayoutSent      PayoutStatus = "sent"
+    PayoutCompleted PayoutStatus = "completed"
+    PayoutFailed    PayoutStatus = "failed"
+)
+
+type Payout struct {
+    ID                int          `json:"id"`
+    UserID            int          `json:"user_id"`
+    Amount            Money        `json:"amount"`
+    Status            PayoutStatus `json:"status"`
+    ProviderReference string       `json:"provider_reference,omitempty"`
+    FailureReason     string       `json:"failure_reason,omitempty"`
+    TransactionID     int          `json:"transaction_id"`
+    CreatedAt         time.Time    `json:"created_at"`
+    UpdatedAt         time.Time    `json:"updated_at"`
+}
+
+type RefundRequest struct {
+    UserID    int    `json:"user_id"`
+    ServiceID int    `json:"service_id"`
+    OrderID   int    `json:"order_id"`
+    // Amount is optional; zero refunds everything still refundable.
+    Amount         Money  `json:"amount"`
+    Reason         string `json:"reason,omitempty"`
+    IdempotencyKey string `json:"-"`
+}
+
+type RefundResponse struct {
+    Status               string `json:"status"`
+    Message              string `json:"message"`
+    Balance              Money  `json:"balance"`
+    Refunded             Money  `json:"refunded"`
+    // RefundedBonus is the part of Refunded returned to the bonus balance.
+    RefundedBonus        Money  `json:"refunded_bonus"`
+    Refundable           Money  `json:"refundable"`
+    TransactionID        int    `json:"transaction_id"`
+    ConfirmTransactionID int    `json:"confirm_transaction_id"`
+}
+
+type UnreserveRequest struct {
+    UserID    int    `json:"user_id"`
+    ServiceID int    `json:"service_id"`
+    OrderID   int    `json:"order_id"`
+    Reason    string `json:"reason,omitempty"`
+}
+
+type UnreserveResponse struct {
+    Status        string     `json:"status"`
+    Message       string     `json:"message"`
+    Balance       Money `json:"balance"`
+    Released      Money `json:"released"`
+    TransactionID int        `json:"transaction_id"`
 }
 
 type BalanceResponse struct {
-    Balance *big.Float `json:"balance"`
-    Reserved *big.Float `json:"reserved"`
+    // Balance is real money; Bonus is promotional credit that can only be
+    // spent on services.
+    Balance Money `json:"balance"`
+    Bonus Money `json:"bonus,omitempty"`
+    Debt Money `json:"debt,omitempty"`
+    Reserved Money `json:"reserved"`
+    // At is set when the balance was reconstructed for a past moment.
+    At *time.Time `json:"at,omitempty"`
 }
 
 type TransferRequest struct {
     FromUserID int      `json:"from_user_id"`
     ToUserID   int      `json:"to_user_id"`
-    Amount     *big.Float `json:"amount"`
+    Amount     Money `json:"amount"`
+    IdempotencyKey string `json:"-"`
 }
 
 type TransferResponse struct {
     Status        string     `json:"status"`
     Message       string     `json:"message"`
     TransactionID int        `json:"transaction_id"`
-    UserToBalance *big.Float `json:"user_to_balance"`
-    UserFromBalance *big.Float `json:"user_from_balance"`
+    IncomingTransactionID int `json:"incoming_transaction_id"`
+    UserToBalance Money `json:"user_to_balance"`
+    UserFromBalance Money `json:"user_from_balance"`
+    // Fee is charged to the sender on top of the amount.
+    Fee Money `json:"fee"`
+    FeeTransactionID int `json:"fee_transaction_id,omitempty"`
 }
 
 type MonthlyReportRequest struct {
@@ -73,11 +302,16 @@ type MonthlyReportRequest struct {
 
 type MonthlyReportData struct {
 	ServiceId   string
-	TotalRevenue float64
+	// ServiceName is the catalog name the service had when the revenue was
+	// booked.
+	ServiceName  string
+	TotalRevenue Money
+	FeeIncome    Money
 }
 
 type MonthlyReportResponse struct {
-    FilePath string
+    // Content is the report as CSV.
+    Content []byte
 }
 
 
@@ -86,9 +320,17 @@ type Transaction struct {
     UserID      int             `json:"user_id"`
     ServiceID   int             `json:"service_id,omitempty"` 
     OrderID     int             `json:"order_id,omitempty"`   
-    Amount      *big.Float      `json:"amount"`
+    Amount      Money      `json:"amount"`
+    // BonusAmount is the part of Amount that moved in the bonus balance.
+    BonusAmount Money      `json:"bonus_amount,omitempty"`
     Type        TransactionType `json:"type"`
     Description string          `json:"description"`
+    // RelatedTransactionID links e.g. a refund to the confirm it reverses.
+    RelatedTransactionID int `json:"related_transaction_id,omitempty"`
+    // CounterpartyUserID is the other side of a transfer.
+    CounterpartyUserID int `json:"counterparty_user_id,omitempty"`
+    // ExternalPaymentID is the billing service's reference of a deposit.
+    ExternalPaymentID string `json:"external_payment_id,omitempty"`
     CreatedAt   time.Time       `json:"created_at"`
 }
 
@@ -118,5 +360,217 @@ const (
     Reserve           TransactionType = "reserve"
     Confirm            TransactionType = "confirm"
     Transfer             TransactionType = "transfer"
+    Unreserve         TransactionType = "unreserve"
+    Expired           TransactionType = "expired"
+    PayoutReturn      TransactionType = "payout_return"
+    Refund            TransactionType = "refund"
+    // Fee is charged on top of a transfer or confirm and points at it through
+    // RelatedTransactionID.
+    Fee               TransactionType = "fee"
+    Bonus             TransactionType = "bonus"
+    BonusExpired      TransactionType = "bonus_expired"
+    // DepositReversal takes back a deposit and points at it. Debt carries the
+    // part the balance could not cover and points at the reversal;
+    // DebtRepayment takes it from a later deposit and points at that deposit.
+    DepositReversal   TransactionType = "deposit_reversal"
+    Debt              TransactionType = "debt"
+    DebtRepayment     TransactionType = "debt_repayment"
+    // Adjustment and ReservedAdjustment are written by reconciliation to make
+    // the history match the stored available and reserved balances.
+    Adjustment         TransactionType = "adjustment"
+    ReservedAdjustment TransactionType = "reserved_adjustment"
     
 )
+
+// IdempotencyRecord is the stored outcome of a request made with an
+// Idempotency-Key header.
+type IdempotencyRecord struct {
+    Key         string
+    RequestHash string
+    Response    []byte
+}
+
+// AccountType identifies a ledger account. User accounts are qualified by a
+// user id, company accounts use user id 0.
+type AccountType string
+
+const (
+    AccountUserAvailable   AccountType = "user_available"
+    AccountUserReserved    AccountType = "user_reserved"
+    AccountUserBonus       AccountType = "user_bonus"
+    // AccountUserDebt goes negative by what the user owes.
+    AccountUserDebt        AccountType = "user_debt"
+    AccountCompanyRevenue  AccountType = "company_revenue"
+    AccountFeeIncome       AccountType = "fee_income"
+    // AccountBonusFunding is the marketing budget bonus credit is granted from.
+    AccountBonusFunding    AccountType = "bonus_funding"
+    AccountExternalFunding AccountType = "external_funding"
+    // AccountPayoutsInTransit holds withdrawn funds until the payout provider
+    // completes or fails the payout.
+    AccountPayoutsInTransit AccountType = "payouts_in_transit"
+)
+
+type Account struct {
+    Type   AccountType `json:"type"`
+    UserID int         `json:"user_id,omitempty"`
+}
+
+func UserAvailable(userID int) Account {
+    return Account{Type: AccountUserAvailable, UserID: userID}
+}
+
+func UserReserved(userID int) Account {
+    return Account{Type: AccountUserReserved, UserID: userID}
+}
+
+func UserBonus(userID int) Account {
+    return Account{Type: AccountUserBonus, UserID: userID}
+}
+
+func UserDebt(userID int) Account {
+    return Account{Type: AccountUserDebt, UserID: userID}
+}
+
+var (
+    CompanyRevenue  = Account{Type: AccountCompanyRevenue}
+    FeeIncome       = Account{Type: AccountFeeIncome}
+    BonusFunding    = Account{Type: AccountBonusFunding}
+    ExternalFunding = Account{Type: AccountExternalFunding}
+    PayoutsInTransit = Account{Type: AccountPayoutsInTransit}
+)
+
+// Posting is one leg of a journal entry. A positive amount increases the
+// account, a negative amount decreases it.
+type Posting struct {
+    Account Account    `json:"account"`
+    Amount  Money `json:"amount"`
+}
+
+// JournalEntry groups postings that must sum to zero.
+type JournalEntry struct {
+    ID            int       `json:"id"`
+    TransactionID int       `json:"transaction_id"`
+    Description   string    `json:"description"`
+    Postings      []Posting `json:"postings"`
+    CreatedAt     time.Time `json:"created_at"`
+}
+
+// NewJournalEntry books amount moving from one account to another.
+func NewJournalEntry(transactionID int, description string, from Account, to Account, amount Money) JournalEntry {
+    return JournalEntry{
+        TransactionID: transactionID,
+        Description:   description,
+        Postings: []Posting{
+            {Account: from, Amount: -amount},
+            {Account: to, Amount: amount},
+        },
+    }
+}
+
+// LedgerDiscrepancy is a user whose stored balances disagree with the ledger.
+type LedgerDiscrepancy struct {
+    UserID            int        `json:"user_id"`
+    Balance           Money `json:"balance"`
+    LedgerAvailable   Money `json:"ledger_available"`
+    Reserved          Money `json:"reserved"`
+    LedgerReserved    Money `json:"ledger_reserved"`
+}
+
+type LedgerReport struct {
+    Balanced          bool                `json:"balanced"`
+    Total             Money          `json:"total"`
+    AccountTotals     map[AccountType]Money `json:"account_totals"`
+    UnbalancedEntries []int               `json:"unbalanced_entries"`
+    Discrepancies     []LedgerDiscrepancy `json:"discrepancies"`
+}
+
+type BatchMode string
+
+const (
+    // BatchAtomic applies every operation or none of them.
+    BatchAtomic BatchMode = "atomic"
+    // BatchBestEffort applies the operations that succeed and reports the rest.
+    BatchBestEffort BatchMode = "best_effort"
+)
+
+type BatchOperationType string
+
+const (
+    BatchDeposit  BatchOperationType = "deposit"
+    BatchTransfer BatchOperationType = "transfer"
+    BatchReserve  BatchOperationType = "reserve"
+)
+
+type BatchOperation struct {
+    Type       BatchOperationType `json:"type"`
+    UserID     int                `json:"user_id"`
+    ToUserID   int                `json:"to_user_id,omitempty"`
+    ServiceID  int                `json:"service_id,omitempty"`
+    OrderID    int                `json:"order_id,omitempty"`
+    Amount     Money              `json:"amount"`
+    TTLSeconds int                `json:"ttl_seconds,omitempty"`
+}
+
+type BatchRequest struct {
+    Mode           BatchMode        `json:"mode"`
+    Operations     []BatchOperation `json:"operations"`
+    IdempotencyKey string           `json:"-"`
+}
+
+// BatchItemResult is the outcome of one operation, in request order.
+type BatchItemResult struct {
+    Index         int    `json:"index"`
+    Status        string `json:"status"`
+    TransactionID int    `json:"transaction_id,omitempty"`
+    Fee           Money  `json:"fee,omitempty"`
+    DebtRepaid    Money  `json:"debt_repaid,omitempty"`
+    Balance       Money  `json:"balance"`
+    Error         string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+    Status    string            `json:"status"`
+    Mode      BatchMode         `json:"mode"`
+    Succeeded int               `json:"succeeded"`
+    Failed    int               `json:"failed"`
+    Results   []BatchItemResult `json:"results"`
+}
+
+type OrderItemRequest struct {
+    ServiceID int   `json:"service_id"`
+    Amount    Money `json:"amount"`
+}
+
+type CreateOrderRequest struct {
+    UserID  int                `json:"user_id"`
+    OrderID int                `json:"order_id"`
+    Items   []OrderItemRequest `json:"items"`
+    // TTLSeconds overrides the configured lifetime of every line's hold.
+    TTLSeconds     int    `json:"ttl_seconds,omitempty"`
+    IdempotencyKey string `json:"-"`
+}
+
+type CreateOrderResponse struct {
+    Status  string `json:"status"`
+    Message string `json:"message"`
+    Order   Order  `json:"order"`
+    Balance Money  `json:"balance"`
+}
+
+// BalanceDiscrepancy is a user whose stored balances disagree with the
+// balances derived from the transactions history.
+type BalanceDiscrepancy struct {
+    UserID           int   `json:"user_id"`
+    Balance          Money `json:"balance"`
+    ExpectedBalance  Money `json:"expected_balance"`
+    Reserved         Money `json:"reserved"`
+    ExpectedReserved Money `json:"expected_reserved"`
+}
+
+type ReconciliationReport struct {
+    GeneratedAt   time.Time            `json:"generated_at"`
+    Fix           bool                 `json:"fix"`
+    Discrepancies []BalanceDiscrepancy `json:"discrepancies"`
+    // Adjustments lists the correcting transactions written in fix mode.
+    Adjustments []Transaction `json:"adjustments,omitempty"`
+}
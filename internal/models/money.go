@@ -0,0 +1,145 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount in minor units (kopecks). Its range and scale match
+// the DECIMAL(15, 2) columns it is stored in.
+type Money int64
+
+// MaxMoney is the largest amount DECIMAL(15, 2) can hold: 9999999999999.99.
+const MaxMoney Money = 999999999999999
+
+var (
+	ErrInvalidAmount   = errors.New("invalid amount")
+	ErrAmountPrecision = errors.New("amount must have at most two decimal places")
+	ErrAmountRange     = errors.New("amount is out of range")
+)
+
+// ParseMoney parses a plain decimal such as "12", "12.3" or "-12.34".
+// Exponents, more than two decimal places and values outside DECIMAL(15, 2)
+// are rejected.
+func ParseMoney(s string) (Money, error) {
+	negative := false
+	switch {
+	case strings.HasPrefix(s, "-"):
+		negative = true
+		s = s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+
+	whole, fraction, hasFraction := strings.Cut(s, ".")
+	if whole == "" || !isDigits(whole) || (hasFraction && (fraction == "" || !isDigits(fraction))) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	if len(fraction) > 2 {
+		return 0, fmt.Errorf("%w: %q", ErrAmountPrecision, s)
+	}
+
+	whole = strings.TrimLeft(whole, "0")
+	if len(whole) > 13 {
+		return 0, fmt.Errorf("%w: %q", ErrAmountRange, s)
+	}
+
+	var units int64
+	if whole != "" {
+		parsed, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+		}
+		units = parsed * 100
+	}
+	fraction += strings.Repeat("0", 2-len(fraction))
+	cents, _ := strconv.ParseInt(fraction, 10, 64)
+	units += cents
+
+	if negative {
+		units = -units
+	}
+	return Money(units), nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount with exactly two decimal places.
+func (m Money) String() string {
+	units := int64(m)
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, units/100, units%100)
+}
+
+// InRange reports whether the amount fits DECIMAL(15, 2).
+func (m Money) InRange() bool {
+	return m >= -MaxMoney && m <= MaxMoney
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts both JSON numbers and numeric strings.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	}
+	parsed, err := ParseMoney(text)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func (m Money) Value() (driver.Value, error) {
+	if !m.InRange() {
+		return nil, fmt.Errorf("%w: %s", ErrAmountRange, m)
+	}
+	return m.String(), nil
+}
+
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return m.scanString(string(v))
+	case string:
+		return m.scanString(v)
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	case nil:
+		*m = 0
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+}
+
+func (m *Money) scanString(s string) error {
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Money
+		wantErr error
+	}{
+		{name: "Whole amount", input: "12", want: 1200},
+		{name: "One decimal place", input: "0.1", want: 10},
+		{name: "Two decimal places", input: "100.55", want: 10055},
+		{name: "Negative amount", input: "-0.05", want: -5},
+		{name: "Maximum amount", input: "9999999999999.99", want: MaxMoney},
+		{name: "Three decimal places", input: "1.005", wantErr: ErrAmountPrecision},
+		{name: "Too large", input: "10000000000000", wantErr: ErrAmountRange},
+		{name: "Exponent", input: "1e3", wantErr: ErrInvalidAmount},
+		{name: "Empty fraction", input: "1.", wantErr: ErrInvalidAmount},
+		{name: "Not a number", input: "abc", wantErr: ErrInvalidAmount},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMoney(tt.input)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("ParseMoney(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMoney(%q) unexpected error = %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseMoney(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoney_JSON(t *testing.T) {
+	var request DepositRequest
+	if err := json.Unmarshal([]byte(`{"user_id":1,"amount":0.1}`), &request); err != nil {
+		t.Fatalf("json.Unmarshal() unexpected error = %v", err)
+	}
+	if request.Amount != 10 {
+		t.Errorf("Amount = %d, want 10", request.Amount)
+	}
+
+	if err := json.Unmarshal([]byte(`{"user_id":1,"amount":"0.001"}`), &request); !errors.Is(err, ErrAmountPrecision) {
+		t.Errorf("json.Unmarshal() error = %v, want %v", err, ErrAmountPrecision)
+	}
+
+	encoded, err := json.Marshal(BalanceResponse{Balance: -1050, Reserved: 7})
+	if err != nil {
+		t.Fatalf("json.Marshal() unexpected error = %v", err)
+	}
+	if want := `{"balance":-10.50,"reserved":0.07}`; string(encoded) != want {
+		t.Errorf("json.Marshal() = %s, want %s", encoded, want)
+	}
+}
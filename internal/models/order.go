@@ -0,0 +1,84 @@
+package models
+
+import "time"
+
+// OrderStatus is the state of one order line, i.e. of one (service_id,
+// order_id) pair.
+type OrderStatus string
+
+const (
+	OrderReserved           OrderStatus = "reserved"
+	OrderPartiallyConfirmed OrderStatus = "partially_confirmed"
+	OrderConfirmed          OrderStatus = "confirmed"
+	OrderReleased           OrderStatus = "released"
+	OrderRefunded           OrderStatus = "refunded"
+	OrderExpired            OrderStatus = "expired"
+)
+
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderReserved:           {OrderPartiallyConfirmed, OrderConfirmed, OrderReleased, OrderExpired},
+	OrderPartiallyConfirmed: {OrderPartiallyConfirmed, OrderConfirmed, OrderRefunded},
+	OrderConfirmed:          {OrderConfirmed, OrderRefunded},
+}
+
+// CanTransitionTo reports whether a line in status s may move to next.
+// Released, expired and refunded lines are final.
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	for _, allowed := range orderTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderItem is one line of an order. Reserved is what is still held for the
+// line; it shrinks as the line is confirmed or released.
+type OrderItem struct {
+	OrderID       int         `json:"order_id"`
+	UserID        int         `json:"user_id"`
+	ServiceID     int         `json:"service_id"`
+	Status        OrderStatus `json:"status"`
+	Amount        Money       `json:"amount"`
+	Reserved      Money       `json:"reserved"`
+	Captured      Money       `json:"captured"`
+	Released      Money       `json:"released"`
+	Refunded      Money       `json:"refunded"`
+	TransactionID int         `json:"transaction_id,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// NextStatus derives the status from the line's amounts. expired tells a
+// release caused by the reservation TTL apart from an explicit one.
+func (i OrderItem) NextStatus(expired bool) OrderStatus {
+	held := i.Amount - i.Captured - i.Released
+	switch {
+	case held == 0 && i.Captured > 0 && i.Refunded >= i.Captured:
+		return OrderRefunded
+	case held > 0 && i.Captured > 0:
+		return OrderPartiallyConfirmed
+	case held > 0:
+		return OrderReserved
+	case i.Captured > 0:
+		return OrderConfirmed
+	case expired:
+		return OrderExpired
+	default:
+		return OrderReleased
+	}
+}
+
+type Order struct {
+	ID        int         `json:"order_id"`
+	UserID    int         `json:"user_id"`
+	Items     []OrderItem `json:"items"`
+	Total     Money       `json:"total"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// OrderItemResponse is an order line with every transaction booked for it.
+type OrderItemResponse struct {
+	OrderItem
+	Transactions []Transaction `json:"transactions"`
+}
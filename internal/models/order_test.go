@@ -0,0 +1,50 @@
+package models
+
+import "testing"
+
+func TestOrderItem_NextStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		item    OrderItem
+		expired bool
+		want    OrderStatus
+	}{
+		{name: "untouched", item: OrderItem{Amount: 1000}, want: OrderReserved},
+		{name: "partially captured", item: OrderItem{Amount: 1000, Captured: 400}, want: OrderPartiallyConfirmed},
+		{name: "fully captured", item: OrderItem{Amount: 1000, Captured: 1000}, want: OrderConfirmed},
+		{name: "remainder released", item: OrderItem{Amount: 1000, Captured: 400, Released: 600}, want: OrderConfirmed},
+		{name: "released", item: OrderItem{Amount: 1000, Released: 1000}, want: OrderReleased},
+		{name: "expired", item: OrderItem{Amount: 1000, Released: 1000}, expired: true, want: OrderExpired},
+		{name: "partially refunded", item: OrderItem{Amount: 1000, Captured: 1000, Refunded: 300}, want: OrderConfirmed},
+		{name: "captured part refunded while held", item: OrderItem{Amount: 1000, Captured: 400, Refunded: 400}, want: OrderPartiallyConfirmed},
+		{name: "refunded", item: OrderItem{Amount: 1000, Captured: 400, Released: 600, Refunded: 400}, want: OrderRefunded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.item.NextStatus(tt.expired); got != tt.want {
+				t.Errorf("NextStatus() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderStatus_CanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from OrderStatus
+		to   OrderStatus
+		want bool
+	}{
+		{OrderReserved, OrderPartiallyConfirmed, true},
+		{OrderReserved, OrderExpired, true},
+		{OrderPartiallyConfirmed, OrderReleased, false},
+		{OrderConfirmed, OrderRefunded, true},
+		{OrderReleased, OrderReserved, false},
+		{OrderExpired, OrderConfirmed, false},
+		{OrderRefunded, OrderConfirmed, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+			t.Errorf("%s.CanTransitionTo(%s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// ReportStatus is the lifecycle state of a report job:
+// pending -> completed -> expired, or pending -> failed.
+type ReportStatus string
+
+const (
+	ReportPending   ReportStatus = "pending"
+	ReportCompleted ReportStatus = "completed"
+	ReportFailed    ReportStatus = "failed"
+	ReportExpired   ReportStatus = "expired"
+)
+
+// ReportJob is a monthly report generated in the background. FileKey names
+// the stored file once the job completed.
+type ReportJob struct {
+	ID          int          `json:"id"`
+	Year        int          `json:"year"`
+	Month       int          `json:"month"`
+	Status      ReportStatus `json:"status"`
+	FileKey     string       `json:"-"`
+	Error       string       `json:"error,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+	// ExpiresAt is when the file is deleted.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// FileName is the name the report is downloaded as.
+func (j ReportJob) FileName() string {
+	return fmt.Sprintf("monthly_report_%04d_%02d.csv", j.Year, j.Month)
+}
+
+type ReportJobResponse struct {
+	ReportJob
+	StatusURL   string `json:"status_url"`
+	DownloadURL string `json:"download_url,omitempty"`
+}
@@ -0,0 +1,19 @@
+package models
+
+type DepositReversalRequest struct {
+	DepositID      int    `json:"-"`
+	Reason         string `json:"reason"`
+	IdempotencyKey string `json:"-"`
+}
+
+type DepositReversalResponse struct {
+	Status        string `json:"status"`
+	Message       string `json:"message"`
+	Balance       Money  `json:"balance"`
+	Debt          Money  `json:"debt"`
+	Reversed      Money  `json:"reversed"`
+	TransactionID int    `json:"transaction_id"`
+	// DebtTransactionID is set when the balance did not cover the reversal.
+	DebtTransactionID    int `json:"debt_transaction_id,omitempty"`
+	DepositTransactionID int `json:"deposit_transaction_id"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// Service is an entry of the services catalog. IDs are assigned by the
+// service management system and match the service_id of reservations.
+type Service struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// Active services accept new reservations and confirmations.
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ServicesResponse struct {
+	Services []Service `json:"services"`
+}
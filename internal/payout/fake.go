@@ -0,0 +1,52 @@
+package payout
+
+import (
+	"context"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"sync"
+)
+
+// FakeProvider is an in-memory Provider for local development. Every payout
+// completes unless its amount exceeds FailAbove.
+type FakeProvider struct {
+	// FailAbove makes larger payouts fail; zero disables failures.
+	FailAbove models.Money
+
+	mu      sync.Mutex
+	results map[string]Result
+}
+
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{
+		results: make(map[string]Result),
+	}
+}
+
+func (p *FakeProvider) Send(ctx context.Context, idempotencyKey string, payout models.Payout) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	reference := "fake-" + idempotencyKey
+	if _, ok := p.results[reference]; ok {
+		return reference, nil
+	}
+
+	result := Result{Status: models.PayoutCompleted}
+	if p.FailAbove > 0 && payout.Amount > p.FailAbove {
+		result = Result{Status: models.PayoutFailed, FailureReason: "amount exceeds provider limit"}
+	}
+	p.results[reference] = result
+	return reference, nil
+}
+
+func (p *FakeProvider) Status(ctx context.Context, reference string) (Result, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result, ok := p.results[reference]
+	if !ok {
+		return Result{}, fmt.Errorf("unknown payout reference %q", reference)
+	}
+	return result, nil
+}
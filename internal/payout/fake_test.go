@@ -0,0 +1,55 @@
+package payout
+
+import (
+	"context"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"testing"
+)
+
+func TestFakeProvider(t *testing.T) {
+	provider := NewFakeProvider()
+	provider.FailAbove = 10000
+
+	tests := []struct {
+		name   string
+		payout models.Payout
+		want   models.PayoutStatus
+	}{
+		{
+			name:   "Completes small payout",
+			payout: models.Payout{ID: 1, Amount: 5000},
+			want:   models.PayoutCompleted,
+		},
+		{
+			name:   "Fails payout above limit",
+			payout: models.Payout{ID: 2, Amount: 10001},
+			want:   models.PayoutFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := fmt.Sprintf("payout-%d", tt.payout.ID)
+			reference, err := provider.Send(context.Background(), key, tt.payout)
+			if err != nil {
+				t.Fatalf("FakeProvider.Send() unexpected error = %v", err)
+			}
+			again, err := provider.Send(context.Background(), key, tt.payout)
+			if err != nil || again != reference {
+				t.Errorf("FakeProvider.Send() is not idempotent: %q, %q, %v", reference, again, err)
+			}
+
+			result, err := provider.Status(context.Background(), reference)
+			if err != nil {
+				t.Fatalf("FakeProvider.Status() unexpected error = %v", err)
+			}
+			if result.Status != tt.want {
+				t.Errorf("FakeProvider.Status() = %s, want %s", result.Status, tt.want)
+			}
+		})
+	}
+
+	if _, err := provider.Status(context.Background(), "unknown"); err == nil {
+		t.Errorf("FakeProvider.Status() expected error for unknown reference")
+	}
+}
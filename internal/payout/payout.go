@@ -0,0 +1,28 @@
+package payout
+
+import (
+	"context"
+	"errors"
+	"internship_backend_2022/internal/models"
+)
+
+// ErrRejected marks a Send error after which the provider will definitely not
+// execute the payout. Any other error leaves the outcome unknown.
+var ErrRejected = errors.New("payout rejected")
+
+// Result is the provider-side state of a payout.
+type Result struct {
+	Status        models.PayoutStatus
+	FailureReason string
+}
+
+// Provider sends money out of the system, e.g. to a bank card.
+type Provider interface {
+	// Send submits the payout and returns the provider's reference for it.
+	// Repeated calls with the same idempotency key must not pay out again.
+	// Errors that wrap ErrRejected are final; others are retried.
+	Send(ctx context.Context, idempotencyKey string, payout models.Payout) (string, error)
+	// Status reports whether a sent payout is still in flight, completed or
+	// failed.
+	Status(ctx context.Context, reference string) (Result, error)
+}
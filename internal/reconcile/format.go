@@ -0,0 +1,55 @@
+// Package reconcile renders reconciliation reports for the CLI and the
+// scheduled job.
+package reconcile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"io"
+	"strconv"
+)
+
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// Write renders report in the given format. CSV output has one row per
+// discrepancy and leaves out the adjustments.
+func Write(w io.Writer, report models.ReconciliationReport, format string) error {
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case FormatCSV:
+		return writeCSV(w, report)
+	default:
+		return fmt.Errorf("unknown format %q, want %s or %s", format, FormatJSON, FormatCSV)
+	}
+}
+
+func writeCSV(w io.Writer, report models.ReconciliationReport) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"user_id", "balance", "expected_balance", "balance_diff", "reserved", "expected_reserved", "reserved_diff"}); err != nil {
+		return err
+	}
+	for _, d := range report.Discrepancies {
+		record := []string{
+			strconv.Itoa(d.UserID),
+			d.Balance.String(),
+			d.ExpectedBalance.String(),
+			(d.Balance - d.ExpectedBalance).String(),
+			d.Reserved.String(),
+			d.ExpectedReserved.String(),
+			(d.Reserved - d.ExpectedReserved).String(),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,32 @@
+package reconcile
+
+import (
+	"bytes"
+	"internship_backend_2022/internal/models"
+	"testing"
+)
+
+func TestWriteCSV(t *testing.T) {
+	report := models.ReconciliationReport{
+		Discrepancies: []models.BalanceDiscrepancy{
+			{UserID: 7, Balance: 10000, ExpectedBalance: 9950, Reserved: 0, ExpectedReserved: 500},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, report, FormatCSV); err != nil {
+		t.Fatalf("Write() unexpected error = %v", err)
+	}
+
+	want := "user_id,balance,expected_balance,balance_diff,reserved,expected_reserved,reserved_diff\n" +
+		"7,100.00,99.50,0.50,0.00,5.00,-5.00\n"
+	if buf.String() != want {
+		t.Errorf("Write() = %q, want %q", buf.String(), want)
+	}
+}
+
+func TestWriteUnknownFormat(t *testing.T) {
+	if err := Write(&bytes.Buffer{}, models.ReconciliationReport{}, "xml"); err == nil {
+		t.Error("Write() expected error for unknown format")
+	}
+}
@@ -0,0 +1,256 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func (r *repository) CreateUsers(ctx context.Context, userIDs []int) error {
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO users (id,balance)
+		SELECT id, 0.00 FROM unnest($1::int[]) AS u(id)
+		ON CONFLICT (id) DO NOTHING`,
+		pq.Array(userIDs),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create users: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) GetUsersForUpdate(ctx context.Context, userIDs []int) (map[int]models.User, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = ANY($1) ORDER BY id FOR UPDATE", pq.Array(userIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make(map[int]models.User, len(userIDs))
+	for rows.Next() {
+		var u models.User
+		if err := rows.Scan(&u.ID, &u.Balance, &u.BonusBalance, &u.Debt, &u.Status, &u.StatusReason, &u.StatusChangedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users[u.ID] = u
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	return users, nil
+}
+
+func (r *repository) AdjustUserBalances(ctx context.Context, deltas map[int]models.Money) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	userIDs := make([]int, 0, len(deltas))
+	amounts := make([]models.Money, 0, len(deltas))
+	for userID, amount := range deltas {
+		userIDs = append(userIDs, userID)
+		amounts = append(amounts, amount)
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE users u
+		SET balance = u.balance + d.amount
+		FROM unnest($1::int[], $2::numeric[]) AS d(id, amount)
+		WHERE u.id = d.id`,
+		pq.Array(userIDs), pq.Array(amounts),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update user balances: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) AdjustUserBonusBalances(ctx context.Context, deltas map[int]models.Money) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	userIDs := make([]int, 0, len(deltas))
+	amounts := make([]models.Money, 0, len(deltas))
+	for userID, amount := range deltas {
+		userIDs = append(userIDs, userID)
+		amounts = append(amounts, amount)
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE users u
+		SET bonus_balance = u.bonus_balance + d.amount
+		FROM unnest($1::int[], $2::numeric[]) AS d(id, amount)
+		WHERE u.id = d.id`,
+		pq.Array(userIDs), pq.Array(amounts),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update user bonus balances: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) AdjustUserDebts(ctx context.Context, deltas map[int]models.Money) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	userIDs := make([]int, 0, len(deltas))
+	amounts := make([]models.Money, 0, len(deltas))
+	for userID, amount := range deltas {
+		userIDs = append(userIDs, userID)
+		amounts = append(amounts, amount)
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE users u
+		SET debt = u.debt + d.amount
+		FROM unnest($1::int[], $2::numeric[]) AS d(id, amount)
+		WHERE u.id = d.id`,
+		pq.Array(userIDs), pq.Array(amounts),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update user debts: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) NextTransactionIDs(ctx context.Context, n int) ([]int, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT nextval(pg_get_serial_sequence('transactions', 'id')) FROM generate_series(1, $1)", n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate transaction ids: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0, n)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan transaction id: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to allocate transaction ids: %w", err)
+	}
+	return ids, nil
+}
+
+func (r *repository) CreateTransactions(ctx context.Context, transactions []models.Transaction) error {
+	if len(transactions) == 0 {
+		return nil
+	}
+	var (
+		ids, userIDs, serviceIDs, orderIDs, relatedIDs, counterpartyIDs []int
+		amounts, bonusAmounts                                           []models.Money
+		types                                                           []models.TransactionType
+		descriptions                                                    []string
+	)
+	for _, t := range transactions {
+		ids = append(ids, t.ID)
+		userIDs = append(userIDs, t.UserID)
+		serviceIDs = append(serviceIDs, t.ServiceID)
+		orderIDs = append(orderIDs, t.OrderID)
+		amounts = append(amounts, t.Amount)
+		bonusAmounts = append(bonusAmounts, t.BonusAmount)
+		types = append(types, t.Type)
+		descriptions = append(descriptions, t.Description)
+		relatedIDs = append(relatedIDs, t.RelatedTransactionID)
+		counterpartyIDs = append(counterpartyIDs, t.CounterpartyUserID)
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO transactions (id,user_id,service_id,order_id,amount,bonus_amount,type,description,related_transaction_id,counterparty_user_id)
+		SELECT id, user_id, service_id, order_id, amount, bonus_amount, type, description, NULLIF(related_id, 0), NULLIF(counterparty_id, 0)
+		FROM unnest($1::int[], $2::int[], $3::int[], $4::int[], $5::numeric[], $6::numeric[], $7::text[], $8::text[], $9::int[], $10::int[])
+			AS t(id, user_id, service_id, order_id, amount, bonus_amount, type, description, related_id, counterparty_id)`,
+		pq.Array(ids), pq.Array(userIDs), pq.Array(serviceIDs), pq.Array(orderIDs), pq.Array(amounts), pq.Array(bonusAmounts),
+		pq.Array(types), pq.Array(descriptions), pq.Array(relatedIDs), pq.Array(counterpartyIDs),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create transactions: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) CreateReservations(ctx context.Context, reservations []models.Reservation) error {
+	if len(reservations) == 0 {
+		return nil
+	}
+	var (
+		userIDs, serviceIDs, orderIDs []int
+		amounts, bonusAmounts         []models.Money
+		expiresAt                     []*time.Time
+	)
+	for _, reservation := range reservations {
+		userIDs = append(userIDs, reservation.UserID)
+		serviceIDs = append(serviceIDs, reservation.ServiceID)
+		orderIDs = append(orderIDs, reservation.OrderID)
+		amounts = append(amounts, reservation.Amount)
+		bonusAmounts = append(bonusAmounts, reservation.BonusAmount)
+		expiresAt = append(expiresAt, reservation.ExpiresAt)
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO reserved_funds (user_id,service_id,order_id,amount,bonus_amount,expires_at)
+		SELECT * FROM unnest($1::int[], $2::int[], $3::int[], $4::numeric[], $5::numeric[], $6::timestamptz[])`,
+		pq.Array(userIDs), pq.Array(serviceIDs), pq.Array(orderIDs), pq.Array(amounts), pq.Array(bonusAmounts), pq.Array(expiresAt),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to reserve funds: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) CreateJournalEntries(ctx context.Context, entries []models.JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var (
+		entryTransactionIDs   []int
+		descriptions          []string
+		postingTransactionIDs []int
+		accounts              []models.AccountType
+		userIDs               []int
+		amounts               []models.Money
+	)
+	seen := make(map[int]bool, len(entries))
+	for _, entry := range entries {
+		if entry.TransactionID == 0 || seen[entry.TransactionID] {
+			return fmt.Errorf("journal entry needs a distinct transaction id, got %d", entry.TransactionID)
+		}
+		seen[entry.TransactionID] = true
+
+		var total models.Money
+		for _, posting := range entry.Postings {
+			total += posting.Amount
+			postingTransactionIDs = append(postingTransactionIDs, entry.TransactionID)
+			accounts = append(accounts, posting.Account.Type)
+			userIDs = append(userIDs, posting.Account.UserID)
+			amounts = append(amounts, posting.Amount)
+		}
+		if len(entry.Postings) < 2 || total != 0 {
+			return ErrUnbalancedEntry
+		}
+		entryTransactionIDs = append(entryTransactionIDs, entry.TransactionID)
+		descriptions = append(descriptions, entry.Description)
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		WITH entries AS (
+			INSERT INTO journal_entries (transaction_id,description)
+			SELECT * FROM unnest($1::int[], $2::text[])
+			RETURNING id, transaction_id
+		)
+		INSERT INTO postings (entry_id,account,user_id,amount)
+		SELECT e.id, p.account, p.user_id, p.amount
+		FROM unnest($3::int[], $4::text[], $5::int[], $6::numeric[]) AS p(transaction_id, account, user_id, amount)
+		JOIN entries e ON e.transaction_id = p.transaction_id`,
+		pq.Array(entryTransactionIDs), pq.Array(descriptions),
+		pq.Array(postingTransactionIDs), pq.Array(accounts), pq.Array(userIDs), pq.Array(amounts),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create journal entries: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func (r *repository) CreateBonusGrant(ctx context.Context, grant models.BonusGrant) (models.BonusGrant, error) {
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO bonus_grants (user_id,amount,remaining,expires_at,transaction_id)
+		VALUES ($1,$2,$2,$3,$4)
+		RETURNING id, remaining, created_at`,
+		grant.UserID, grant.Amount, grant.ExpiresAt, grant.TransactionID,
+	).Scan(&grant.ID, &grant.Remaining, &grant.CreatedAt)
+	if err != nil {
+		return models.BonusGrant{}, fmt.Errorf("failed to create bonus grant: %w", err)
+	}
+	return grant, nil
+}
+
+// SpendBonusGrants takes each user's amount out of their unexpired grants,
+// those expiring first before the others.
+func (r *repository) SpendBonusGrants(ctx context.Context, amounts map[int]models.Money, now time.Time) error {
+	userIDs, values := splitAmounts(amounts)
+	if len(userIDs) == 0 {
+		return nil
+	}
+	_, err := r.db.ExecContext(ctx, `
+		WITH ranked AS (
+			SELECT g.id, g.remaining, s.amount,
+				SUM(g.remaining) OVER (PARTITION BY g.user_id ORDER BY g.expires_at NULLS LAST, g.id) - g.remaining AS before
+			FROM bonus_grants g
+			JOIN unnest($1::int[], $2::numeric[]) AS s(user_id, amount) ON s.user_id = g.user_id
+			WHERE g.remaining > 0 AND (g.expires_at IS NULL OR g.expires_at > $3)
+		)
+		UPDATE bonus_grants g
+		SET remaining = g.remaining - LEAST(r.remaining, r.amount - r.before)
+		FROM ranked r
+		WHERE g.id = r.id AND r.before < r.amount`,
+		pq.Array(userIDs), pq.Array(values), now,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to spend bonus grants: %w", err)
+	}
+	return nil
+}
+
+// RestoreBonusGrants gives returned bonus back to the grants it was spent
+// from, refilling those expiring first. Grants that expired meanwhile are
+// refilled too and forfeit the credit on the next expiry run.
+func (r *repository) RestoreBonusGrants(ctx context.Context, amounts map[int]models.Money) error {
+	userIDs, values := splitAmounts(amounts)
+	if len(userIDs) == 0 {
+		return nil
+	}
+	_, err := r.db.ExecContext(ctx, `
+		WITH ranked AS (
+			SELECT g.id, g.amount - g.remaining AS room, s.amount,
+				SUM(g.amount - g.remaining) OVER (PARTITION BY g.user_id ORDER BY g.expires_at NULLS LAST, g.id) - (g.amount - g.remaining) AS before
+			FROM bonus_grants g
+			JOIN unnest($1::int[], $2::numeric[]) AS s(user_id, amount) ON s.user_id = g.user_id
+			WHERE g.remaining < g.amount
+		)
+		UPDATE bonus_grants g
+		SET remaining = g.remaining + LEAST(r.room, r.amount - r.before)
+		FROM ranked r
+		WHERE g.id = r.id AND r.before < r.amount`,
+		pq.Array(userIDs), pq.Array(values),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to restore bonus grants: %w", err)
+	}
+	return nil
+}
+
+// GetUsersWithExpiredBonus lists up to limit users holding credit in grants
+// expired at now.
+func (r *repository) GetUsersWithExpiredBonus(ctx context.Context, now time.Time, limit int) ([]int, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT user_id
+		FROM bonus_grants
+		WHERE remaining > 0 AND expires_at <= $1
+		GROUP BY user_id
+		ORDER BY MAX(expiry_failed_at) NULLS FIRST, MIN(expires_at), MIN(id)
+		LIMIT $2`,
+		now, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired bonus grants: %w", err)
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("failed to scan expired bonus grant: %w", err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get expired bonus grants: %w", err)
+	}
+	return userIDs, nil
+}
+
+// ExpireBonusGrants empties the users' grants expired at now, takes their
+// remaining credit off the bonus balances and returns what each user lost.
+func (r *repository) ExpireBonusGrants(ctx context.Context, userIDs []int, now time.Time) ([]models.BonusExpiry, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		WITH expired AS (
+			UPDATE bonus_grants g
+			SET remaining = 0
+			FROM (
+				SELECT id, remaining FROM bonus_grants
+				WHERE user_id = ANY($1) AND remaining > 0 AND expires_at <= $2
+			) old
+			WHERE g.id = old.id
+			RETURNING g.user_id, old.remaining
+		), totals AS (
+			SELECT user_id, SUM(remaining) AS amount FROM expired GROUP BY user_id
+		)
+		UPDATE users u
+		SET bonus_balance = u.bonus_balance - t.amount
+		FROM totals t
+		WHERE u.id = t.user_id
+		RETURNING u.id, t.amount`,
+		pq.Array(userIDs), now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire bonus grants: %w", err)
+	}
+	defer rows.Close()
+
+	var expiries []models.BonusExpiry
+	for rows.Next() {
+		var e models.BonusExpiry
+		if err := rows.Scan(&e.UserID, &e.Amount); err != nil {
+			return nil, fmt.Errorf("failed to scan bonus expiry: %w", err)
+		}
+		expiries = append(expiries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to expire bonus grants: %w", err)
+	}
+	return expiries, nil
+}
+
+// GetOrderBonus returns the bonus captured for the order that has not been
+// refunded yet.
+func (r *repository) GetOrderBonus(ctx context.Context, userId int, serviceId int, orderId int) (models.Money, error) {
+	var bonus models.Money
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(-bonus_amount), 0)
+		FROM transactions
+		WHERE user_id = $1 AND service_id = $2 AND order_id = $3 AND type IN ('confirm', 'refund')`,
+		userId, serviceId, orderId,
+	).Scan(&bonus)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get order bonus: %w", err)
+	}
+	return bonus, nil
+}
+
+func splitAmounts(amounts map[int]models.Money) ([]int, []models.Money) {
+	userIDs := make([]int, 0, len(amounts))
+	values := make([]models.Money, 0, len(amounts))
+	for userID, amount := range amounts {
+		if amount == 0 {
+			continue
+		}
+		userIDs = append(userIDs, userID)
+		values = append(values, amount)
+	}
+	return userIDs, values
+}
+
+func (r *repository) MarkBonusExpiryFailed(ctx context.Context, userID int, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE bonus_grants
+		SET expiry_failed_at = $1
+		WHERE user_id = $2 AND remaining > 0 AND expires_at <= $1`,
+		at, userID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to mark bonus grants: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+)
+
+func (r *repository) GetUserDebt(ctx context.Context, userID int) (models.Money, error) {
+	var debt models.Money
+	err := r.db.QueryRowContext(ctx, "SELECT debt FROM users WHERE id = $1", userID).Scan(&debt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRows
+		}
+		return 0, fmt.Errorf("failed to get user debt: %w", err)
+	}
+	return debt, nil
+}
+
+func (r *repository) UpdateUserDebt(ctx context.Context, userID int, amount models.Money) (models.Money, error) {
+	var debt models.Money
+	err := r.db.QueryRowContext(ctx, "UPDATE users SET debt = debt + $1 WHERE id = $2 RETURNING debt", amount, userID).Scan(&debt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRows
+		}
+		return 0, fmt.Errorf("failed to update user debt: %w", err)
+	}
+	return debt, nil
+}
+
+func (r *repository) GetTransaction(ctx context.Context, transactionID int) (models.Transaction, error) {
+	var t models.Transaction
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, user_id, service_id, order_id, amount, bonus_amount, type, description,
+			COALESCE(related_transaction_id, 0), COALESCE(counterparty_user_id, 0), COALESCE(external_payment_id, ''), created_at
+		FROM transactions
+		WHERE id = $1`,
+		transactionID,
+	).Scan(&t.ID, &t.UserID, &t.ServiceID, &t.OrderID, &t.Amount, &t.BonusAmount, &t.Type, &t.Description,
+		&t.RelatedTransactionID, &t.CounterpartyUserID, &t.ExternalPaymentID, &t.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Transaction{}, ErrNoRows
+		}
+		return models.Transaction{}, fmt.Errorf("failed to get transaction: %w", err)
+	}
+	return t, nil
+}
+
+func (r *repository) GetDepositReversal(ctx context.Context, depositID int) (int, error) {
+	var reversalID int
+	err := r.db.QueryRowContext(ctx,
+		"SELECT id FROM transactions WHERE related_transaction_id = $1 AND type = 'deposit_reversal'",
+		depositID,
+	).Scan(&reversalID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRows
+		}
+		return 0, fmt.Errorf("failed to get deposit reversal: %w", err)
+	}
+	return reversalID, nil
+}
@@ -0,0 +1,114 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+
+	"github.com/lib/pq"
+)
+
+const feeRuleColumns = "operation, service_id, rate_bps, min_fee, max_fee"
+
+func (r *repository) GetFeeRules(ctx context.Context) ([]models.FeeRule, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+feeRuleColumns+" FROM fee_rules ORDER BY operation, service_id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get fee rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []models.FeeRule
+	for rows.Next() {
+		var rule models.FeeRule
+		if err := rows.Scan(&rule.Operation, &rule.ServiceID, &rule.RateBps, &rule.MinFee, &rule.MaxFee); err != nil {
+			return nil, fmt.Errorf("failed to scan fee rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get fee rules: %w", err)
+	}
+	return rules, nil
+}
+
+// GetFeeRule returns the rule of the service, falling back to the default rule
+// of the operation. It returns ErrNoRows when neither exists.
+func (r *repository) GetFeeRule(ctx context.Context, operation models.FeeOperation, serviceID int) (models.FeeRule, error) {
+	var rule models.FeeRule
+	err := r.db.QueryRowContext(ctx, `
+		SELECT `+feeRuleColumns+`
+		FROM fee_rules
+		WHERE operation = $1 AND service_id IN (0, $2)
+		ORDER BY service_id DESC
+		LIMIT 1`,
+		operation, serviceID,
+	).Scan(&rule.Operation, &rule.ServiceID, &rule.RateBps, &rule.MinFee, &rule.MaxFee)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.FeeRule{}, ErrNoRows
+		}
+		return models.FeeRule{}, fmt.Errorf("failed to get fee rule: %w", err)
+	}
+	return rule, nil
+}
+
+func (r *repository) UpsertFeeRule(ctx context.Context, rule models.FeeRule) error {
+	var maxFee interface{}
+	if rule.MaxFee != nil {
+		maxFee = *rule.MaxFee
+	}
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO fee_rules (`+feeRuleColumns+`)
+		VALUES ($1,$2,$3,$4,$5)
+		ON CONFLICT (operation, service_id)
+		DO UPDATE SET rate_bps = EXCLUDED.rate_bps, min_fee = EXCLUDED.min_fee, max_fee = EXCLUDED.max_fee`,
+		rule.Operation, rule.ServiceID, rule.RateBps, rule.MinFee, maxFee,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save fee rule: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) DeleteFeeRule(ctx context.Context, operation models.FeeOperation, serviceID int) error {
+	result, err := r.db.ExecContext(ctx,
+		"DELETE FROM fee_rules WHERE operation = $1 AND service_id = $2",
+		operation, serviceID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete fee rule: %w", err)
+	}
+	return requireAffected(result)
+}
+
+// AddFeeRecords books fee transactions as fee income in the revenue report.
+// Fee transactions carry the fee as a negative amount.
+func (r *repository) AddFeeRecords(ctx context.Context, fees []models.Transaction) error {
+	if len(fees) == 0 {
+		return nil
+	}
+	var (
+		userIDs, serviceIDs, orderIDs []int
+		amounts                       []models.Money
+	)
+	for _, fee := range fees {
+		userIDs = append(userIDs, fee.UserID)
+		serviceIDs = append(serviceIDs, fee.ServiceID)
+		orderIDs = append(orderIDs, fee.OrderID)
+		amounts = append(amounts, -fee.Amount)
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO revenue_report (user_id,service_id,order_id,revenue,source,service_name)
+		SELECT f.user_id, f.service_id, f.order_id, f.revenue, 'fee', s.name
+		FROM unnest($1::int[], $2::int[], $3::int[], $4::numeric[]) AS f(user_id, service_id, order_id, revenue)
+		LEFT JOIN services s ON s.id = f.service_id`,
+		pq.Array(userIDs), pq.Array(serviceIDs), pq.Array(orderIDs), pq.Array(amounts),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add fee records: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"internship_backend_2022/internal/models"
+
+	"github.com/lib/pq"
+)
+
+func (r *repository) GetLimits(ctx context.Context, userIDs []int) ([]models.Limit, error) {
+	query := "SELECT user_id, operation, window_seconds, max_amount, max_count FROM limits"
+	var args []interface{}
+	if userIDs != nil {
+		query += " WHERE user_id = 0 OR user_id = ANY($1)"
+		args = append(args, pq.Array(userIDs))
+	}
+	rows, err := r.db.QueryContext(ctx, query+" ORDER BY user_id, operation, window_seconds", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get limits: %w", err)
+	}
+	defer rows.Close()
+
+	var limits []models.Limit
+	for rows.Next() {
+		var l models.Limit
+		if err := rows.Scan(&l.UserID, &l.Operation, &l.WindowSeconds, &l.MaxAmount, &l.MaxCount); err != nil {
+			return nil, fmt.Errorf("failed to scan limit: %w", err)
+		}
+		limits = append(limits, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get limits: %w", err)
+	}
+	return limits, nil
+}
+
+func (r *repository) UpsertLimit(ctx context.Context, limit models.Limit) error {
+	var maxAmount interface{}
+	if limit.MaxAmount != nil {
+		maxAmount = *limit.MaxAmount
+	}
+	var maxCount interface{}
+	if limit.MaxCount != nil {
+		maxCount = *limit.MaxCount
+	}
+	_, err := r.db.ExecContext(ctx, `
+		INSERT INTO limits (user_id,operation,window_seconds,max_amount,max_count)
+		VALUES ($1,$2,$3,$4,$5)
+		ON CONFLICT (user_id, operation, window_seconds)
+		DO UPDATE SET max_amount = EXCLUDED.max_amount, max_count = EXCLUDED.max_count`,
+		limit.UserID, limit.Operation, limit.WindowSeconds, maxAmount, maxCount,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save limit: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) DeleteLimit(ctx context.Context, userID int, operation models.LimitOperation, windowSeconds int) error {
+	result, err := r.db.ExecContext(ctx,
+		"DELETE FROM limits WHERE user_id = $1 AND operation = $2 AND window_seconds = $3",
+		userID, operation, windowSeconds,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to delete limit: %w", err)
+	}
+	return requireAffected(result)
+}
+
+// GetLimitUsage sums the users' deposits, outgoing transfers and reserves
+// within each window, measured back from the database clock.
+func (r *repository) GetLimitUsage(ctx context.Context, userIDs []int, windowSeconds []int) ([]models.LimitUsage, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT t.user_id, w.seconds,
+			CASE t.type WHEN 'deposit' THEN 'deposit' WHEN 'reserve' THEN 'reserve' ELSE 'transfer' END,
+			SUM(ABS(t.amount)), COUNT(*)
+		FROM transactions t
+		JOIN unnest($2::int[]) AS w(seconds) ON t.created_at > now() - make_interval(secs => w.seconds)
+		WHERE t.user_id = ANY($1)
+			AND (t.type IN ('deposit', 'reserve') OR (t.type = 'transfer' AND t.amount < 0))
+		GROUP BY 1, 2, 3`,
+		pq.Array(userIDs), pq.Array(windowSeconds),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get limit usage: %w", err)
+	}
+	defer rows.Close()
+
+	var usage []models.LimitUsage
+	for rows.Next() {
+		var u models.LimitUsage
+		if err := rows.Scan(&u.UserID, &u.WindowSeconds, &u.Operation, &u.Amount, &u.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan limit usage: %w", err)
+		}
+		usage = append(usage, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get limit usage: %w", err)
+	}
+	return usage, nil
+}
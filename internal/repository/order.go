@@ -0,0 +1,257 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+
+	"github.com/lib/pq"
+)
+
+const orderItemColumns = `order_id, user_id, service_id, status, amount, amount - captured - released,
+	captured, released, refunded, transaction_id, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrderItem(row rowScanner) (models.OrderItem, error) {
+	var i models.OrderItem
+	err := row.Scan(&i.OrderID, &i.UserID, &i.ServiceID, &i.Status, &i.Amount, &i.Reserved,
+		&i.Captured, &i.Released, &i.Refunded, &i.TransactionID, &i.CreatedAt, &i.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.OrderItem{}, ErrNoRows
+		}
+		return models.OrderItem{}, fmt.Errorf("failed to scan order item: %w", err)
+	}
+	return i, nil
+}
+
+func (r *repository) CreateOrder(ctx context.Context, order models.Order) (bool, error) {
+	result, err := r.db.ExecContext(ctx,
+		"INSERT INTO orders (user_id,id) VALUES ($1,$2) ON CONFLICT (user_id, id) DO NOTHING",
+		order.UserID, order.ID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to create order: %w", err)
+	}
+	created, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to create order: %w", err)
+	}
+	if created == 0 {
+		return false, nil
+	}
+
+	var (
+		serviceIDs, transactionIDs []int
+		amounts                    []models.Money
+	)
+	for _, item := range order.Items {
+		serviceIDs = append(serviceIDs, item.ServiceID)
+		amounts = append(amounts, item.Amount)
+		transactionIDs = append(transactionIDs, item.TransactionID)
+	}
+	result, err = r.db.ExecContext(ctx, `
+		INSERT INTO order_items (order_id,user_id,service_id,amount,transaction_id)
+		SELECT $1, $2, * FROM unnest($3::int[], $4::numeric[], $5::int[])
+		ON CONFLICT (order_id, service_id) DO NOTHING`,
+		order.ID, order.UserID, pq.Array(serviceIDs), pq.Array(amounts), pq.Array(transactionIDs),
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to create order items: %w", err)
+	}
+	created, err = result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to create order items: %w", err)
+	}
+	return created == int64(len(order.Items)), nil
+}
+
+func (r *repository) AddOrderItem(ctx context.Context, userID int, orderID int, item models.OrderItem) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		WITH new_order AS (
+			INSERT INTO orders (user_id,id) VALUES ($1,$2)
+			ON CONFLICT (user_id, id) DO NOTHING
+		)
+		INSERT INTO order_items (order_id,user_id,service_id,amount,transaction_id)
+		VALUES ($2,$1,$3,$4,$5)
+		ON CONFLICT (order_id, service_id) DO NOTHING`,
+		userID, orderID, item.ServiceID, item.Amount, item.TransactionID,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to create order item: %w", err)
+	}
+	created, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to create order item: %w", err)
+	}
+	return created == 1, nil
+}
+
+func (r *repository) CreateOrders(ctx context.Context, orders []models.Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	var (
+		orderIDs, userIDs                                               []int
+		itemOrderIDs, itemUserIDs, itemServiceIDs, itemTransactionIDs []int
+		itemAmounts                                                     []models.Money
+	)
+	for _, order := range orders {
+		orderIDs = append(orderIDs, order.ID)
+		userIDs = append(userIDs, order.UserID)
+		for _, item := range order.Items {
+			itemOrderIDs = append(itemOrderIDs, order.ID)
+			itemUserIDs = append(itemUserIDs, order.UserID)
+			itemServiceIDs = append(itemServiceIDs, item.ServiceID)
+			itemAmounts = append(itemAmounts, item.Amount)
+			itemTransactionIDs = append(itemTransactionIDs, item.TransactionID)
+		}
+	}
+
+	_, err := r.db.ExecContext(ctx, `
+		WITH new_orders AS (
+			INSERT INTO orders (user_id,id)
+			SELECT * FROM unnest($1::int[], $2::int[])
+			ON CONFLICT (user_id, id) DO NOTHING
+		)
+		INSERT INTO order_items (order_id,user_id,service_id,amount,transaction_id)
+		SELECT * FROM unnest($3::int[], $4::int[], $5::int[], $6::numeric[], $7::int[])`,
+		pq.Array(userIDs), pq.Array(orderIDs),
+		pq.Array(itemOrderIDs), pq.Array(itemUserIDs), pq.Array(itemServiceIDs), pq.Array(itemAmounts), pq.Array(itemTransactionIDs),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create orders: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) GetOrder(ctx context.Context, userID int, orderID int) (models.Order, error) {
+	order := models.Order{ID: orderID, UserID: userID}
+	err := r.db.QueryRowContext(ctx,
+		"SELECT created_at FROM orders WHERE user_id = $1 AND id = $2",
+		userID, orderID,
+	).Scan(&order.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Order{}, ErrNoRows
+		}
+		return models.Order{}, fmt.Errorf("failed to get order: %w", err)
+	}
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+orderItemColumns+`
+		FROM order_items
+		WHERE user_id = $1 AND order_id = $2
+		ORDER BY service_id`,
+		userID, orderID,
+	)
+	if err != nil {
+		return models.Order{}, fmt.Errorf("failed to get order items: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanOrderItem(rows)
+		if err != nil {
+			return models.Order{}, err
+		}
+		order.Items = append(order.Items, item)
+		order.Total += item.Amount
+	}
+	if err := rows.Err(); err != nil {
+		return models.Order{}, fmt.Errorf("failed to get order items: %w", err)
+	}
+	return order, nil
+}
+
+func (r *repository) GetOrderItems(ctx context.Context, orderIDs []int) ([]models.OrderItem, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT `+orderItemColumns+`
+		FROM order_items
+		WHERE order_id = ANY($1)
+		ORDER BY order_id, service_id`,
+		pq.Array(orderIDs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order items: %w", err)
+	}
+	defer rows.Close()
+
+	var items []models.OrderItem
+	for rows.Next() {
+		item, err := scanOrderItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get order items: %w", err)
+	}
+	return items, nil
+}
+
+func (r *repository) GetOrderItem(ctx context.Context, serviceID int, orderID int) (models.OrderItem, error) {
+	return scanOrderItem(r.db.QueryRowContext(ctx, `
+		SELECT `+orderItemColumns+`
+		FROM order_items
+		WHERE service_id = $1 AND order_id = $2`,
+		serviceID, orderID,
+	))
+}
+
+func (r *repository) GetOrderItemForUpdate(ctx context.Context, serviceID int, orderID int) (models.OrderItem, error) {
+	return scanOrderItem(r.db.QueryRowContext(ctx, `
+		SELECT `+orderItemColumns+`
+		FROM order_items
+		WHERE service_id = $1 AND order_id = $2
+		FOR UPDATE`,
+		serviceID, orderID,
+	))
+}
+
+func (r *repository) UpdateOrderItem(ctx context.Context, item models.OrderItem) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE order_items
+		SET status = $1, captured = $2, released = $3, refunded = $4, updated_at = now()
+		WHERE service_id = $5 AND order_id = $6`,
+		item.Status, item.Captured, item.Released, item.Refunded, item.ServiceID, item.OrderID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update order item: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) GetOrderTransactions(ctx context.Context, userID int, serviceID int, orderID int) ([]models.Transaction, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, user_id, service_id, order_id, amount, bonus_amount, type, description, COALESCE(related_transaction_id, 0), COALESCE(counterparty_user_id, 0), created_at
+		FROM transactions
+		WHERE user_id = $1 AND service_id = $2 AND order_id = $3
+		ORDER BY id`,
+		userID, serviceID, orderID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get order transactions: %w", err)
+	}
+	defer rows.Close()
+
+	var transactions []models.Transaction
+	for rows.Next() {
+		var t models.Transaction
+		err := rows.Scan(&t.ID, &t.UserID, &t.ServiceID, &t.OrderID, &t.Amount, &t.BonusAmount, &t.Type, &t.Description, &t.RelatedTransactionID, &t.CounterpartyUserID, &t.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan transaction: %w", err)
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get order transactions: %w", err)
+	}
+	return transactions, nil
+}
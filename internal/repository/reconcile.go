@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"internship_backend_2022/internal/models"
+)
+
+// availableDelta, bonusDelta and reservedDelta are the effect of a
+// transaction row t on the user's available, bonus and reserved balance.
+// Confirmations move money from reserved to revenue; unreserve and expiry move
+// it from reserved back to available. Every other type changes the available
+// and bonus balances by the real and bonus parts of its amount.
+const (
+	availableDelta = `CASE WHEN t.type IN ('confirm', 'reserved_adjustment') THEN 0 ELSE t.amount - t.bonus_amount END`
+	bonusDelta     = `CASE WHEN t.type IN ('confirm', 'reserved_adjustment') THEN 0 ELSE t.bonus_amount END`
+	reservedDelta  = `CASE
+		WHEN t.type IN ('confirm', 'reserved_adjustment') THEN t.amount
+		WHEN t.type IN ('reserve', 'unreserve', 'expired') THEN -t.amount
+		ELSE 0
+	END`
+)
+
+func (r *repository) GetBalanceDiscrepancies(ctx context.Context, userID int) ([]models.BalanceDiscrepancy, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		WITH history AS (
+			SELECT t.user_id, SUM(`+availableDelta+`) AS available, SUM(`+reservedDelta+`) AS reserved
+			FROM transactions t
+			WHERE $1 = 0 OR t.user_id = $1
+			GROUP BY t.user_id
+		), held AS (
+			SELECT user_id, SUM(amount) AS reserved
+			FROM reserved_funds
+			WHERE $1 = 0 OR user_id = $1
+			GROUP BY user_id
+		)
+		SELECT u.id, u.balance, COALESCE(hi.available, 0), COALESCE(he.reserved, 0), COALESCE(hi.reserved, 0)
+		FROM users u
+		LEFT JOIN history hi ON hi.user_id = u.id
+		LEFT JOIN held he ON he.user_id = u.id
+		WHERE ($1 = 0 OR u.id = $1)
+			AND (u.balance <> COALESCE(hi.available, 0) OR COALESCE(he.reserved, 0) <> COALESCE(hi.reserved, 0))
+		ORDER BY u.id`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance discrepancies: %w", err)
+	}
+	defer rows.Close()
+
+	var discrepancies []models.BalanceDiscrepancy
+	for rows.Next() {
+		var d models.BalanceDiscrepancy
+		if err := rows.Scan(&d.UserID, &d.Balance, &d.ExpectedBalance, &d.Reserved, &d.ExpectedReserved); err != nil {
+			return nil, fmt.Errorf("failed to scan balance discrepancy: %w", err)
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get balance discrepancies: %w", err)
+	}
+
+	return discrepancies, nil
+}
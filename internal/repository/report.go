@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"time"
+)
+
+const reportJobColumns = `id, year, month, status, COALESCE(file_key, ''), COALESCE(error, ''), created_at, completed_at, expires_at`
+
+func scanReportJob(row *sql.Row) (models.ReportJob, error) {
+	var j models.ReportJob
+	err := row.Scan(&j.ID, &j.Year, &j.Month, &j.Status, &j.FileKey, &j.Error, &j.CreatedAt, &j.CompletedAt, &j.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.ReportJob{}, ErrNoRows
+		}
+		return models.ReportJob{}, fmt.Errorf("failed to get report job: %w", err)
+	}
+	return j, nil
+}
+
+func (r *repository) CreateReportJob(ctx context.Context, year int, month int) (models.ReportJob, error) {
+	return scanReportJob(r.db.QueryRowContext(ctx,
+		"INSERT INTO report_jobs (year, month) VALUES ($1, $2) RETURNING "+reportJobColumns,
+		year, month,
+	))
+}
+
+func (r *repository) GetReportJob(ctx context.Context, jobID int) (models.ReportJob, error) {
+	return scanReportJob(r.db.QueryRowContext(ctx, "SELECT "+reportJobColumns+" FROM report_jobs WHERE id = $1", jobID))
+}
+
+func (r *repository) GetReportJobForUpdate(ctx context.Context, jobID int) (models.ReportJob, error) {
+	return scanReportJob(r.db.QueryRowContext(ctx, "SELECT "+reportJobColumns+" FROM report_jobs WHERE id = $1 FOR UPDATE", jobID))
+}
+
+func (r *repository) GetReportJobIDsByStatus(ctx context.Context, status models.ReportStatus, limit int) ([]int, error) {
+	return r.reportJobIDs(ctx, "SELECT id FROM report_jobs WHERE status = $1 ORDER BY id LIMIT $2", status, limit)
+}
+
+func (r *repository) GetExpiredReportJobIDs(ctx context.Context, now time.Time, limit int) ([]int, error) {
+	return r.reportJobIDs(ctx, "SELECT id FROM report_jobs WHERE status = 'completed' AND expires_at <= $1 ORDER BY expires_at LIMIT $2", now, limit)
+}
+
+func (r *repository) reportJobIDs(ctx context.Context, query string, args ...interface{}) ([]int, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get report jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var jobIDs []int
+	for rows.Next() {
+		var jobID int
+		if err := rows.Scan(&jobID); err != nil {
+			return nil, fmt.Errorf("failed to scan report job: %w", err)
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get report jobs: %w", err)
+	}
+	return jobIDs, nil
+}
+
+func (r *repository) UpdateReportJob(ctx context.Context, job models.ReportJob) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE report_jobs
+		SET status = $1, file_key = NULLIF($2, ''), error = NULLIF($3, ''), completed_at = $4, expires_at = $5
+		WHERE id = $6`,
+		job.Status, job.FileKey, job.Error, job.CompletedAt, job.ExpiresAt, job.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update report job: %w", err)
+	}
+	return nil
+}
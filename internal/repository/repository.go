@@ -6,38 +6,228 @@ import (
 	"errors"
 	"fmt"
 	"internship_backend_2022/internal/models"
-	"math/big"
+	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 var (
-	ErrNoRows = sql.ErrNoRows
+	ErrNoRows          = sql.ErrNoRows
+	ErrUnbalancedEntry = errors.New("journal entry postings do not sum to zero")
+	// ErrDuplicateExternalPayment is returned when a deposit reuses an
+	// external payment id already credited.
+	ErrDuplicateExternalPayment = errors.New("external payment already credited")
 )
 
+// externalPaymentIndex is the unique index over deposit external payment ids.
+const externalPaymentIndex = "transactions_external_payment_idx"
+
+// DBTX is the subset of *sql.DB and *sql.Tx used by the repository, so the same
+// queries can run either on the pool or inside a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 type Repository interface {
-	GetUserBalance(ctx context.Context, userID int) (*big.Float, error)
-	GetUserReservedFunds(ctx context.Context, userId int) (*big.Float, error)
+	// WithTx runs fn inside a single database transaction. The Repository passed
+	// to fn is bound to that transaction; the transaction is committed when fn
+	// returns nil and rolled back otherwise. Nested calls reuse the outer transaction.
+	WithTx(ctx context.Context, fn func(repo Repository) error) error
+	GetUserBalance(ctx context.Context, userID int) (models.Money, error)
+	GetUserBonusBalance(ctx context.Context, userID int) (models.Money, error)
+	// GetUserForUpdate reads the user and locks the row until the surrounding
+	// transaction ends. ErrNoRows is returned for unknown users.
+	GetUserForUpdate(ctx context.Context, userID int) (models.User, error)
+	UpdateUserStatus(ctx context.Context, userID int, status models.UserStatus, reason string) (models.User, error)
+	GetUserReservedFunds(ctx context.Context, userId int) (models.Money, error)
+	// GetUserBalanceAt reconstructs the available, bonus and reserved balance
+	// at the given moment from the transactions history. It also returns when
+	// the user was created; ErrNoRows is returned for unknown users.
+	GetUserBalanceAt(ctx context.Context, userID int, at time.Time) (available models.Money, bonus models.Money, reserved models.Money, createdAt time.Time, err error)
 	CreateUser(ctx context.Context, userID int) error
-	CreateTransaction(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float, txType models.TransactionType, descriptions string) (int, error)
-	UpdateUserBalance(ctx context.Context, userID int, amount *big.Float) (*big.Float, error)
-	ReserveFunds(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float) (int, error)
+	CreateTransaction(ctx context.Context, transaction models.Transaction) (int, error)
+	UpdateUserBalance(ctx context.Context, userID int, amount models.Money) (models.Money, error)
+	// UpdateUserBonusBalance adds amount to the bonus balance and returns it.
+	UpdateUserBonusBalance(ctx context.Context, userID int, amount models.Money) (models.Money, error)
+	// ReserveFunds creates a hold of amount, bonus of which was drawn from the
+	// bonus balance; a nil expiresAt means it never expires.
+	ReserveFunds(ctx context.Context, userId int, serviceId int, orderId int, amount models.Money, bonus models.Money, expiresAt *time.Time) (int, error)
 	DeleteReservation(ctx context.Context, ReservedID int) error
-	DeleteReservationByServiceAndOrder(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float) error
-	GetReserveFundsByServiceAndOrder(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float) (bool, error)
-	AddRevenueRecord(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float) error
-	Transfer(ctx context.Context, fromUserId int, toUserId int, amount *big.Float) error
+	// GetReservationsForUpdate returns the holds of the order, oldest first, and
+	// locks them until the surrounding transaction ends.
+	GetReservationsForUpdate(ctx context.Context, userId int, serviceId int, orderId int) ([]models.Reservation, error)
+	UpdateReservationAmount(ctx context.Context, reservedID int, amount models.Money, bonus models.Money) error
+	// ExtendReservations moves the expiry of the order's unexpired holds to
+	// expiresAt and returns how many holds were extended.
+	ExtendReservations(ctx context.Context, userId int, serviceId int, orderId int, expiresAt time.Time) (int64, error)
+	// GetExpiredOrders lists up to limit orders that have at least one hold
+	// expired at now, oldest first. Orders whose release failed come last so
+	// they cannot fill every batch.
+	GetExpiredOrders(ctx context.Context, now time.Time, limit int) ([]models.Reservation, error)
+	// MarkReleaseFailed records that the order's expired holds could not be
+	// released.
+	MarkReleaseFailed(ctx context.Context, userId int, serviceId int, orderId int, at time.Time) error
+	// ListReservations returns one page of holds matching filter and the total
+	// number of matches. SortBy and SortOrder must already be validated.
+	ListReservations(ctx context.Context, filter models.ReservationFilter) ([]models.Reservation, int, error)
+	CreateCapture(ctx context.Context, capture models.Capture) (int, error)
+	GetCaptures(ctx context.Context, serviceId int, orderId int) ([]models.Capture, error)
+	// ReleaseReservations deletes every hold of the order and returns their
+	// total and its bonus part. ErrNoRows is returned when the order holds nothing.
+	ReleaseReservations(ctx context.Context, userId int, serviceId int, orderId int) (models.Money, models.Money, error)
+	AddRevenueRecord(ctx context.Context, userId int, serviceId int, orderId int, amount models.Money) error
+	// Transfer moves amount between the two balances. ErrNoRows is returned
+	// when either user does not exist.
+	Transfer(ctx context.Context, fromUserId int, toUserId int, amount models.Money) error
+	// GetMonthlyReportData sums the month's revenue per service, named as the
+	// service was named when its latest revenue of the month was booked.
 	GetMonthlyReportData(ctx context.Context, year, month int) ([]models.MonthlyReportData, error)
+	// CreateJournalEntry stores a ledger entry with its postings. Entries whose
+	// postings do not sum to zero are rejected with ErrUnbalancedEntry.
+	CreateJournalEntry(ctx context.Context, entry models.JournalEntry) (int, error)
+	GetLedgerAccountTotals(ctx context.Context) (map[models.AccountType]models.Money, error)
+	GetUnbalancedJournalEntries(ctx context.Context) ([]int, error)
+	// GetLedgerDiscrepancies lists users whose users.balance or reserved_funds
+	// disagree with the balances derived from their postings.
+	GetLedgerDiscrepancies(ctx context.Context) ([]models.LedgerDiscrepancy, error)
+	// GetBalanceDiscrepancies lists users whose users.balance or reserved_funds
+	// disagree with the balances derived from their transactions. A non-zero
+	// userID limits the check to that user.
+	GetBalanceDiscrepancies(ctx context.Context, userID int) ([]models.BalanceDiscrepancy, error)
 	GetTransactions(ctx context.Context, userId int, page int, limit int, sortBy string, sortOrder string) ([]models.Transaction, int, error)
+	// CreateIdempotencyKey registers the key and reports whether it was new. When
+	// another transaction holds the same key the call waits for it to finish.
+	CreateIdempotencyKey(ctx context.Context, key string, requestHash string) (bool, error)
+	GetIdempotencyKey(ctx context.Context, key string) (models.IdempotencyRecord, error)
+	SaveIdempotencyResponse(ctx context.Context, key string, response []byte) error
+	// GetOrderRevenue returns the net revenue booked for the order, i.e.
+	// confirmed amounts minus refunds.
+	GetOrderRevenue(ctx context.Context, userId int, serviceId int, orderId int) (models.Money, error)
+	// GetLastTransaction returns the most recent transaction of txType for the
+	// order, or ErrNoRows.
+	GetLastTransaction(ctx context.Context, userId int, serviceId int, orderId int, txType models.TransactionType) (models.Transaction, error)
+	GetDepositByExternalPaymentID(ctx context.Context, externalPaymentID string) (models.Transaction, error)
+	CreatePayout(ctx context.Context, payout models.Payout) (int, error)
+	GetPayout(ctx context.Context, payoutID int) (models.Payout, error)
+	// GetPayoutForUpdate locks the payout until the surrounding transaction ends.
+	GetPayoutForUpdate(ctx context.Context, payoutID int) (models.Payout, error)
+	GetPayoutIDsByStatus(ctx context.Context, status models.PayoutStatus, limit int) ([]int, error)
+	UpdatePayout(ctx context.Context, payout models.Payout) error
+	// CreateOrder stores the order and its items and reports whether all of
+	// them were new. Order ids are scoped to the user, so it reports false when
+	// the user already has the order or another user holds one of its lines.
+	CreateOrder(ctx context.Context, order models.Order) (bool, error)
+	// AddOrderItem adds a line to the user's order, creating the order when
+	// needed, and reports false when (service_id, order_id) is already taken.
+	AddOrderItem(ctx context.Context, userID int, orderID int, item models.OrderItem) (bool, error)
+	// GetOrder returns the user's order with its items, or ErrNoRows.
+	GetOrder(ctx context.Context, userID int, orderID int) (models.Order, error)
+	// GetOrderItems returns the lines of every user's orders with these ids.
+	GetOrderItems(ctx context.Context, orderIDs []int) ([]models.OrderItem, error)
+	// GetOrderItem returns the line of (serviceID, orderID), or ErrNoRows.
+	GetOrderItem(ctx context.Context, serviceID int, orderID int) (models.OrderItem, error)
+	// GetOrderItemForUpdate locks the line until the surrounding transaction ends.
+	GetOrderItemForUpdate(ctx context.Context, serviceID int, orderID int) (models.OrderItem, error)
+	UpdateOrderItem(ctx context.Context, item models.OrderItem) error
+	GetOrderTransactions(ctx context.Context, userID int, serviceID int, orderID int) ([]models.Transaction, error)
+	// GetLimits returns the global limits together with the overrides of the
+	// given users; nil userIDs returns every limit.
+	GetLimits(ctx context.Context, userIDs []int) ([]models.Limit, error)
+	UpsertLimit(ctx context.Context, limit models.Limit) error
+	// DeleteLimit returns ErrNoRows when the limit does not exist.
+	DeleteLimit(ctx context.Context, userID int, operation models.LimitOperation, windowSeconds int) error
+	GetLimitUsage(ctx context.Context, userIDs []int, windowSeconds []int) ([]models.LimitUsage, error)
+	GetFeeRules(ctx context.Context) ([]models.FeeRule, error)
+	// GetFeeRule returns the rule of the service or else the operation's
+	// default rule, or ErrNoRows when there is neither.
+	GetFeeRule(ctx context.Context, operation models.FeeOperation, serviceID int) (models.FeeRule, error)
+	UpsertFeeRule(ctx context.Context, rule models.FeeRule) error
+	// DeleteFeeRule returns ErrNoRows when the rule does not exist.
+	DeleteFeeRule(ctx context.Context, operation models.FeeOperation, serviceID int) error
+	// AddFeeRecords books fee transactions as fee income in the revenue report.
+	AddFeeRecords(ctx context.Context, fees []models.Transaction) error
+	// CreateBonusGrant stores a grant with its full amount remaining.
+	CreateBonusGrant(ctx context.Context, grant models.BonusGrant) (models.BonusGrant, error)
+	// SpendBonusGrants and RestoreBonusGrants keep the grants in step with
+	// bonus spent and returned; the users must be locked.
+	SpendBonusGrants(ctx context.Context, amounts map[int]models.Money, now time.Time) error
+	RestoreBonusGrants(ctx context.Context, amounts map[int]models.Money) error
+	// GetUsersWithExpiredBonus lists up to limit users with expired grants,
+	// oldest first. Users whose expiry failed come last.
+	GetUsersWithExpiredBonus(ctx context.Context, now time.Time, limit int) ([]int, error)
+	// MarkBonusExpiryFailed records that the user's expired grants could not be
+	// forfeited.
+	MarkBonusExpiryFailed(ctx context.Context, userID int, at time.Time) error
+	// ExpireBonusGrants forfeits the credit of the locked users' expired grants.
+	ExpireBonusGrants(ctx context.Context, userIDs []int, now time.Time) ([]models.BonusExpiry, error)
+	GetOrderBonus(ctx context.Context, userId int, serviceId int, orderId int) (models.Money, error)
+	GetUserDebt(ctx context.Context, userID int) (models.Money, error)
+	GetServices(ctx context.Context) ([]models.Service, error)
+	// GetService returns the catalog entry of the service, or ErrNoRows.
+	GetService(ctx context.Context, serviceID int) (models.Service, error)
+	// CreateService inserts the service and reports false when the id is taken.
+	CreateService(ctx context.Context, service models.Service) (models.Service, bool, error)
+	UpdateService(ctx context.Context, service models.Service) (models.Service, error)
+	DeleteService(ctx context.Context, serviceID int) error
+	CreateReportJob(ctx context.Context, year int, month int) (models.ReportJob, error)
+	// GetReportJob returns the job, or ErrNoRows.
+	GetReportJob(ctx context.Context, jobID int) (models.ReportJob, error)
+	// GetReportJobForUpdate locks the job until the surrounding transaction ends.
+	GetReportJobForUpdate(ctx context.Context, jobID int) (models.ReportJob, error)
+	GetReportJobIDsByStatus(ctx context.Context, status models.ReportStatus, limit int) ([]int, error)
+	// GetExpiredReportJobIDs lists completed jobs whose file expired at now.
+	GetExpiredReportJobIDs(ctx context.Context, now time.Time, limit int) ([]int, error)
+	UpdateReportJob(ctx context.Context, job models.ReportJob) error
+	// UpdateUserDebt adds amount to the user's debt and returns it.
+	UpdateUserDebt(ctx context.Context, userID int, amount models.Money) (models.Money, error)
+	// GetTransaction returns the transaction with the id, or ErrNoRows.
+	GetTransaction(ctx context.Context, transactionID int) (models.Transaction, error)
+	// GetDepositReversal returns the id of the transaction that reversed the
+	// deposit, or ErrNoRows when it has not been reversed.
+	GetDepositReversal(ctx context.Context, depositID int) (int, error)
+
+	// The bulk methods below write many rows per statement for batch operations.
+
+	// CreateUsers creates the missing users with a zero balance.
+	CreateUsers(ctx context.Context, userIDs []int) error
+	// GetUsersForUpdate reads and locks the existing users in id order. Unknown
+	// ids are missing from the result.
+	GetUsersForUpdate(ctx context.Context, userIDs []int) (map[int]models.User, error)
+	// AdjustUserBalances adds each delta to the user's balance.
+	AdjustUserBalances(ctx context.Context, deltas map[int]models.Money) error
+	AdjustUserBonusBalances(ctx context.Context, deltas map[int]models.Money) error
+	AdjustUserDebts(ctx context.Context, deltas map[int]models.Money) error
+	// GetServicesByID returns the catalog entries of serviceIDs; unknown ids
+	// are missing from the result.
+	GetServicesByID(ctx context.Context, serviceIDs []int) (map[int]models.Service, error)
+	// NextTransactionIDs allocates n transaction ids so related transactions
+	// can reference each other before they are inserted.
+	NextTransactionIDs(ctx context.Context, n int) ([]int, error)
+	// CreateTransactions inserts transactions with ids from NextTransactionIDs.
+	CreateTransactions(ctx context.Context, transactions []models.Transaction) error
+	CreateReservations(ctx context.Context, reservations []models.Reservation) error
+	// CreateOrders inserts new order lines; orders the user already has are
+	// reused. Callers check that the lines are free beforehand.
+	CreateOrders(ctx context.Context, orders []models.Order) error
+	// CreateJournalEntries stores entries and their postings in one statement.
+	// Every entry needs a distinct TransactionID.
+	CreateJournalEntries(ctx context.Context, entries []models.JournalEntry) error
 }
 type repository struct {
-	db *sql.DB
+	db DBTX
+	// conn is nil when the repository is bound to a transaction.
+	conn *sql.DB
 }
 
 func NewRepository(db *sql.DB) Repository {
 	return &repository{
-		db: db,
+		db:   db,
+		conn: db,
 	}
 }
 
@@ -56,55 +246,130 @@ func InitDB(connStr string) (*sql.DB, error) {
 	return db, nil
 }
 
-func (r *repository) GetUserBalance(ctx context.Context, userID int) (*big.Float, error) {
+func (r *repository) WithTx(ctx context.Context, fn func(repo Repository) error) error {
+	if r.conn == nil {
+		return fn(r)
+	}
+
+	tx, err := r.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(&repository{db: tx}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) GetUserBalance(ctx context.Context, userID int) (models.Money, error) {
 	stmt, err := r.db.Prepare("SELECT balance FROM users WHERE id = $1")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user balance: %w", err)
+		return 0, fmt.Errorf("failed to get user balance: %w", err)
 	}
 	defer stmt.Close()
 
-	var balanceStr string
-	err = stmt.QueryRowContext(ctx, userID).Scan(&balanceStr)
+	var balance models.Money
+	err = stmt.QueryRowContext(ctx, userID).Scan(&balance)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user not found: %w", err)
+			return 0, fmt.Errorf("user not found: %w", err)
 		}
-		return nil, fmt.Errorf("failed to get user balance: %w", err)
+		return 0, fmt.Errorf("failed to get user balance: %w", err)
 	}
 
-	balance, ok := new(big.Float).SetString(balanceStr)
-	if !ok {
-		return nil, fmt.Errorf("failed to convert balance to big.Float: %w", err)
+	return balance, nil
+}
+
+func (r *repository) GetUserBonusBalance(ctx context.Context, userID int) (models.Money, error) {
+	var bonus models.Money
+	err := r.db.QueryRowContext(ctx, "SELECT bonus_balance FROM users WHERE id = $1", userID).Scan(&bonus)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRows
+		}
+		return 0, fmt.Errorf("failed to get user bonus balance: %w", err)
 	}
+	return bonus, nil
+}
 
-	return balance, nil
+const userColumns = `id, balance, bonus_balance, debt, status, COALESCE(status_reason, ''), status_changed_at`
+
+func scanUser(row *sql.Row) (models.User, error) {
+	var u models.User
+	err := row.Scan(&u.ID, &u.Balance, &u.BonusBalance, &u.Debt, &u.Status, &u.StatusReason, &u.StatusChangedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.User{}, fmt.Errorf("user not found: %w", err)
+		}
+		return models.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	return u, nil
 }
 
-func (r *repository) GetUserReservedFunds(ctx context.Context, userId int) (*big.Float, error) {
-	var totalReservedStr string
+func (r *repository) GetUserForUpdate(ctx context.Context, userID int) (models.User, error) {
+	return scanUser(r.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE id = $1 FOR UPDATE", userID))
+}
+
+func (r *repository) UpdateUserStatus(ctx context.Context, userID int, status models.UserStatus, reason string) (models.User, error) {
+	return scanUser(r.db.QueryRowContext(ctx, `
+		UPDATE users
+		SET status = $1, status_reason = NULLIF($2, ''), status_changed_at = now()
+		WHERE id = $3
+		RETURNING `+userColumns,
+		status, reason, userID,
+	))
+}
+
+func (r *repository) GetUserReservedFunds(ctx context.Context, userId int) (models.Money, error) {
+	var totalReserved models.Money
 	err := r.db.QueryRowContext(ctx, `
         SELECT COALESCE(SUM(amount), '0')
         FROM reserved_funds
         WHERE user_id = $1`,
 		userId,
-	).Scan(&totalReservedStr)
+	).Scan(&totalReserved)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get reserved balance: %w", err)
-	}
-
-	totalReserved, ok := new(big.Float).SetString(totalReservedStr)
-	if !ok {
-		return nil, fmt.Errorf("failed to parse total reserved balance: %s", totalReservedStr)
+		return 0, fmt.Errorf("failed to get reserved balance: %w", err)
 	}
 
 	return totalReserved, nil
 }
 
+func (r *repository) GetUserBalanceAt(ctx context.Context, userID int, at time.Time) (models.Money, models.Money, models.Money, time.Time, error) {
+	var available, bonus, reserved models.Money
+	var createdAt time.Time
+	err := r.db.QueryRowContext(ctx, `
+		SELECT u.created_at,
+			COALESCE(SUM(`+availableDelta+`), 0),
+			COALESCE(SUM(`+bonusDelta+`), 0),
+			COALESCE(SUM(`+reservedDelta+`), 0)
+		FROM users u
+		LEFT JOIN transactions t ON t.user_id = u.id AND t.created_at <= $2
+		WHERE u.id = $1
+		GROUP BY u.created_at`,
+		userID, at,
+	).Scan(&createdAt, &available, &bonus, &reserved)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, 0, 0, time.Time{}, ErrNoRows
+		}
+		return 0, 0, 0, time.Time{}, fmt.Errorf("failed to get balance history: %w", err)
+	}
+	return available, bonus, reserved, createdAt, nil
+}
+
 func (r *repository) CreateUser(ctx context.Context, userID int) error {
-	stmt, err := r.db.Prepare("INSERT INTO users (id,balance) VALUES ($1,0.00)")
+	stmt, err := r.db.Prepare("INSERT INTO users (id,balance) VALUES ($1,0.00) ON CONFLICT (id) DO NOTHING")
 	if err != nil {
 		return fmt.Errorf("failed to create user: %w", err)
 	}
+	defer stmt.Close()
 	_, err = stmt.ExecContext(ctx, userID)
 	if err != nil {
 		return fmt.Errorf("failed to create user: %w", err)
@@ -112,63 +377,76 @@ func (r *repository) CreateUser(ctx context.Context, userID int) error {
 	return nil
 }
 
-func (r *repository) CreateTransaction(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float, txType models.TransactionType, descriptions string) (int, error) {
+func (r *repository) CreateTransaction(ctx context.Context, transaction models.Transaction) (int, error) {
 	var transactionsID int
-	stmt, err := r.db.Prepare(`INSERT INTO transactions (user_id,service_id,order_id,amount,type,description)
-	VALUES ($1,$2,$3,$4,$5,$6)
+	stmt, err := r.db.Prepare(`INSERT INTO transactions (user_id,service_id,order_id,amount,bonus_amount,type,description,related_transaction_id,counterparty_user_id,external_payment_id)
+	VALUES ($1,$2,$3,$4,$5,$6,$7,NULLIF($8, 0),NULLIF($9, 0),NULLIF($10, ''))
 	RETURNING id`)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create transaction: %w", err)
 	}
 	defer stmt.Close()
-	_ = stmt.QueryRowContext(ctx, userId, serviceId, orderId, amount.Text('f', 2), txType, descriptions).Scan(&transactionsID)
+	err = stmt.QueryRowContext(ctx,
+		transaction.UserID,
+		transaction.ServiceID,
+		transaction.OrderID,
+		transaction.Amount,
+		transaction.BonusAmount,
+		transaction.Type,
+		transaction.Description,
+		transaction.RelatedTransactionID,
+		transaction.CounterpartyUserID,
+		transaction.ExternalPaymentID,
+	).Scan(&transactionsID)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == externalPaymentIndex {
+			return 0, fmt.Errorf("%w: %s", ErrDuplicateExternalPayment, transaction.ExternalPaymentID)
+		}
+		return 0, fmt.Errorf("failed to create transaction: %w", err)
+	}
 	return transactionsID, nil
 
 }
 
-func (r *repository) UpdateUserBalance(ctx context.Context, userID int, amount *big.Float) (*big.Float, error) {
-	tx, err := r.db.BeginTx(ctx, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
-
-	var currentBalanceStr string
-	err = tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = $1 FOR UPDATE", userID).Scan(&currentBalanceStr)
+func (r *repository) UpdateUserBalance(ctx context.Context, userID int, amount models.Money) (models.Money, error) {
+	var newBalance models.Money
+	err := r.db.QueryRowContext(ctx, "UPDATE users SET balance = balance + $1 WHERE id = $2 RETURNING balance", amount, userID).Scan(&newBalance)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrNoRows
+			return 0, ErrNoRows
 		}
-		return nil, fmt.Errorf("failed to get user balance: %w", err)
-	}
-	currentBalance, ok := new(big.Float).SetString(currentBalanceStr)
-	if !ok {
-		return nil, fmt.Errorf("failed to convert balance to big.Float: %w", err)
+		return 0, fmt.Errorf("failed to update user balance: %w", err)
 	}
-	newBalance := new(big.Float).Add(currentBalance, amount)
 
-	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $1 WHERE id = $2", newBalance.String(), userID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to update user balance: %w", err)
-	}
+	return newBalance, nil
+}
 
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+func (r *repository) UpdateUserBonusBalance(ctx context.Context, userID int, amount models.Money) (models.Money, error) {
+	var newBonus models.Money
+	err := r.db.QueryRowContext(ctx, "UPDATE users SET bonus_balance = bonus_balance + $1 WHERE id = $2 RETURNING bonus_balance", amount, userID).Scan(&newBonus)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRows
+		}
+		return 0, fmt.Errorf("failed to update user bonus balance: %w", err)
 	}
-
-	return newBalance, nil
+	return newBonus, nil
 }
 
-func (r *repository) ReserveFunds(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float) (int, error) {
+func (r *repository) ReserveFunds(ctx context.Context, userId int, serviceId int, orderId int, amount models.Money, bonus models.Money, expiresAt *time.Time) (int, error) {
 	var ReservedID int
-	stmt, err := r.db.Prepare(`INSERT INTO reserved_funds (user_id,service_id,order_id,amount)
-	VALUES ($1,$2,$3,$4)
+	stmt, err := r.db.Prepare(`INSERT INTO reserved_funds (user_id,service_id,order_id,amount,bonus_amount,expires_at)
+	VALUES ($1,$2,$3,$4,$5,$6)
 	RETURNING id`)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create transaction: %w", err)
+		return 0, fmt.Errorf("failed to reserve funds: %w", err)
 	}
 	defer stmt.Close()
-	_ = stmt.QueryRowContext(ctx, userId, serviceId, orderId, amount.Text('f', 2)).Scan(&ReservedID)
+	err = stmt.QueryRowContext(ctx, userId, serviceId, orderId, amount, bonus, expiresAt).Scan(&ReservedID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve funds: %w", err)
+	}
 	return ReservedID, nil
 }
 
@@ -177,6 +455,7 @@ func (r *repository) DeleteReservation(ctx context.Context, ReservedID int) erro
 	if err != nil {
 		return fmt.Errorf("failed to delete reservation: %w", err)
 	}
+	defer stmt.Close()
 	_, err = stmt.ExecContext(ctx, ReservedID)
 	if err != nil {
 		return fmt.Errorf("failed to delete reservation: %w", err)
@@ -184,37 +463,252 @@ func (r *repository) DeleteReservation(ctx context.Context, ReservedID int) erro
 	return nil
 }
 
-func (r *repository) GetReserveFundsByServiceAndOrder(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float) (bool, error) {
-	var Exist bool
-	stmt, err := r.db.Prepare("SELECT EXISTS(SELECT 1 FROM reserved_funds WHERE user_id = $1 AND service_id = $2 AND order_id = $3 AND amount = $4)")
+func (r *repository) GetReservationsForUpdate(ctx context.Context, userId int, serviceId int, orderId int) ([]models.Reservation, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, user_id, service_id, order_id, amount, bonus_amount, expires_at, created_at
+		FROM reserved_funds
+		WHERE user_id = $1 AND service_id = $2 AND order_id = $3
+		ORDER BY id
+		FOR UPDATE`,
+		userId, serviceId, orderId,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reservations: %w", err)
+	}
+	defer rows.Close()
+
+	var reservations []models.Reservation
+	for rows.Next() {
+		var res models.Reservation
+		if err := rows.Scan(&res.ID, &res.UserID, &res.ServiceID, &res.OrderID, &res.Amount, &res.BonusAmount, &res.ExpiresAt, &res.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan reservation: %w", err)
+		}
+		reservations = append(reservations, res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get reservations: %w", err)
+	}
+
+	return reservations, nil
+}
+
+func (r *repository) UpdateReservationAmount(ctx context.Context, reservedID int, amount models.Money, bonus models.Money) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE reserved_funds SET amount = $1, bonus_amount = $2 WHERE id = $3", amount, bonus, reservedID)
+	if err != nil {
+		return fmt.Errorf("failed to update reservation: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) ExtendReservations(ctx context.Context, userId int, serviceId int, orderId int, expiresAt time.Time) (int64, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE reserved_funds SET expires_at = $4
+		WHERE user_id = $1 AND service_id = $2 AND order_id = $3
+			AND (expires_at IS NULL OR expires_at > now())`,
+		userId, serviceId, orderId, expiresAt,
+	)
 	if err != nil {
-		return false, fmt.Errorf("failed to delete reservation: %w", err)
+		return 0, fmt.Errorf("failed to extend reservation: %w", err)
 	}
-	_ = stmt.QueryRowContext(ctx, userId, serviceId, orderId, amount.Text('f', 2)).Scan(&Exist)
+	extended, err := result.RowsAffected()
 	if err != nil {
-		return false, fmt.Errorf("failed to delete reservation: %w", err)
+		return 0, fmt.Errorf("failed to extend reservation: %w", err)
 	}
-	return Exist, nil
+	return extended, nil
 }
 
-func (r *repository) DeleteReservationByServiceAndOrder(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float) error {
-	stmt, err := r.db.Prepare("DELETE FROM reserved_funds WHERE user_id = $1 AND service_id = $2 AND order_id = $3 AND amount = $4")
+func (r *repository) GetExpiredOrders(ctx context.Context, now time.Time, limit int) ([]models.Reservation, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT user_id, service_id, order_id
+		FROM reserved_funds
+		WHERE expires_at <= $1
+		GROUP BY user_id, service_id, order_id
+		ORDER BY MAX(release_failed_at) NULLS FIRST, MIN(expires_at), MIN(id)
+		LIMIT $2`,
+		now, limit,
+	)
 	if err != nil {
-		return fmt.Errorf("failed to delete reservation: %w", err)
+		return nil, fmt.Errorf("failed to get expired reservations: %w", err)
+	}
+	defer rows.Close()
+
+	var orders []models.Reservation
+	for rows.Next() {
+		var res models.Reservation
+		if err := rows.Scan(&res.UserID, &res.ServiceID, &res.OrderID); err != nil {
+			return nil, fmt.Errorf("failed to scan expired reservation: %w", err)
+		}
+		orders = append(orders, res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get expired reservations: %w", err)
 	}
-	_, err = stmt.ExecContext(ctx, userId, serviceId, orderId, amount.Text('f', 2))
+
+	return orders, nil
+}
+
+func (r *repository) MarkReleaseFailed(ctx context.Context, userId int, serviceId int, orderId int, at time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE reserved_funds
+		SET release_failed_at = $1
+		WHERE user_id = $2 AND service_id = $3 AND order_id = $4`,
+		at, userId, serviceId, orderId,
+	)
 	if err != nil {
-		return fmt.Errorf("failed to delete reservation: %w", err)
+		return fmt.Errorf("failed to mark reservations: %w", err)
 	}
 	return nil
 }
 
-func (r *repository) AddRevenueRecord(ctx context.Context, userId int, serviceId int, orderId int, amount *big.Float) error {
-	stmt, err := r.db.Prepare("INSERT INTO revenue_report (user_id,service_id,order_id,revenue) VALUES ($1,$2,$3,$4)")
+func (r *repository) ListReservations(ctx context.Context, filter models.ReservationFilter) ([]models.Reservation, int, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.UserID != 0 {
+		where("user_id = $%d", filter.UserID)
+	}
+	if filter.ServiceID != 0 {
+		where("service_id = $%d", filter.ServiceID)
+	}
+	if filter.CreatedFrom != nil {
+		where("created_at >= $%d", *filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		where("created_at < $%d", *filter.CreatedTo)
+	}
+	if filter.ExpiresFrom != nil {
+		where("expires_at >= $%d", *filter.ExpiresFrom)
+	}
+	if filter.ExpiresTo != nil {
+		where("expires_at < $%d", *filter.ExpiresTo)
+	}
+	whereClause := ""
+	if len(conditions) > 0 {
+		whereClause = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM reserved_funds "+whereClause, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count reservations: %w", err)
+	}
+
+	offset := (filter.Page - 1) * filter.Limit
+	rows, err := r.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id, user_id, service_id, order_id, amount, expires_at, created_at
+		FROM reserved_funds
+		%s
+		ORDER BY %s %s NULLS LAST, id
+		LIMIT $%d OFFSET $%d`,
+		whereClause, filter.SortBy, filter.SortOrder, len(args)+1, len(args)+2),
+		append(args, filter.Limit, offset)...,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list reservations: %w", err)
+	}
+	defer rows.Close()
+
+	var reservations []models.Reservation
+	for rows.Next() {
+		var res models.Reservation
+		if err := rows.Scan(&res.ID, &res.UserID, &res.ServiceID, &res.OrderID, &res.Amount, &res.ExpiresAt, &res.CreatedAt); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan reservation: %w", err)
+		}
+		reservations = append(reservations, res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("failed to list reservations: %w", err)
+	}
+
+	return reservations, total, nil
+}
+
+func (r *repository) CreateCapture(ctx context.Context, capture models.Capture) (int, error) {
+	var captureID int
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO reservation_captures (user_id,service_id,order_id,amount,transaction_id)
+		VALUES ($1,$2,$3,$4,$5)
+		RETURNING id`,
+		capture.UserID, capture.ServiceID, capture.OrderID, capture.Amount, capture.TransactionID,
+	).Scan(&captureID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create capture: %w", err)
+	}
+	return captureID, nil
+}
+
+func (r *repository) GetCaptures(ctx context.Context, serviceId int, orderId int) ([]models.Capture, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, user_id, service_id, order_id, amount, transaction_id, created_at
+		FROM reservation_captures
+		WHERE service_id = $1 AND order_id = $2
+		ORDER BY id`,
+		serviceId, orderId,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get captures: %w", err)
+	}
+	defer rows.Close()
+
+	var captures []models.Capture
+	for rows.Next() {
+		var c models.Capture
+		if err := rows.Scan(&c.ID, &c.UserID, &c.ServiceID, &c.OrderID, &c.Amount, &c.TransactionID, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan capture: %w", err)
+		}
+		captures = append(captures, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get captures: %w", err)
+	}
+
+	return captures, nil
+}
+
+func (r *repository) ReleaseReservations(ctx context.Context, userId int, serviceId int, orderId int) (models.Money, models.Money, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		DELETE FROM reserved_funds
+		WHERE user_id = $1 AND service_id = $2 AND order_id = $3
+		RETURNING amount, bonus_amount`,
+		userId, serviceId, orderId,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to release reservation: %w", err)
+	}
+	defer rows.Close()
+
+	var released, releasedBonus models.Money
+	found := false
+	for rows.Next() {
+		var amount, bonus models.Money
+		if err := rows.Scan(&amount, &bonus); err != nil {
+			return 0, 0, fmt.Errorf("failed to scan released amount: %w", err)
+		}
+		released += amount
+		releasedBonus += bonus
+		found = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, fmt.Errorf("failed to release reservation: %w", err)
+	}
+	if !found {
+		return 0, 0, ErrNoRows
+	}
+
+	return released, releasedBonus, nil
+}
+
+func (r *repository) AddRevenueRecord(ctx context.Context, userId int, serviceId int, orderId int, amount models.Money) error {
+	stmt, err := r.db.Prepare(`INSERT INTO revenue_report (user_id,service_id,order_id,revenue,service_name)
+	VALUES ($1,$2,$3,$4,(SELECT name FROM services WHERE id = $2))`)
 	if err != nil {
 		return fmt.Errorf("failed to add revenue record: %w", err)
 	}
-	_, err = stmt.ExecContext(ctx, userId, serviceId, orderId, amount.Text('f', 2))
+	defer stmt.Close()
+	_, err = stmt.ExecContext(ctx, userId, serviceId, orderId, amount)
 	if err != nil {
 		return fmt.Errorf("failed to add revenue record: %w", err)
 	}
@@ -222,22 +716,29 @@ func (r *repository) AddRevenueRecord(ctx context.Context, userId int, serviceId
 
 }
 
-func (r *repository) Transfer(ctx context.Context, fromUserId int, toUserId int, amount *big.Float) error {
-	tx, err := r.db.BeginTx(ctx, nil)
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
-	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = balance + $1 WHERE id = $2", amount.Text('f', 2), toUserId)
+func (r *repository) Transfer(ctx context.Context, fromUserId int, toUserId int, amount models.Money) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE users SET balance = balance + $1 WHERE id = $2", amount, toUserId)
 	if err != nil {
 		return fmt.Errorf("failed to update toUserId balance: %w", err)
 	}
-	_, err = tx.ExecContext(ctx, "UPDATE users SET balance = balance - $1 WHERE id = $2", amount.Text('f', 2), fromUserId)
+	if err := requireAffected(result); err != nil {
+		return err
+	}
+	result, err = r.db.ExecContext(ctx, "UPDATE users SET balance = balance - $1 WHERE id = $2", amount, fromUserId)
 	if err != nil {
 		return fmt.Errorf("failed to update fromUserId balance: %w", err)
 	}
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+	return requireAffected(result)
+}
+
+// requireAffected returns ErrNoRows when an UPDATE matched nothing.
+func requireAffected(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if affected == 0 {
+		return ErrNoRows
 	}
 	return nil
 }
@@ -247,10 +748,15 @@ func (r *repository) GetMonthlyReportData(ctx context.Context, year, month int)
 	endOfMonth := startOfMonth.AddDate(0, 1, 0)
 
 	stmt, err := r.db.PrepareContext(ctx, `
-		SELECT service_id, SUM(revenue) AS total_revenue
-		FROM revenue_report
-		WHERE created_at >= $1 AND created_at < $2
-		GROUP BY service_id
+		SELECT r.service_id,
+			COALESCE((array_agg(r.service_name ORDER BY r.created_at DESC) FILTER (WHERE r.service_name IS NOT NULL))[1], s.name, '') AS service_name,
+			COALESCE(SUM(r.revenue) FILTER (WHERE r.source = 'service'), 0) AS total_revenue,
+			COALESCE(SUM(r.revenue) FILTER (WHERE r.source = 'fee'), 0) AS fee_income
+		FROM revenue_report r
+		LEFT JOIN services s ON s.id = r.service_id
+		WHERE r.created_at >= $1 AND r.created_at < $2
+		GROUP BY r.service_id, s.name
+		ORDER BY r.service_id
 	`)
 	if err != nil {
 		return []models.MonthlyReportData{}, fmt.Errorf("database prepare error: %w", err)
@@ -266,7 +772,7 @@ func (r *repository) GetMonthlyReportData(ctx context.Context, year, month int)
 	var reportData []models.MonthlyReportData
 	for rows.Next() {
 		var data models.MonthlyReportData
-		err := rows.Scan(&data.ServiceId, &data.TotalRevenue)
+		err := rows.Scan(&data.ServiceId, &data.ServiceName, &data.TotalRevenue, &data.FeeIncome)
 		if err != nil {
 			return []models.MonthlyReportData{}, fmt.Errorf("database scan error: %w", err)
 		}
@@ -289,7 +795,7 @@ func (r *repository) GetTransactions(ctx context.Context, userId int, page int,
 	}
 
 	rows, err := r.db.QueryContext(ctx, `
-	SELECT id,user_id,service_id,order_id,amount,type,description,created_at
+	SELECT id,user_id,service_id,order_id,amount,bonus_amount,type,description,COALESCE(related_transaction_id, 0),COALESCE(counterparty_user_id, 0),COALESCE(external_payment_id, ''),created_at
 	FROM transactions
 	WHERE user_id = $1
 	ORDER BY `+sortBy+` `+sortOrder+`
@@ -303,12 +809,10 @@ func (r *repository) GetTransactions(ctx context.Context, userId int, page int,
 	var Transactions []models.Transaction
 	for rows.Next() {
 		var t models.Transaction
-		var amountStr string
-		err := rows.Scan(&t.ID, &t.UserID, &t.ServiceID, &t.OrderID, &amountStr, &t.Type, &t.Description, &t.CreatedAt)
+		err := rows.Scan(&t.ID, &t.UserID, &t.ServiceID, &t.OrderID, &t.Amount, &t.BonusAmount, &t.Type, &t.Description, &t.RelatedTransactionID, &t.CounterpartyUserID, &t.ExternalPaymentID, &t.CreatedAt)
 		if err != nil {
 			return nil, 0, fmt.Errorf("failed to scan transaction: %w", err)
 		}
-		t.Amount, _ = new(big.Float).SetString(amountStr)
 		Transactions = append(Transactions, t)
 	}
 
@@ -319,3 +823,294 @@ func (r *repository) GetTransactions(ctx context.Context, userId int, page int,
 	return Transactions, total, nil
 
 }
+
+func (r *repository) CreateJournalEntry(ctx context.Context, entry models.JournalEntry) (int, error) {
+	var total models.Money
+	for _, posting := range entry.Postings {
+		total += posting.Amount
+	}
+	if len(entry.Postings) < 2 || total != 0 {
+		return 0, ErrUnbalancedEntry
+	}
+
+	var transactionID interface{}
+	if entry.TransactionID != 0 {
+		transactionID = entry.TransactionID
+	}
+
+	var entryID int
+	err := r.db.QueryRowContext(ctx,
+		"INSERT INTO journal_entries (transaction_id,description) VALUES ($1,$2) RETURNING id",
+		transactionID, entry.Description,
+	).Scan(&entryID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	stmt, err := r.db.PrepareContext(ctx, "INSERT INTO postings (entry_id,account,user_id,amount) VALUES ($1,$2,$3,$4)")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create posting: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, posting := range entry.Postings {
+		_, err = stmt.ExecContext(ctx, entryID, posting.Account.Type, posting.Account.UserID, posting.Amount)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create posting: %w", err)
+		}
+	}
+
+	return entryID, nil
+}
+
+func (r *repository) GetLedgerAccountTotals(ctx context.Context) (map[models.AccountType]models.Money, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT account, SUM(amount) FROM postings GROUP BY account")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account totals: %w", err)
+	}
+	defer rows.Close()
+
+	totals := make(map[models.AccountType]models.Money)
+	for rows.Next() {
+		var account models.AccountType
+		var total models.Money
+		if err := rows.Scan(&account, &total); err != nil {
+			return nil, fmt.Errorf("failed to scan account total: %w", err)
+		}
+		totals[account] = total
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get account totals: %w", err)
+	}
+
+	return totals, nil
+}
+
+func (r *repository) GetUnbalancedJournalEntries(ctx context.Context) ([]int, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT e.id
+		FROM journal_entries e
+		LEFT JOIN postings p ON p.entry_id = e.id
+		GROUP BY e.id
+		HAVING COALESCE(SUM(p.amount), 0) <> 0 OR COUNT(p.id) < 2
+		ORDER BY e.id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get unbalanced journal entries: %w", err)
+	}
+	defer rows.Close()
+
+	var entryIDs []int
+	for rows.Next() {
+		var entryID int
+		if err := rows.Scan(&entryID); err != nil {
+			return nil, fmt.Errorf("failed to scan journal entry: %w", err)
+		}
+		entryIDs = append(entryIDs, entryID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get unbalanced journal entries: %w", err)
+	}
+
+	return entryIDs, nil
+}
+
+func (r *repository) GetLedgerDiscrepancies(ctx context.Context) ([]models.LedgerDiscrepancy, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		WITH ledger AS (
+			SELECT user_id,
+				COALESCE(SUM(amount) FILTER (WHERE account = 'user_available'), 0) AS available,
+				COALESCE(SUM(amount) FILTER (WHERE account = 'user_reserved'), 0) AS reserved
+			FROM postings
+			WHERE account IN ('user_available', 'user_reserved')
+			GROUP BY user_id
+		), held AS (
+			SELECT user_id, SUM(amount) AS reserved
+			FROM reserved_funds
+			GROUP BY user_id
+		)
+		SELECT u.id, u.balance, COALESCE(l.available, 0), COALESCE(h.reserved, 0), COALESCE(l.reserved, 0)
+		FROM users u
+		LEFT JOIN ledger l ON l.user_id = u.id
+		LEFT JOIN held h ON h.user_id = u.id
+		WHERE u.balance <> COALESCE(l.available, 0) OR COALESCE(h.reserved, 0) <> COALESCE(l.reserved, 0)
+		ORDER BY u.id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ledger discrepancies: %w", err)
+	}
+	defer rows.Close()
+
+	var discrepancies []models.LedgerDiscrepancy
+	for rows.Next() {
+		var d models.LedgerDiscrepancy
+		if err := rows.Scan(&d.UserID, &d.Balance, &d.LedgerAvailable, &d.Reserved, &d.LedgerReserved); err != nil {
+			return nil, fmt.Errorf("failed to scan ledger discrepancy: %w", err)
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get ledger discrepancies: %w", err)
+	}
+
+	return discrepancies, nil
+}
+
+func (r *repository) CreateIdempotencyKey(ctx context.Context, key string, requestHash string) (bool, error) {
+	result, err := r.db.ExecContext(ctx,
+		"INSERT INTO idempotency_keys (key,request_hash) VALUES ($1,$2) ON CONFLICT (key) DO NOTHING",
+		key, requestHash,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to create idempotency key: %w", err)
+	}
+	created, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to create idempotency key: %w", err)
+	}
+	return created == 1, nil
+}
+
+func (r *repository) GetIdempotencyKey(ctx context.Context, key string) (models.IdempotencyRecord, error) {
+	record := models.IdempotencyRecord{Key: key}
+	err := r.db.QueryRowContext(ctx,
+		"SELECT request_hash, response FROM idempotency_keys WHERE key = $1",
+		key,
+	).Scan(&record.RequestHash, &record.Response)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.IdempotencyRecord{}, ErrNoRows
+		}
+		return models.IdempotencyRecord{}, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	return record, nil
+}
+
+func (r *repository) SaveIdempotencyResponse(ctx context.Context, key string, response []byte) error {
+	_, err := r.db.ExecContext(ctx, "UPDATE idempotency_keys SET response = $1 WHERE key = $2", response, key)
+	if err != nil {
+		return fmt.Errorf("failed to save idempotent response: %w", err)
+	}
+	return nil
+}
+
+func (r *repository) GetOrderRevenue(ctx context.Context, userId int, serviceId int, orderId int) (models.Money, error) {
+	var revenue models.Money
+	err := r.db.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(revenue), 0)
+		FROM revenue_report
+		WHERE user_id = $1 AND service_id = $2 AND order_id = $3 AND source = 'service'`,
+		userId, serviceId, orderId,
+	).Scan(&revenue)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get order revenue: %w", err)
+	}
+	return revenue, nil
+}
+
+func (r *repository) GetLastTransaction(ctx context.Context, userId int, serviceId int, orderId int, txType models.TransactionType) (models.Transaction, error) {
+	var t models.Transaction
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, user_id, service_id, order_id, amount, bonus_amount, type, description, COALESCE(related_transaction_id, 0), COALESCE(counterparty_user_id, 0), created_at
+		FROM transactions
+		WHERE user_id = $1 AND service_id = $2 AND order_id = $3 AND type = $4
+		ORDER BY id DESC
+		LIMIT 1`,
+		userId, serviceId, orderId, txType,
+	).Scan(&t.ID, &t.UserID, &t.ServiceID, &t.OrderID, &t.Amount, &t.BonusAmount, &t.Type, &t.Description, &t.RelatedTransactionID, &t.CounterpartyUserID, &t.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Transaction{}, ErrNoRows
+		}
+		return models.Transaction{}, fmt.Errorf("failed to get transaction: %w", err)
+	}
+	return t, nil
+}
+
+// GetDepositByExternalPaymentID returns the deposit that credited an external
+// payment.
+func (r *repository) GetDepositByExternalPaymentID(ctx context.Context, externalPaymentID string) (models.Transaction, error) {
+	var t models.Transaction
+	err := r.db.QueryRowContext(ctx, `
+		SELECT id, user_id, amount, type, description, external_payment_id, created_at
+		FROM transactions
+		WHERE external_payment_id = $1 AND type = 'deposit'`,
+		externalPaymentID,
+	).Scan(&t.ID, &t.UserID, &t.Amount, &t.Type, &t.Description, &t.ExternalPaymentID, &t.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Transaction{}, ErrNoRows
+		}
+		return models.Transaction{}, fmt.Errorf("failed to get deposit: %w", err)
+	}
+	return t, nil
+}
+
+func (r *repository) CreatePayout(ctx context.Context, payout models.Payout) (int, error) {
+	var payoutID int
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO payouts (user_id,amount,status,transaction_id)
+		VALUES ($1,$2,$3,$4)
+		RETURNING id`,
+		payout.UserID, payout.Amount, payout.Status, payout.TransactionID,
+	).Scan(&payoutID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create payout: %w", err)
+	}
+	return payoutID, nil
+}
+
+const payoutColumns = `id, user_id, amount, status, COALESCE(provider_reference, ''), COALESCE(failure_reason, ''), transaction_id, created_at, updated_at`
+
+func scanPayout(row *sql.Row) (models.Payout, error) {
+	var p models.Payout
+	err := row.Scan(&p.ID, &p.UserID, &p.Amount, &p.Status, &p.ProviderReference, &p.FailureReason, &p.TransactionID, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Payout{}, ErrNoRows
+		}
+		return models.Payout{}, fmt.Errorf("failed to get payout: %w", err)
+	}
+	return p, nil
+}
+
+func (r *repository) GetPayout(ctx context.Context, payoutID int) (models.Payout, error) {
+	return scanPayout(r.db.QueryRowContext(ctx, "SELECT "+payoutColumns+" FROM payouts WHERE id = $1", payoutID))
+}
+
+func (r *repository) GetPayoutForUpdate(ctx context.Context, payoutID int) (models.Payout, error) {
+	return scanPayout(r.db.QueryRowContext(ctx, "SELECT "+payoutColumns+" FROM payouts WHERE id = $1 FOR UPDATE", payoutID))
+}
+
+func (r *repository) GetPayoutIDsByStatus(ctx context.Context, status models.PayoutStatus, limit int) ([]int, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT id FROM payouts WHERE status = $1 ORDER BY id LIMIT $2", status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get payouts: %w", err)
+	}
+	defer rows.Close()
+
+	var payoutIDs []int
+	for rows.Next() {
+		var payoutID int
+		if err := rows.Scan(&payoutID); err != nil {
+			return nil, fmt.Errorf("failed to scan payout: %w", err)
+		}
+		payoutIDs = append(payoutIDs, payoutID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get payouts: %w", err)
+	}
+
+	return payoutIDs, nil
+}
+
+func (r *repository) UpdatePayout(ctx context.Context, payout models.Payout) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE payouts
+		SET status = $1, provider_reference = NULLIF($2, ''), failure_reason = NULLIF($3, ''), updated_at = now()
+		WHERE id = $4`,
+		payout.Status, payout.ProviderReference, payout.FailureReason, payout.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update payout: %w", err)
+	}
+	return nil
+}
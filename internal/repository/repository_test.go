@@ -3,11 +3,16 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"internship_backend_2022/internal/models"
+	"reflect"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 )
 
 func TestRepository_DeleteReservation(t *testing.T) {
@@ -159,3 +164,926 @@ func TestRepositoryGetUserBalance(t *testing.T) {
 	}
 
 }
+
+func TestRepository_WithTx(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+
+	tests := []struct {
+		name    string
+		mock    func()
+		fn      func(repo Repository) error
+		wantErr bool
+	}{
+		{
+			name: "Commit on success",
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectQuery(regexp.QuoteMeta("FROM users WHERE id = $1 FOR UPDATE")).
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "bonus_balance", "debt", "status", "status_reason", "status_changed_at"}).
+						AddRow(1, "100.00", "0.00", "0.00", "active", "", nil))
+				mock.ExpectCommit()
+			},
+			fn: func(repo Repository) error {
+				_, err := repo.GetUserForUpdate(context.Background(), 1)
+				return err
+			},
+			wantErr: false,
+		},
+		{
+			name: "Rollback on error",
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			fn: func(repo Repository) error {
+				return errors.New("insufficient funds")
+			},
+			wantErr: true,
+		},
+		{
+			name: "Nested call reuses transaction",
+			mock: func() {
+				mock.ExpectBegin()
+				mock.ExpectCommit()
+			},
+			fn: func(repo Repository) error {
+				return repo.WithTx(context.Background(), func(repo Repository) error {
+					return nil
+				})
+			},
+			wantErr: false,
+		},
+		{
+			name: "Begin error",
+			mock: func() {
+				mock.ExpectBegin().WillReturnError(fmt.Errorf("begin error"))
+			},
+			fn: func(repo Repository) error {
+				return nil
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			err := repo.WithTx(context.Background(), tt.fn)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Repository.WithTx() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRepository_ReleaseReservations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+
+	query := regexp.QuoteMeta("DELETE FROM reserved_funds")
+
+	tests := []struct {
+		name      string
+		mock      func()
+		want      string
+		wantBonus string
+		wantErr   error
+		anyError  bool
+	}{
+		{
+			name: "Releases every hold of the order",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(1, 2, 3).
+					WillReturnRows(sqlmock.NewRows([]string{"amount", "bonus_amount"}).AddRow("10.50", "2.00").AddRow("4.50", "0.00"))
+			},
+			want:      "15.00",
+			wantBonus: "2.00",
+		},
+		{
+			name: "Nothing reserved",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(1, 2, 3).
+					WillReturnRows(sqlmock.NewRows([]string{"amount", "bonus_amount"}))
+			},
+			wantErr: ErrNoRows,
+		},
+		{
+			name: "Query error",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(1, 2, 3).
+					WillReturnError(fmt.Errorf("query error"))
+			},
+			anyError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			got, gotBonus, err := repo.ReleaseReservations(context.Background(), 1, 2, 3)
+			switch {
+			case tt.anyError:
+				if err == nil {
+					t.Errorf("Repository.ReleaseReservations() expected error")
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Repository.ReleaseReservations() error = %v, want %v", err, tt.wantErr)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("Repository.ReleaseReservations() unexpected error = %v", err)
+				}
+				if got.String() != tt.want || gotBonus.String() != tt.wantBonus {
+					t.Errorf("Repository.ReleaseReservations() = %s, %s, want %s, %s", got, gotBonus, tt.want, tt.wantBonus)
+				}
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRepository_CreateJournalEntry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+
+	tests := []struct {
+		name    string
+		mock    func()
+		entry   models.JournalEntry
+		wantErr bool
+	}{
+		{
+			name: "Balanced entry",
+			mock: func() {
+				mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO journal_entries")).
+					WithArgs(7, "deposit").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				prep := mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO postings"))
+				prep.ExpectExec().
+					WithArgs(1, models.AccountExternalFunding, 0, "-10.00").
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				prep.ExpectExec().
+					WithArgs(1, models.AccountUserAvailable, 42, "10.00").
+					WillReturnResult(sqlmock.NewResult(2, 1))
+			},
+			entry:   models.NewJournalEntry(7, "deposit", models.ExternalFunding, models.UserAvailable(42), models.Money(1000)),
+			wantErr: false,
+		},
+		{
+			name: "Unbalanced entry",
+			mock: func() {},
+			entry: models.JournalEntry{
+				Description: "broken",
+				Postings: []models.Posting{
+					{Account: models.ExternalFunding, Amount: -1000},
+					{Account: models.UserAvailable(42), Amount: 1100},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			_, err := repo.CreateJournalEntry(context.Background(), tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Repository.CreateJournalEntry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRepository_Transfer(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+
+	query := regexp.QuoteMeta("UPDATE users SET balance")
+
+	tests := []struct {
+		name    string
+		mock    func()
+		wantErr error
+	}{
+		{
+			name: "Moves funds between existing users",
+			mock: func() {
+				mock.ExpectExec(query).WithArgs("5.00", 2).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(query).WithArgs("5.00", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name: "Recipient does not exist",
+			mock: func() {
+				mock.ExpectExec(query).WithArgs("5.00", 2).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			wantErr: ErrNoRows,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			err := repo.Transfer(context.Background(), 1, 2, 500)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Repository.Transfer() error = %v, want %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRepository_CreateJournalEntries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+
+	deposit := models.NewJournalEntry(1, "deposit", models.ExternalFunding, models.UserAvailable(7), 500)
+	transfer := models.NewJournalEntry(2, "transfer", models.UserAvailable(7), models.UserAvailable(8), 200)
+	unbalanced := models.NewJournalEntry(3, "broken", models.ExternalFunding, models.UserAvailable(7), 100)
+	unbalanced.Postings[1].Amount = 99
+
+	tests := []struct {
+		name     string
+		entries  []models.JournalEntry
+		mock     func()
+		wantErr  error
+		anyError bool
+	}{
+		{
+			name:    "Writes all entries in one statement",
+			entries: []models.JournalEntry{deposit, transfer},
+			mock: func() {
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO postings")).
+					WithArgs("{1,2}", `{"deposit","transfer"}`, "{1,1,2,2}", sqlmock.AnyArg(), "{0,7,7,8}", `{"-5.00","5.00","-2.00","2.00"}`).
+					WillReturnResult(sqlmock.NewResult(0, 4))
+			},
+		},
+		{
+			name:    "Unbalanced entry",
+			entries: []models.JournalEntry{deposit, unbalanced},
+			mock:    func() {},
+			wantErr: ErrUnbalancedEntry,
+		},
+		{
+			name:     "Duplicate transaction id",
+			entries:  []models.JournalEntry{deposit, deposit},
+			mock:     func() {},
+			anyError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			err := repo.CreateJournalEntries(context.Background(), tt.entries)
+			switch {
+			case tt.anyError:
+				if err == nil {
+					t.Errorf("Repository.CreateJournalEntries() expected error")
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("Repository.CreateJournalEntries() error = %v, want %v", err, tt.wantErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRepository_CreateOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+
+	order := models.Order{
+		ID:     42,
+		UserID: 1,
+		Items: []models.OrderItem{
+			{ServiceID: 1, Amount: 1000, TransactionID: 10},
+			{ServiceID: 2, Amount: 250, TransactionID: 11},
+		},
+	}
+
+	tests := []struct {
+		name string
+		mock func()
+		want bool
+	}{
+		{
+			name: "Creates order with items",
+			mock: func() {
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO orders")).
+					WithArgs(1, 42).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO order_items")).
+					WithArgs(42, 1, "{1,2}", `{"10.00","2.50"}`, "{10,11}").
+					WillReturnResult(sqlmock.NewResult(0, 2))
+			},
+			want: true,
+		},
+		{
+			name: "User already has the order",
+			mock: func() {
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO orders")).
+					WithArgs(1, 42).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			want: false,
+		},
+		{
+			name: "Line already reserved",
+			mock: func() {
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO orders")).
+					WithArgs(1, 42).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO order_items")).
+					WithArgs(42, 1, "{1,2}", `{"10.00","2.50"}`, "{10,11}").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			got, err := repo.CreateOrder(context.Background(), order)
+			if err != nil {
+				t.Fatalf("Repository.CreateOrder() unexpected error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Repository.CreateOrder() = %v, want %v", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRepository_AddOrderItem(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+	query := regexp.QuoteMeta("INSERT INTO order_items")
+
+	// User 1 holds order 5 on service 1.
+	tests := []struct {
+		name   string
+		userID int
+		item   models.OrderItem
+		mock   func()
+		want   bool
+	}{
+		{
+			name:   "Another user shares the order id on another service",
+			userID: 2,
+			item:   models.OrderItem{ServiceID: 2, Amount: 500, TransactionID: 11},
+			mock: func() {
+				mock.ExpectExec(query).
+					WithArgs(2, 5, 2, models.Money(500), 11).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: true,
+		},
+		{
+			name:   "Same user adds a service to the order",
+			userID: 1,
+			item:   models.OrderItem{ServiceID: 3, Amount: 500, TransactionID: 12},
+			mock: func() {
+				mock.ExpectExec(query).
+					WithArgs(1, 5, 3, models.Money(500), 12).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			want: true,
+		},
+		{
+			name:   "Line already reserved",
+			userID: 2,
+			item:   models.OrderItem{ServiceID: 1, Amount: 500, TransactionID: 13},
+			mock: func() {
+				mock.ExpectExec(query).
+					WithArgs(2, 5, 1, models.Money(500), 13).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			got, err := repo.AddOrderItem(context.Background(), tt.userID, 5, tt.item)
+			if err != nil {
+				t.Fatalf("Repository.AddOrderItem() unexpected error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Repository.AddOrderItem() = %v, want %v", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRepository_ListReservations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+
+	createdFrom := time.Date(2022, 11, 1, 0, 0, 0, 0, time.UTC)
+	created := time.Date(2022, 11, 2, 10, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM reserved_funds WHERE user_id = $1 AND created_at >= $2")).
+		WithArgs(1, createdFrom).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("ORDER BY amount desc NULLS LAST, id\n\t\tLIMIT $3 OFFSET $4")).
+		WithArgs(1, createdFrom, 2, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "service_id", "order_id", "amount", "expires_at", "created_at"}).
+			AddRow(7, 1, 2, 3, "10.00", nil, created))
+
+	got, total, err := repo.ListReservations(context.Background(), models.ReservationFilter{
+		UserID:      1,
+		CreatedFrom: &createdFrom,
+		Page:        2,
+		Limit:       2,
+		SortBy:      "amount",
+		SortOrder:   "desc",
+	})
+	if err != nil {
+		t.Fatalf("Repository.ListReservations() unexpected error = %v", err)
+	}
+	if total != 3 || len(got) != 1 || got[0].OrderID != 3 || got[0].ExpiresAt != nil {
+		t.Errorf("Repository.ListReservations() = %+v, %d", got, total)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRepository_GetUserBalanceAt(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+
+	at := time.Date(2023, 3, 3, 14, 0, 0, 0, time.UTC)
+	created := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	query := regexp.QuoteMeta("LEFT JOIN transactions t ON t.user_id = u.id AND t.created_at <= $2")
+
+	tests := []struct {
+		name         string
+		mock         func()
+		wantBalance  string
+		wantBonus    string
+		wantReserved string
+		wantErr      error
+	}{
+		{
+			name: "Reconstructs balances",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(1, at).
+					WillReturnRows(sqlmock.NewRows([]string{"created_at", "available", "bonus", "reserved"}).AddRow(created, "90.00", "3.00", "6.00"))
+			},
+			wantBalance:  "90.00",
+			wantBonus:    "3.00",
+			wantReserved: "6.00",
+		},
+		{
+			name: "User not found",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(1, at).
+					WillReturnRows(sqlmock.NewRows([]string{"created_at", "available", "bonus", "reserved"}))
+			},
+			wantErr: ErrNoRows,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			balance, bonus, reserved, _, err := repo.GetUserBalanceAt(context.Background(), 1, at)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Repository.GetUserBalanceAt() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (balance.String() != tt.wantBalance || bonus.String() != tt.wantBonus || reserved.String() != tt.wantReserved) {
+				t.Errorf("Repository.GetUserBalanceAt() = %s, %s, %s, want %s, %s, %s", balance, bonus, reserved, tt.wantBalance, tt.wantBonus, tt.wantReserved)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestRepository_GetLimits(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM limits WHERE user_id = 0 OR user_id = ANY($1) ORDER BY user_id")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "operation", "window_seconds", "max_amount", "max_count"}).
+			AddRow(0, "deposit", 86400, "1000.00", nil).
+			AddRow(1, "deposit", 86400, nil, 5))
+
+	got, err := repo.GetLimits(context.Background(), []int{1})
+	if err != nil {
+		t.Fatalf("Repository.GetLimits() unexpected error = %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("Repository.GetLimits() = %+v", got)
+	}
+	if got[0].MaxAmount == nil || got[0].MaxAmount.String() != "1000.00" || got[0].MaxCount != nil {
+		t.Errorf("Repository.GetLimits() global = %+v", got[0])
+	}
+	if got[1].MaxAmount != nil || got[1].MaxCount == nil || *got[1].MaxCount != 5 {
+		t.Errorf("Repository.GetLimits() override = %+v", got[1])
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRepository_GetFeeRule(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+	query := regexp.QuoteMeta("WHERE operation = $1 AND service_id IN (0, $2)")
+	columns := []string{"operation", "service_id", "rate_bps", "min_fee", "max_fee"}
+
+	tests := []struct {
+		name    string
+		mock    func()
+		want    models.FeeRule
+		wantErr error
+	}{
+		{
+			name: "Service rule",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(models.FeeConfirm, 7).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow("confirm", 7, 250, "1.00", nil))
+			},
+			want: models.FeeRule{Operation: models.FeeConfirm, ServiceID: 7, RateBps: 250, MinFee: 100},
+		},
+		{
+			name: "No rule",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(models.FeeConfirm, 7).
+					WillReturnRows(sqlmock.NewRows(columns))
+			},
+			wantErr: ErrNoRows,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			got, err := repo.GetFeeRule(context.Background(), models.FeeConfirm, 7)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Repository.GetFeeRule() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Repository.GetFeeRule() unexpected error = %v", err)
+			}
+			if got.Operation != tt.want.Operation || got.ServiceID != tt.want.ServiceID || got.RateBps != tt.want.RateBps || got.MinFee != tt.want.MinFee || got.MaxFee != nil {
+				t.Errorf("Repository.GetFeeRule() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRepository_CreateTransaction_DuplicateExternalPayment(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+	mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO transactions")).
+		ExpectQuery().
+		WithArgs(1, 0, 0, models.Money(1000), models.Money(0), models.Deposit, "deposit", 0, 0, "pay_1").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: externalPaymentIndex})
+
+	_, err = repo.CreateTransaction(context.Background(), models.Transaction{
+		UserID:            1,
+		Amount:            1000,
+		Type:              models.Deposit,
+		Description:       "deposit",
+		ExternalPaymentID: "pay_1",
+	})
+	if !errors.Is(err, ErrDuplicateExternalPayment) {
+		t.Errorf("Repository.CreateTransaction() error = %v, want %v", err, ErrDuplicateExternalPayment)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRepository_GetDepositReversal(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+	query := regexp.QuoteMeta("WHERE related_transaction_id = $1 AND type = 'deposit_reversal'")
+
+	tests := []struct {
+		name    string
+		mock    func()
+		want    int
+		wantErr error
+	}{
+		{
+			name: "Reversed deposit",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(5).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+			},
+			want: 9,
+		},
+		{
+			name: "Deposit not reversed",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(5).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+			wantErr: ErrNoRows,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			got, err := repo.GetDepositReversal(context.Background(), 5)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("Repository.GetDepositReversal() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Repository.GetDepositReversal() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRepository_GetMonthlyReportData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+	start := time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectPrepare(regexp.QuoteMeta("LEFT JOIN services s ON s.id = r.service_id")).
+		ExpectQuery().
+		WithArgs(start, start.AddDate(0, 1, 0)).
+		WillReturnRows(sqlmock.NewRows([]string{"service_id", "service_name", "total_revenue", "fee_income"}).
+			AddRow("0", "", "0.00", "1.50").
+			AddRow("7", "Premium listing", "120.00", "3.00"))
+
+	got, err := repo.GetMonthlyReportData(context.Background(), 2022, 3)
+	if err != nil {
+		t.Fatalf("Repository.GetMonthlyReportData() unexpected error = %v", err)
+	}
+	want := []models.MonthlyReportData{
+		{ServiceId: "0", FeeIncome: 150},
+		{ServiceId: "7", ServiceName: "Premium listing", TotalRevenue: 12000, FeeIncome: 300},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Repository.GetMonthlyReportData() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Repository.GetMonthlyReportData()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRepository_GetReportJob(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+	query := regexp.QuoteMeta("FROM report_jobs WHERE id = $1")
+	columns := []string{"id", "year", "month", "status", "file_key", "error", "created_at", "completed_at", "expires_at"}
+	createdAt := time.Date(2022, 11, 1, 10, 0, 0, 0, time.UTC)
+	completedAt := createdAt.Add(time.Minute)
+	expiresAt := completedAt.Add(24 * time.Hour)
+
+	tests := []struct {
+		name    string
+		mock    func()
+		want    models.ReportJob
+		wantErr error
+	}{
+		{
+			name: "Completed report",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(3, 2022, 10, "completed", "report-3.csv", "", createdAt, completedAt, expiresAt))
+			},
+			want: models.ReportJob{
+				ID:          3,
+				Year:        2022,
+				Month:       10,
+				Status:      models.ReportCompleted,
+				FileKey:     "report-3.csv",
+				CreatedAt:   createdAt,
+				CompletedAt: &completedAt,
+				ExpiresAt:   &expiresAt,
+			},
+		},
+		{
+			name: "Pending report",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows(columns).
+						AddRow(3, 2022, 10, "pending", "", "", createdAt, nil, nil))
+			},
+			want: models.ReportJob{
+				ID:        3,
+				Year:      2022,
+				Month:     10,
+				Status:    models.ReportPending,
+				CreatedAt: createdAt,
+			},
+		},
+		{
+			name: "Report not found",
+			mock: func() {
+				mock.ExpectQuery(query).
+					WithArgs(3).
+					WillReturnRows(sqlmock.NewRows(columns))
+			},
+			wantErr: ErrNoRows,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.mock()
+			got, err := repo.GetReportJob(context.Background(), 3)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("Repository.GetReportJob() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Repository.GetReportJob() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRepository_GetOrderTransactions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+	createdAt := time.Date(2022, 11, 1, 10, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM transactions")).
+		WithArgs(1, 2, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "service_id", "order_id", "amount", "bonus_amount", "type", "description", "related_transaction_id", "counterparty_user_id", "created_at"}).
+			AddRow(7, 1, 2, 3, "-10.00", "-4.00", "reserve", "reserve", 0, 0, createdAt))
+
+	got, err := repo.GetOrderTransactions(context.Background(), 1, 2, 3)
+	if err != nil {
+		t.Fatalf("Repository.GetOrderTransactions() unexpected error = %v", err)
+	}
+	want := []models.Transaction{{
+		ID:          7,
+		UserID:      1,
+		ServiceID:   2,
+		OrderID:     3,
+		Amount:      -1000,
+		BonusAmount: -400,
+		Type:        models.Reserve,
+		Description: "reserve",
+		CreatedAt:   createdAt,
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Repository.GetOrderTransactions() = %+v, want %+v", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRepository_GetExpiredOrders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	repo := NewRepository(db)
+	now := time.Date(2022, 11, 1, 10, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(regexp.QuoteMeta("ORDER BY MAX(release_failed_at) NULLS FIRST, MIN(expires_at), MIN(id)")).
+		WithArgs(now, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "service_id", "order_id"}).
+			AddRow(1, 1, 5).
+			AddRow(2, 1, 6))
+
+	got, err := repo.GetExpiredOrders(context.Background(), now, 2)
+	if err != nil {
+		t.Fatalf("Repository.GetExpiredOrders() unexpected error = %v", err)
+	}
+	want := []models.Reservation{
+		{UserID: 1, ServiceID: 1, OrderID: 5},
+		{UserID: 2, ServiceID: 1, OrderID: 6},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Repository.GetExpiredOrders() = %+v, want %+v", got, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,120 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+
+	"github.com/lib/pq"
+)
+
+const serviceColumns = "id, name, category, active, created_at, updated_at"
+
+func scanService(scan func(dest ...interface{}) error) (models.Service, error) {
+	var s models.Service
+	err := scan(&s.ID, &s.Name, &s.Category, &s.Active, &s.CreatedAt, &s.UpdatedAt)
+	return s, err
+}
+
+func (r *repository) GetServices(ctx context.Context) ([]models.Service, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+serviceColumns+" FROM services ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get services: %w", err)
+	}
+	defer rows.Close()
+
+	var services []models.Service
+	for rows.Next() {
+		service, err := scanService(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan service: %w", err)
+		}
+		services = append(services, service)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get services: %w", err)
+	}
+	return services, nil
+}
+
+func (r *repository) GetService(ctx context.Context, serviceID int) (models.Service, error) {
+	row := r.db.QueryRowContext(ctx, "SELECT "+serviceColumns+" FROM services WHERE id = $1", serviceID)
+	service, err := scanService(row.Scan)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Service{}, ErrNoRows
+		}
+		return models.Service{}, fmt.Errorf("failed to get service: %w", err)
+	}
+	return service, nil
+}
+
+// GetServicesByID returns the catalog entries of serviceIDs; unknown ids are
+// missing from the result.
+func (r *repository) GetServicesByID(ctx context.Context, serviceIDs []int) (map[int]models.Service, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT "+serviceColumns+" FROM services WHERE id = ANY($1)", pq.Array(serviceIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get services: %w", err)
+	}
+	defer rows.Close()
+
+	services := make(map[int]models.Service, len(serviceIDs))
+	for rows.Next() {
+		service, err := scanService(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan service: %w", err)
+		}
+		services[service.ID] = service
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get services: %w", err)
+	}
+	return services, nil
+}
+
+// CreateService inserts the service and reports false when the id is taken.
+func (r *repository) CreateService(ctx context.Context, service models.Service) (models.Service, bool, error) {
+	row := r.db.QueryRowContext(ctx, `
+		INSERT INTO services (id, name, category, active)
+		VALUES ($1,$2,$3,$4)
+		ON CONFLICT (id) DO NOTHING
+		RETURNING `+serviceColumns,
+		service.ID, service.Name, service.Category, service.Active,
+	)
+	created, err := scanService(row.Scan)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Service{}, false, nil
+		}
+		return models.Service{}, false, fmt.Errorf("failed to create service: %w", err)
+	}
+	return created, true, nil
+}
+
+func (r *repository) UpdateService(ctx context.Context, service models.Service) (models.Service, error) {
+	row := r.db.QueryRowContext(ctx, `
+		UPDATE services
+		SET name = $2, category = $3, active = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING `+serviceColumns,
+		service.ID, service.Name, service.Category, service.Active,
+	)
+	updated, err := scanService(row.Scan)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.Service{}, ErrNoRows
+		}
+		return models.Service{}, fmt.Errorf("failed to update service: %w", err)
+	}
+	return updated, nil
+}
+
+func (r *repository) DeleteService(ctx context.Context, serviceID int) error {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM services WHERE id = $1", serviceID)
+	if err != nil {
+		return fmt.Errorf("failed to delete service: %w", err)
+	}
+	return requireAffected(result)
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"time"
+)
+
+var (
+	ErrAccountFrozen           = errors.New("account is frozen")
+	ErrAccountClosed           = errors.New("account is closed")
+	ErrAccountNotEmpty         = errors.New("account still holds funds")
+	ErrInvalidStatusTransition = errors.New("invalid account status transition")
+)
+
+// ensureOpen allows operations that only bring money in or settle existing
+// holds; frozen accounts still accept them.
+func ensureOpen(user models.User) error {
+	if user.Status == models.UserClosed {
+		return fmt.Errorf("%w: %d", ErrAccountClosed, user.ID)
+	}
+	return nil
+}
+
+// ensureCanSpend allows operations that move money out of the available
+// balance.
+func ensureCanSpend(user models.User) error {
+	switch user.Status {
+	case models.UserFrozen:
+		return fmt.Errorf("%w: %d", ErrAccountFrozen, user.ID)
+	case models.UserClosed:
+		return fmt.Errorf("%w: %d", ErrAccountClosed, user.ID)
+	}
+	return nil
+}
+
+func (s *service) FreezeAccount(ctx context.Context, request models.AccountStatusRequest) (models.AccountStatusResponse, error) {
+	return s.changeStatus(ctx, request, models.UserFrozen, "account frozen", models.UserActive)
+}
+
+func (s *service) UnfreezeAccount(ctx context.Context, request models.AccountStatusRequest) (models.AccountStatusResponse, error) {
+	return s.changeStatus(ctx, request, models.UserActive, "account unfrozen", models.UserFrozen)
+}
+
+func (s *service) changeStatus(ctx context.Context, request models.AccountStatusRequest, status models.UserStatus, message string, from ...models.UserStatus) (models.AccountStatusResponse, error) {
+	var response models.AccountStatusResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		user, err := lockUser(ctx, repo, request.UserID)
+		if err != nil {
+			return err
+		}
+		if !statusIn(user.Status, from) {
+			return fmt.Errorf("%w: %s -> %s", ErrInvalidStatusTransition, user.Status, status)
+		}
+
+		user, err = repo.UpdateUserStatus(ctx, request.UserID, status, request.Reason)
+		if err != nil {
+			return fmt.Errorf("failed to update account status: %w", err)
+		}
+
+		response = models.AccountStatusResponse{
+			Status:  "success",
+			Message: message,
+			User:    user,
+		}
+		return nil
+	})
+	if err != nil {
+		return models.AccountStatusResponse{}, err
+	}
+	return response, nil
+}
+
+func (s *service) CloseAccount(ctx context.Context, request models.AccountStatusRequest) (models.AccountStatusResponse, error) {
+	var response models.AccountStatusResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		user, err := lockUser(ctx, repo, request.UserID)
+		if err != nil {
+			return err
+		}
+		if user.Status == models.UserClosed {
+			return fmt.Errorf("%w: %s -> %s", ErrInvalidStatusTransition, user.Status, models.UserClosed)
+		}
+
+		reserved, err := repo.GetUserReservedFunds(ctx, request.UserID)
+		if err != nil {
+			return fmt.Errorf("failed to get user reserved funds: %w", err)
+		}
+		if reserved > 0 {
+			return fmt.Errorf("%w: %s reserved", ErrAccountNotEmpty, reserved)
+		}
+
+		if user.Debt > 0 {
+			return fmt.Errorf("%w: debt %s outstanding", ErrAccountNotEmpty, user.Debt)
+		}
+
+		var payoutID int
+		if user.Balance > 0 {
+			if !request.ForcePayout {
+				return fmt.Errorf("%w: balance %s", ErrAccountNotEmpty, user.Balance)
+			}
+			payoutID, _, _, err = createPayout(ctx, repo, request.UserID, user.Balance)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Bonus credit cannot be paid out, so it is forfeited.
+		bonus, err := spendableBonus(ctx, repo, user, time.Now())
+		if err != nil {
+			return err
+		}
+		if bonus > 0 {
+			if err := forfeitBonus(ctx, repo, request.UserID, bonus, "bonus forfeited on account close"); err != nil {
+				return err
+			}
+		}
+
+		user, err = repo.UpdateUserStatus(ctx, request.UserID, models.UserClosed, request.Reason)
+		if err != nil {
+			return fmt.Errorf("failed to update account status: %w", err)
+		}
+
+		response = models.AccountStatusResponse{
+			Status:   "success",
+			Message:  "account closed",
+			User:     user,
+			PayoutID: payoutID,
+		}
+		return nil
+	})
+	if err != nil {
+		return models.AccountStatusResponse{}, err
+	}
+	return response, nil
+}
+
+func statusIn(status models.UserStatus, allowed []models.UserStatus) bool {
+	for _, candidate := range allowed {
+		if status == candidate {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,585 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"sort"
+	"time"
+)
+
+// MaxBatchOperations bounds the size of a single POST /batch request.
+const MaxBatchOperations = 10000
+
+var ErrBatchRejected = errors.New("batch rejected")
+
+// BatchError is returned by an atomic batch in which some operations failed.
+// Failed lists only the failed items. It matches ErrBatchRejected.
+type BatchError struct {
+	Failed []models.BatchItemResult
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%s: %d operation(s) failed", ErrBatchRejected, len(e.Failed))
+}
+
+func (e *BatchError) Unwrap() error {
+	return ErrBatchRejected
+}
+
+// Batch applies the operations in request order against balances locked up
+// front, then writes all effects with a fixed number of bulk statements.
+func (s *service) Batch(ctx context.Context, batchRequest models.BatchRequest) (models.BatchResponse, error) {
+	if batchRequest.Mode == "" {
+		batchRequest.Mode = models.BatchAtomic
+	}
+	if batchRequest.Mode != models.BatchAtomic && batchRequest.Mode != models.BatchBestEffort {
+		return models.BatchResponse{}, newValidationError("mode", "must be atomic or best_effort")
+	}
+	if len(batchRequest.Operations) == 0 {
+		return models.BatchResponse{}, newValidationError("operations", "must not be empty")
+	}
+	if len(batchRequest.Operations) > MaxBatchOperations {
+		return models.BatchResponse{}, newValidationError("operations", fmt.Sprintf("at most %d operations are allowed", MaxBatchOperations))
+	}
+
+	plan := newBatchPlan(batchRequest, s.bonusPriority())
+	for i, op := range batchRequest.Operations {
+		if err := validateBatchOperation(op); err != nil {
+			plan.fail(i, err)
+		}
+	}
+	if err := plan.rejectIfAtomic(); err != nil {
+		return models.BatchResponse{}, err
+	}
+
+	now := time.Now()
+	var batchResponse models.BatchResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "batch", batchRequest.IdempotencyKey, batchRequest, &batchResponse)
+		if err != nil || replayed {
+			return err
+		}
+
+		if err := repo.CreateUsers(ctx, plan.depositUserIDs()); err != nil {
+			return err
+		}
+		userIDs := plan.userIDs()
+		plan.users, err = repo.GetUsersForUpdate(ctx, userIDs)
+		if err != nil {
+			return err
+		}
+		lost, err := expireBonus(ctx, repo, userIDs, now)
+		if err != nil {
+			return err
+		}
+		for userID, amount := range lost {
+			user := plan.users[userID]
+			user.BonusBalance -= amount
+			plan.users[userID] = user
+		}
+		if plan.limits, err = loadLimits(ctx, repo, userIDs); err != nil {
+			return err
+		}
+		if plan.hasTransfers() {
+			rule, err := repo.GetFeeRule(ctx, models.FeeTransfer, 0)
+			if err != nil && !errors.Is(err, repository.ErrNoRows) {
+				return fmt.Errorf("failed to get transfer fee: %w", err)
+			}
+			if err == nil {
+				plan.transferFee = &rule
+			}
+		}
+		if orderIDs := plan.reserveOrderIDs(); len(orderIDs) > 0 {
+			if plan.orderItems, err = repo.GetOrderItems(ctx, orderIDs); err != nil {
+				return err
+			}
+			if plan.services, err = repo.GetServicesByID(ctx, plan.reserveServiceIDs()); err != nil {
+				return err
+			}
+		}
+
+		for i, op := range batchRequest.Operations {
+			if plan.failed(i) {
+				continue
+			}
+			if err := plan.apply(i, op, s.reservationExpiry(op.ServiceID, op.TTLSeconds, now)); err != nil {
+				plan.fail(i, err)
+			}
+		}
+		if err := plan.rejectIfAtomic(); err != nil {
+			return err
+		}
+
+		if err := plan.write(ctx, repo, now); err != nil {
+			return err
+		}
+
+		batchResponse = plan.response()
+		return storeIdempotentResponse(ctx, repo, batchRequest.IdempotencyKey, batchResponse)
+	})
+	if err != nil {
+		return models.BatchResponse{}, err
+	}
+	return batchResponse, nil
+}
+
+func validateBatchOperation(op models.BatchOperation) error {
+	if err := validateAmount(op.Amount); err != nil {
+		return err
+	}
+	switch op.Type {
+	case models.BatchDeposit:
+	case models.BatchTransfer:
+		if op.UserID == op.ToUserID {
+			return newValidationError("to_user_id", "cannot transfer to self")
+		}
+	case models.BatchReserve:
+		if op.TTLSeconds < 0 {
+			return newValidationError("ttl_seconds", "must not be negative")
+		}
+	default:
+		return newValidationError("type", "must be deposit, transfer or reserve")
+	}
+	return nil
+}
+
+// pendingTransaction is a transaction of the plan together with the journal
+// entry booked for it. Entries that only link another transaction have none.
+type pendingTransaction struct {
+	transaction models.Transaction
+	entry       *models.JournalEntry
+	// result is the index of the operation that receives the transaction id.
+	result int
+	// related is the index of the pending transaction this one points at, or -1.
+	related int
+}
+
+// batchPlan accumulates the effects of a batch in memory.
+type batchPlan struct {
+	mode       models.BatchMode
+	operations []models.BatchOperation
+	results    []models.BatchItemResult
+	users      map[int]models.User
+	deltas     map[int]models.Money
+	// debtDeltas are the debts repaid by deposits, as negative amounts.
+	debtDeltas map[int]models.Money
+	// bonusDeltas are the changes of the bonus balances; reservations draw
+	// on them in priority order.
+	bonusDeltas  map[int]models.Money
+	priority     models.BonusPriority
+	transactions []pendingTransaction
+	reservations []models.Reservation
+	// orderItems holds the existing lines of the reserved order ids; lines adds
+	// the new order lines, each pointing at its reserve transaction.
+	orderItems []models.OrderItem
+	lines      []pendingOrderLine
+	// services holds the catalog entries of the reserved services.
+	services map[int]models.Service
+	limits   *limitChecker
+	// transferFee is the fee rule of transfers, nil when they are free.
+	transferFee *models.FeeRule
+}
+
+type pendingOrderLine struct {
+	item        models.OrderItem
+	transaction int
+}
+
+func newBatchPlan(request models.BatchRequest, priority models.BonusPriority) *batchPlan {
+	results := make([]models.BatchItemResult, len(request.Operations))
+	for i := range results {
+		results[i] = models.BatchItemResult{Index: i, Status: "success"}
+	}
+	return &batchPlan{
+		mode:        request.Mode,
+		operations:  request.Operations,
+		results:     results,
+		deltas:      make(map[int]models.Money),
+		bonusDeltas: make(map[int]models.Money),
+		debtDeltas:  make(map[int]models.Money),
+		priority:    priority,
+	}
+}
+
+func (p *batchPlan) fail(i int, err error) {
+	p.results[i].Status = "failed"
+	p.results[i].Error = err.Error()
+}
+
+func (p *batchPlan) failed(i int) bool {
+	return p.results[i].Error != ""
+}
+
+func (p *batchPlan) rejectIfAtomic() error {
+	if p.mode != models.BatchAtomic {
+		return nil
+	}
+	var failed []models.BatchItemResult
+	for i, result := range p.results {
+		if p.failed(i) {
+			failed = append(failed, result)
+		}
+	}
+	if len(failed) > 0 {
+		return &BatchError{Failed: failed}
+	}
+	return nil
+}
+
+func (p *batchPlan) depositUserIDs() []int {
+	var userIDs []int
+	for i, op := range p.operations {
+		if !p.failed(i) && op.Type == models.BatchDeposit {
+			userIDs = append(userIDs, op.UserID)
+		}
+	}
+	return userIDs
+}
+
+// userIDs returns every user touched by the batch, sorted so the rows are
+// locked in the same order as lockOrder does.
+func (p *batchPlan) userIDs() []int {
+	seen := make(map[int]bool)
+	var userIDs []int
+	for i, op := range p.operations {
+		if p.failed(i) {
+			continue
+		}
+		for _, userID := range []int{op.UserID, op.ToUserID} {
+			if userID != 0 && !seen[userID] {
+				seen[userID] = true
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+	sort.Ints(userIDs)
+	return userIDs
+}
+
+func (p *batchPlan) reserveOrderIDs() []int {
+	var orderIDs []int
+	for i, op := range p.operations {
+		if !p.failed(i) && op.Type == models.BatchReserve {
+			orderIDs = append(orderIDs, op.OrderID)
+		}
+	}
+	return orderIDs
+}
+
+func (p *batchPlan) reserveServiceIDs() []int {
+	var serviceIDs []int
+	for i, op := range p.operations {
+		if !p.failed(i) && op.Type == models.BatchReserve {
+			serviceIDs = append(serviceIDs, op.ServiceID)
+		}
+	}
+	return serviceIDs
+}
+
+// checkOrderLine enforces that (service_id, order_id) is reserved once,
+// including lines added by earlier operations of the batch.
+func (p *batchPlan) checkOrderLine(op models.BatchOperation) error {
+	taken := fmt.Errorf("%w: service %d, order %d", ErrOrderExists, op.ServiceID, op.OrderID)
+	for _, item := range p.orderItems {
+		if item.OrderID == op.OrderID && item.ServiceID == op.ServiceID {
+			return taken
+		}
+	}
+	for _, line := range p.lines {
+		if line.item.OrderID == op.OrderID && line.item.ServiceID == op.ServiceID {
+			return taken
+		}
+	}
+	return nil
+}
+
+func (p *batchPlan) user(userID int) (models.User, error) {
+	user, ok := p.users[userID]
+	if !ok {
+		return models.User{}, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+	}
+	return user, nil
+}
+
+func (p *batchPlan) move(userID int, amount models.Money) {
+	user := p.users[userID]
+	user.Balance += amount
+	p.users[userID] = user
+	p.deltas[userID] += amount
+}
+
+func (p *batchPlan) moveBonus(userID int, amount models.Money) {
+	user := p.users[userID]
+	user.BonusBalance += amount
+	p.users[userID] = user
+	p.bonusDeltas[userID] += amount
+}
+
+func (p *batchPlan) repayDebt(userID int, amount models.Money) {
+	user := p.users[userID]
+	user.Debt -= amount
+	p.users[userID] = user
+	p.debtDeltas[userID] -= amount
+}
+
+// add records a transaction whose id is reported for operation i (-1 for
+// none) and returns its index in the plan.
+func (p *batchPlan) add(i int, transaction models.Transaction, entry *models.JournalEntry) int {
+	p.transactions = append(p.transactions, pendingTransaction{transaction: transaction, entry: entry, result: i, related: -1})
+	return len(p.transactions) - 1
+}
+
+// addRelated records a transaction that points at the one at index related.
+func (p *batchPlan) addRelated(related int, transaction models.Transaction, entry *models.JournalEntry) {
+	p.transactions = append(p.transactions, pendingTransaction{transaction: transaction, entry: entry, result: -1, related: related})
+}
+
+func (p *batchPlan) hasTransfers() bool {
+	for i, op := range p.operations {
+		if op.Type == models.BatchTransfer && !p.failed(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply checks op against the balances left by the earlier operations and
+// records its effects. A failed operation leaves the plan unchanged.
+func (p *batchPlan) apply(i int, op models.BatchOperation, expiresAt *time.Time) error {
+	user, err := p.user(op.UserID)
+	if err != nil {
+		return err
+	}
+
+	switch op.Type {
+	case models.BatchDeposit:
+		if err := ensureOpen(user); err != nil {
+			return err
+		}
+		if err := p.limits.check(op.UserID, models.LimitDeposit, op.Amount); err != nil {
+			return err
+		}
+		repaid := min(op.Amount, user.Debt)
+		p.move(op.UserID, op.Amount-repaid)
+		entry := models.NewJournalEntry(0, "deposit", models.ExternalFunding, models.UserAvailable(op.UserID), op.Amount)
+		deposit := p.add(i, models.Transaction{
+			UserID:      op.UserID,
+			Amount:      op.Amount,
+			Type:        models.Deposit,
+			Description: "deposit",
+		}, &entry)
+		if repaid > 0 {
+			p.repayDebt(op.UserID, repaid)
+			repayment := models.NewJournalEntry(0, "debt repayment", models.UserAvailable(op.UserID), models.UserDebt(op.UserID), repaid)
+			p.addRelated(deposit, models.Transaction{
+				UserID:      op.UserID,
+				Amount:      -repaid,
+				Type:        models.DebtRepayment,
+				Description: "debt repayment",
+			}, &repayment)
+			p.results[i].DebtRepaid = repaid
+		}
+
+	case models.BatchTransfer:
+		recipient, err := p.user(op.ToUserID)
+		if err != nil {
+			return err
+		}
+		if err := ensureCanSpend(user); err != nil {
+			return err
+		}
+		if err := ensureOpen(recipient); err != nil {
+			return err
+		}
+		var fee models.Money
+		if p.transferFee != nil {
+			fee = p.transferFee.Fee(op.Amount)
+		}
+		if user.Balance < op.Amount+fee {
+			return ErrInsufficientFunds
+		}
+		if err := p.limits.check(op.UserID, models.LimitTransfer, op.Amount); err != nil {
+			return err
+		}
+		p.move(op.UserID, -op.Amount-fee)
+		p.move(op.ToUserID, op.Amount)
+		entry := models.NewJournalEntry(0, "transfer", models.UserAvailable(op.UserID), models.UserAvailable(op.ToUserID), op.Amount)
+		outgoing := p.add(i, models.Transaction{
+			UserID:             op.UserID,
+			Amount:             -op.Amount,
+			Type:               models.Transfer,
+			Description:        "outgoing transfer",
+			CounterpartyUserID: op.ToUserID,
+		}, &entry)
+		p.addRelated(outgoing, models.Transaction{
+			UserID:             op.ToUserID,
+			Amount:             op.Amount,
+			Type:               models.Transfer,
+			Description:        "incoming transfer",
+			CounterpartyUserID: op.UserID,
+		}, nil)
+		if fee > 0 {
+			feeEntry := models.NewJournalEntry(0, "transfer fee", models.UserAvailable(op.UserID), models.FeeIncome, fee)
+			p.addRelated(outgoing, models.Transaction{
+				UserID:      op.UserID,
+				Amount:      -fee,
+				Type:        models.Fee,
+				Description: "transfer fee",
+			}, &feeEntry)
+			p.results[i].Fee = fee
+		}
+
+	case models.BatchReserve:
+		if err := ensureCanSpend(user); err != nil {
+			return err
+		}
+		service, ok := p.services[op.ServiceID]
+		if !ok {
+			return fmt.Errorf("%w: %d", ErrServiceNotFound, op.ServiceID)
+		}
+		if err := checkServiceActive(service); err != nil {
+			return err
+		}
+		if err := p.checkOrderLine(op); err != nil {
+			return err
+		}
+		if user.Balance+user.BonusBalance < op.Amount {
+			return ErrInsufficientFunds
+		}
+		if err := p.limits.check(op.UserID, models.LimitReserve, op.Amount); err != nil {
+			return err
+		}
+		fromReal, fromBonus := p.priority.Split(op.Amount, user.Balance, user.BonusBalance)
+		p.move(op.UserID, -fromReal)
+		p.moveBonus(op.UserID, -fromBonus)
+		p.lines = append(p.lines, pendingOrderLine{
+			item: models.OrderItem{
+				OrderID:   op.OrderID,
+				UserID:    op.UserID,
+				ServiceID: op.ServiceID,
+				Amount:    op.Amount,
+			},
+			transaction: len(p.transactions),
+		})
+		p.reservations = append(p.reservations, models.Reservation{
+			UserID:      op.UserID,
+			ServiceID:   op.ServiceID,
+			OrderID:     op.OrderID,
+			Amount:      op.Amount,
+			BonusAmount: fromBonus,
+			ExpiresAt:   expiresAt,
+		})
+		entry := models.NewBucketJournalEntry(0, "reserve", op.UserID, models.UserReserved(op.UserID), -fromReal, -fromBonus)
+		p.add(i, models.Transaction{
+			UserID:      op.UserID,
+			ServiceID:   op.ServiceID,
+			OrderID:     op.OrderID,
+			Amount:      -op.Amount,
+			BonusAmount: -fromBonus,
+			Type:        models.Reserve,
+			Description: "reserve",
+		}, &entry)
+	}
+
+	p.results[i].Balance = p.users[op.UserID].Balance
+	return nil
+}
+
+func (p *batchPlan) write(ctx context.Context, repo repository.Repository, now time.Time) error {
+	if len(p.transactions) == 0 {
+		return nil
+	}
+
+	ids, err := repo.NextTransactionIDs(ctx, len(p.transactions))
+	if err != nil {
+		return err
+	}
+
+	transactions := make([]models.Transaction, 0, len(p.transactions))
+	entries := make([]models.JournalEntry, 0, len(p.transactions))
+	var fees []models.Transaction
+	for n, pending := range p.transactions {
+		transaction := pending.transaction
+		transaction.ID = ids[n]
+		if pending.related >= 0 {
+			transaction.RelatedTransactionID = ids[pending.related]
+		}
+		if pending.entry != nil {
+			entry := *pending.entry
+			entry.TransactionID = ids[n]
+			entries = append(entries, entry)
+		}
+		if transaction.Type == models.Fee {
+			fees = append(fees, transaction)
+		}
+		if pending.result >= 0 {
+			p.results[pending.result].TransactionID = ids[n]
+		}
+		transactions = append(transactions, transaction)
+	}
+
+	if err := repo.AdjustUserBalances(ctx, p.deltas); err != nil {
+		return err
+	}
+	if err := repo.AdjustUserDebts(ctx, p.debtDeltas); err != nil {
+		return err
+	}
+	if err := repo.AdjustUserBonusBalances(ctx, p.bonusDeltas); err != nil {
+		return err
+	}
+	spent := make(map[int]models.Money, len(p.bonusDeltas))
+	for userID, delta := range p.bonusDeltas {
+		spent[userID] = -delta
+	}
+	if err := repo.SpendBonusGrants(ctx, spent, now); err != nil {
+		return err
+	}
+	if err := repo.CreateTransactions(ctx, transactions); err != nil {
+		return err
+	}
+	if err := repo.CreateReservations(ctx, p.reservations); err != nil {
+		return err
+	}
+	if err := repo.CreateJournalEntries(ctx, entries); err != nil {
+		return err
+	}
+	if err := repo.AddFeeRecords(ctx, fees); err != nil {
+		return err
+	}
+
+	orders := make([]models.Order, 0, len(p.lines))
+	for _, line := range p.lines {
+		line.item.TransactionID = ids[line.transaction]
+		orders = append(orders, models.Order{
+			ID:     line.item.OrderID,
+			UserID: line.item.UserID,
+			Items:  []models.OrderItem{line.item},
+		})
+	}
+	return repo.CreateOrders(ctx, orders)
+}
+
+func (p *batchPlan) response() models.BatchResponse {
+	response := models.BatchResponse{
+		Status:  "success",
+		Mode:    p.mode,
+		Results: p.results,
+	}
+	for i := range p.results {
+		if p.failed(i) {
+			response.Failed++
+		} else {
+			response.Succeeded++
+		}
+	}
+	switch {
+	case response.Succeeded == 0:
+		response.Status = "failed"
+	case response.Failed > 0:
+		response.Status = "partial"
+	}
+	return response
+}
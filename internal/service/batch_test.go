@@ -0,0 +1,37 @@
+package service
+
+import (
+	"errors"
+	"internship_backend_2022/internal/models"
+	"testing"
+)
+
+func TestBatchPlan_checkOrderLine(t *testing.T) {
+	plan := &batchPlan{
+		orderItems: []models.OrderItem{
+			{OrderID: 5, UserID: 1, ServiceID: 1},
+		},
+		lines: []pendingOrderLine{
+			{item: models.OrderItem{OrderID: 6, UserID: 1, ServiceID: 1}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		op      models.BatchOperation
+		wantErr error
+	}{
+		{name: "another user shares the order id on another service", op: models.BatchOperation{UserID: 2, ServiceID: 2, OrderID: 5}},
+		{name: "same user adds a service to the order", op: models.BatchOperation{UserID: 1, ServiceID: 3, OrderID: 5}},
+		{name: "line already reserved", op: models.BatchOperation{UserID: 2, ServiceID: 1, OrderID: 5}, wantErr: ErrOrderExists},
+		{name: "line reserved earlier in the batch", op: models.BatchOperation{UserID: 2, ServiceID: 1, OrderID: 6}, wantErr: ErrOrderExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := plan.checkOrderLine(tt.op)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Errorf("checkOrderLine() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
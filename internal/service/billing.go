@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+)
+
+// maxExternalPaymentIDLength matches transactions.external_payment_id.
+const maxExternalPaymentIDLength = 255
+
+var ErrExternalPaymentConflict = errors.New("external payment id already used")
+
+// BillingDeposit credits a payment reported by the billing service. Each
+// external payment is credited once: a retry of the same payment returns the
+// original deposit, while a different payment reusing the id is rejected.
+func (s *service) BillingDeposit(ctx context.Context, request models.BillingDepositRequest) (models.DepositResponse, error) {
+	if request.ExternalPaymentID == "" {
+		return models.DepositResponse{}, newValidationError("external_payment_id", "must not be empty")
+	}
+	if len(request.ExternalPaymentID) > maxExternalPaymentIDLength {
+		return models.DepositResponse{}, newValidationError("external_payment_id", fmt.Sprintf("must be at most %d characters", maxExternalPaymentIDLength))
+	}
+	if err := validateAmount(request.Amount); err != nil {
+		return models.DepositResponse{}, err
+	}
+
+	var depositResponse models.DepositResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		// The user lock serialises retries of the same payment.
+		user, err := lockOrCreateUser(ctx, repo, request.UserID)
+		if err != nil {
+			return err
+		}
+
+		existing, err := repo.GetDepositByExternalPaymentID(ctx, request.ExternalPaymentID)
+		if err == nil {
+			if existing.UserID != request.UserID || existing.Amount != request.Amount {
+				return fmt.Errorf("%w: %s", ErrExternalPaymentConflict, request.ExternalPaymentID)
+			}
+			depositResponse = models.DepositResponse{
+				Status:            "success",
+				Message:           "payment already credited",
+				Balance:           user.Balance,
+				TransactionID:     existing.ID,
+				ExternalPaymentID: existing.ExternalPaymentID,
+			}
+			return nil
+		}
+		if !errors.Is(err, repository.ErrNoRows) {
+			return err
+		}
+
+		depositResponse, err = deposit(ctx, repo, user, request.Amount, request.ExternalPaymentID)
+		if errors.Is(err, repository.ErrDuplicateExternalPayment) {
+			// Credited concurrently to another user.
+			return fmt.Errorf("%w: %s", ErrExternalPaymentConflict, request.ExternalPaymentID)
+		}
+		return err
+	})
+	if err != nil {
+		return models.DepositResponse{}, err
+	}
+	return depositResponse, nil
+}
@@ -0,0 +1,217 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"time"
+)
+
+// bonusExpiryBatch bounds how many users one bonus expiry run handles.
+const bonusExpiryBatch = 100
+
+func (s *service) bonusPriority() models.BonusPriority {
+	if s.options.BonusPriority == "" {
+		return models.BonusFirst
+	}
+	return s.options.BonusPriority
+}
+
+// GrantBonus credits promotional money to the user's bonus balance. It can be
+// spent on services but not transferred or withdrawn.
+func (s *service) GrantBonus(ctx context.Context, request models.BonusGrantRequest) (models.BonusGrantResponse, error) {
+	if err := validateAmount(request.Amount); err != nil {
+		return models.BonusGrantResponse{}, err
+	}
+	if request.TTLSeconds < 0 {
+		return models.BonusGrantResponse{}, newValidationError("ttl_seconds", "must not be negative")
+	}
+	description := request.Reason
+	if description == "" {
+		description = "bonus"
+	}
+	var expiresAt *time.Time
+	if request.TTLSeconds > 0 {
+		at := time.Now().Add(time.Duration(request.TTLSeconds) * time.Second)
+		expiresAt = &at
+	}
+
+	var response models.BonusGrantResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "bonus", request.IdempotencyKey, request, &response)
+		if err != nil || replayed {
+			return err
+		}
+
+		user, err := lockUser(ctx, repo, request.UserID)
+		if err != nil {
+			return err
+		}
+		if err := ensureOpen(user); err != nil {
+			return err
+		}
+
+		bonusBalance, err := repo.UpdateUserBonusBalance(ctx, request.UserID, request.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to update user bonus balance: %w", err)
+		}
+
+		transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+			UserID:      request.UserID,
+			Amount:      request.Amount,
+			BonusAmount: request.Amount,
+			Type:        models.Bonus,
+			Description: description,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create transaction: %w", err)
+		}
+
+		entry := models.NewJournalEntry(transactionId, description, models.BonusFunding, models.UserBonus(request.UserID), request.Amount)
+		if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+			return fmt.Errorf("failed to create journal entry: %w", err)
+		}
+
+		grant, err := repo.CreateBonusGrant(ctx, models.BonusGrant{
+			UserID:        request.UserID,
+			Amount:        request.Amount,
+			ExpiresAt:     expiresAt,
+			TransactionID: transactionId,
+		})
+		if err != nil {
+			return err
+		}
+
+		response = models.BonusGrantResponse{
+			Status:       "success",
+			Message:      "bonus granted successfully",
+			Grant:        grant,
+			Balance:      user.Balance,
+			BonusBalance: bonusBalance,
+		}
+		return storeIdempotentResponse(ctx, repo, request.IdempotencyKey, response)
+	})
+	if err != nil {
+		return models.BonusGrantResponse{}, err
+	}
+	return response, nil
+}
+
+// ExpireBonuses forfeits the credit left in expired grants.
+func (s *service) ExpireBonuses(ctx context.Context) (int, error) {
+	now := time.Now()
+	userIDs, err := s.repository.GetUsersWithExpiredBonus(ctx, now, bonusExpiryBatch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get expired bonus grants: %w", err)
+	}
+
+	expired := 0
+	var errs []error
+	for _, userID := range userIDs {
+		var lost map[int]models.Money
+		err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+			if _, err := lockUser(ctx, repo, userID); err != nil {
+				return err
+			}
+			var err error
+			lost, err = expireBonus(ctx, repo, []int{userID}, now)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to expire bonus of user %d: %w", userID, err))
+			if err := s.repository.MarkBonusExpiryFailed(ctx, userID, now); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if lost[userID] > 0 {
+			expired++
+		}
+	}
+	return expired, errors.Join(errs...)
+}
+
+// expireBonus forfeits the locked users' expired grants before their bonus is
+// spent and returns the credit each user lost.
+func expireBonus(ctx context.Context, repo repository.Repository, userIDs []int, now time.Time) (map[int]models.Money, error) {
+	expiries, err := repo.ExpireBonusGrants(ctx, userIDs, now)
+	if err != nil {
+		return nil, err
+	}
+	lost := make(map[int]models.Money, len(expiries))
+	for _, expiry := range expiries {
+		if err := recordBonusLoss(ctx, repo, expiry.UserID, expiry.Amount, "bonus expired"); err != nil {
+			return nil, err
+		}
+		lost[expiry.UserID] = expiry.Amount
+	}
+	return lost, nil
+}
+
+// forfeitBonus takes the whole remaining bonus balance of a locked user, e.g.
+// when the account is closed.
+func forfeitBonus(ctx context.Context, repo repository.Repository, userID int, amount models.Money, description string) error {
+	if err := spendBonus(ctx, repo, userID, amount, time.Now()); err != nil {
+		return err
+	}
+	return recordBonusLoss(ctx, repo, userID, amount, description)
+}
+
+// recordBonusLoss books credit that left the bonus balance unspent back to the
+// bonus funding account.
+func recordBonusLoss(ctx context.Context, repo repository.Repository, userID int, amount models.Money, description string) error {
+	transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+		UserID:      userID,
+		Amount:      -amount,
+		BonusAmount: -amount,
+		Type:        models.BonusExpired,
+		Description: description,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	entry := models.NewJournalEntry(transactionId, description, models.UserBonus(userID), models.BonusFunding, amount)
+	if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+		return fmt.Errorf("failed to create journal entry: %w", err)
+	}
+	return nil
+}
+
+// spendBonus takes amount off the user's bonus balance and grants.
+func spendBonus(ctx context.Context, repo repository.Repository, userID int, amount models.Money, now time.Time) error {
+	if amount == 0 {
+		return nil
+	}
+	if _, err := repo.UpdateUserBonusBalance(ctx, userID, -amount); err != nil {
+		return fmt.Errorf("failed to update user bonus balance: %w", err)
+	}
+	return repo.SpendBonusGrants(ctx, map[int]models.Money{userID: amount}, now)
+}
+
+// returnBonus gives bonus released from a hold or refunded back to the user's
+// bonus balance and grants.
+func returnBonus(ctx context.Context, repo repository.Repository, userID int, amount models.Money) error {
+	if amount == 0 {
+		return nil
+	}
+	if _, err := repo.UpdateUserBonusBalance(ctx, userID, amount); err != nil {
+		return fmt.Errorf("failed to update user bonus balance: %w", err)
+	}
+	return repo.RestoreBonusGrants(ctx, map[int]models.Money{userID: amount})
+}
+
+// spendableBonus expires the locked user's due grants and returns the bonus
+// balance left to spend.
+func spendableBonus(ctx context.Context, repo repository.Repository, user models.User, now time.Time) (models.Money, error) {
+	if user.BonusBalance == 0 {
+		return 0, nil
+	}
+	lost, err := expireBonus(ctx, repo, []int{user.ID}, now)
+	if err != nil {
+		return 0, err
+	}
+	return user.BonusBalance - lost[user.ID], nil
+}
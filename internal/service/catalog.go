@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"strings"
+)
+
+var (
+	ErrServiceNotFound = errors.New("service not found")
+	ErrServiceExists   = errors.New("service already exists")
+	ErrServiceInactive = errors.New("service is inactive")
+)
+
+// ensureServiceActive allows new holds only for services of the catalog that
+// are active.
+func ensureServiceActive(ctx context.Context, repo repository.Repository, serviceID int) error {
+	service, err := repo.GetService(ctx, serviceID)
+	if errors.Is(err, repository.ErrNoRows) {
+		return fmt.Errorf("%w: %d", ErrServiceNotFound, serviceID)
+	}
+	if err != nil {
+		return err
+	}
+	return checkServiceActive(service)
+}
+
+// ensureServicesActive is ensureServiceActive for several services at once.
+func ensureServicesActive(ctx context.Context, repo repository.Repository, serviceIDs []int) error {
+	services, err := repo.GetServicesByID(ctx, serviceIDs)
+	if err != nil {
+		return err
+	}
+	for _, serviceID := range serviceIDs {
+		service, ok := services[serviceID]
+		if !ok {
+			return fmt.Errorf("%w: %d", ErrServiceNotFound, serviceID)
+		}
+		if err := checkServiceActive(service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkServiceActive(service models.Service) error {
+	if !service.Active {
+		return fmt.Errorf("%w: %d", ErrServiceInactive, service.ID)
+	}
+	return nil
+}
+
+func validateService(service models.Service) error {
+	if service.ID <= 0 {
+		return newValidationError("id", "must be greater than 0")
+	}
+	if strings.TrimSpace(service.Name) == "" {
+		return newValidationError("name", "must not be empty")
+	}
+	if len(service.Name) > 255 {
+		return newValidationError("name", "must be at most 255 characters")
+	}
+	if len(service.Category) > 64 {
+		return newValidationError("category", "must be at most 64 characters")
+	}
+	return nil
+}
+
+func (s *service) Services(ctx context.Context) (models.ServicesResponse, error) {
+	services, err := s.repository.GetServices(ctx)
+	if err != nil {
+		return models.ServicesResponse{}, err
+	}
+	return models.ServicesResponse{Services: services}, nil
+}
+
+func (s *service) GetService(ctx context.Context, serviceID int) (models.Service, error) {
+	service, err := s.repository.GetService(ctx, serviceID)
+	if errors.Is(err, repository.ErrNoRows) {
+		return models.Service{}, fmt.Errorf("%w: %d", ErrServiceNotFound, serviceID)
+	}
+	return service, err
+}
+
+func (s *service) CreateService(ctx context.Context, service models.Service) (models.Service, error) {
+	if err := validateService(service); err != nil {
+		return models.Service{}, err
+	}
+	created, ok, err := s.repository.CreateService(ctx, service)
+	if err != nil {
+		return models.Service{}, err
+	}
+	if !ok {
+		return models.Service{}, fmt.Errorf("%w: %d", ErrServiceExists, service.ID)
+	}
+	return created, nil
+}
+
+// UpdateService renames, recategorises or (de)activates a service. Revenue
+// already booked keeps the name it was booked under.
+func (s *service) UpdateService(ctx context.Context, service models.Service) (models.Service, error) {
+	if err := validateService(service); err != nil {
+		return models.Service{}, err
+	}
+	updated, err := s.repository.UpdateService(ctx, service)
+	if errors.Is(err, repository.ErrNoRows) {
+		return models.Service{}, fmt.Errorf("%w: %d", ErrServiceNotFound, service.ID)
+	}
+	return updated, err
+}
+
+func (s *service) DeleteService(ctx context.Context, serviceID int) error {
+	err := s.repository.DeleteService(ctx, serviceID)
+	if errors.Is(err, repository.ErrNoRows) {
+		return fmt.Errorf("%w: %d", ErrServiceNotFound, serviceID)
+	}
+	return err
+}
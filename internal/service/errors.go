@@ -0,0 +1,33 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrValidation          = errors.New("validation failed")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrInsufficientFunds   = errors.New("insufficient funds")
+	ErrReservationNotFound = errors.New("no corresponding reservation found")
+	ErrReservationExpired  = errors.New("reservation has expired")
+)
+
+// ValidationError reports a request field the service rejected. It matches
+// ErrValidation with errors.Is.
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrValidation
+}
+
+func newValidationError(field string, message string) error {
+	return &ValidationError{Field: field, Message: message}
+}
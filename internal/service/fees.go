@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+)
+
+var ErrFeeRuleNotFound = errors.New("fee rule not found")
+
+// feeFor prices an operation with the matching fee rule. Operations without a
+// rule are free.
+func feeFor(ctx context.Context, repo repository.Repository, operation models.FeeOperation, serviceID int, amount models.Money) (models.Money, error) {
+	rule, err := repo.GetFeeRule(ctx, operation, serviceID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNoRows) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return rule.Fee(amount), nil
+}
+
+// chargeFee takes fee from the user's available balance as fee income and
+// records it as a fee transaction pointing at the operation it was charged
+// for. The caller has checked the balance.
+func chargeFee(ctx context.Context, repo repository.Repository, related models.Transaction, fee models.Money, description string) (int, error) {
+	if _, err := repo.UpdateUserBalance(ctx, related.UserID, -fee); err != nil {
+		return 0, fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	feeTransaction := models.Transaction{
+		UserID:               related.UserID,
+		ServiceID:            related.ServiceID,
+		OrderID:              related.OrderID,
+		Amount:               -fee,
+		Type:                 models.Fee,
+		Description:          description,
+		RelatedTransactionID: related.ID,
+	}
+	transactionId, err := repo.CreateTransaction(ctx, feeTransaction)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	entry := models.NewJournalEntry(transactionId, description, models.UserAvailable(related.UserID), models.FeeIncome, fee)
+	if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+		return 0, fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	if err := repo.AddFeeRecords(ctx, []models.Transaction{feeTransaction}); err != nil {
+		return 0, err
+	}
+	return transactionId, nil
+}
+
+func (s *service) FeeRules(ctx context.Context) (models.FeeRulesResponse, error) {
+	rules, err := s.repository.GetFeeRules(ctx)
+	if err != nil {
+		return models.FeeRulesResponse{}, fmt.Errorf("failed to get fee rules: %w", err)
+	}
+	return models.FeeRulesResponse{Rules: rules}, nil
+}
+
+func (s *service) SetFeeRule(ctx context.Context, rule models.FeeRule) (models.FeeRule, error) {
+	if !rule.Operation.Valid() {
+		return models.FeeRule{}, newValidationError("operation", "must be transfer or confirm")
+	}
+	if rule.ServiceID < 0 {
+		return models.FeeRule{}, newValidationError("service_id", "must not be negative")
+	}
+	if rule.Operation == models.FeeTransfer && rule.ServiceID != 0 {
+		return models.FeeRule{}, newValidationError("service_id", "transfer fees cannot be set per service")
+	}
+	if rule.RateBps < 0 || rule.RateBps > 10000 {
+		return models.FeeRule{}, newValidationError("rate_bps", "must be between 0 and 10000")
+	}
+	if rule.MinFee < 0 || !rule.MinFee.InRange() {
+		return models.FeeRule{}, newValidationError("min_fee", "must not be negative")
+	}
+	if rule.MaxFee != nil && (*rule.MaxFee < rule.MinFee || !rule.MaxFee.InRange()) {
+		return models.FeeRule{}, newValidationError("max_fee", "must not be less than min_fee")
+	}
+
+	if err := s.repository.UpsertFeeRule(ctx, rule); err != nil {
+		return models.FeeRule{}, fmt.Errorf("failed to save fee rule: %w", err)
+	}
+	return rule, nil
+}
+
+func (s *service) DeleteFeeRule(ctx context.Context, operation models.FeeOperation, serviceID int) error {
+	err := s.repository.DeleteFeeRule(ctx, operation, serviceID)
+	if errors.Is(err, repository.ErrNoRows) {
+		return fmt.Errorf("%w: %s for service %d", ErrFeeRuleNotFound, operation, serviceID)
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/repository"
+)
+
+var ErrIdempotencyKeyReused = errors.New("idempotency key was already used with a different request")
+
+// claimIdempotencyKey registers key for this request inside the caller's
+// transaction. If the key was already used for the same request, the stored
+// response is decoded into response and true is returned so the caller can
+// replay it instead of executing the operation again.
+func claimIdempotencyKey(ctx context.Context, repo repository.Repository, operation string, key string, request interface{}, response interface{}) (bool, error) {
+	if key == "" {
+		return false, nil
+	}
+
+	requestHash, err := hashRequest(operation, request)
+	if err != nil {
+		return false, err
+	}
+
+	created, err := repo.CreateIdempotencyKey(ctx, key, requestHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if created {
+		return false, nil
+	}
+
+	record, err := repo.GetIdempotencyKey(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+	if record.RequestHash != requestHash || record.Response == nil {
+		return false, ErrIdempotencyKeyReused
+	}
+	if err := json.Unmarshal(record.Response, response); err != nil {
+		return false, fmt.Errorf("failed to decode stored response: %w", err)
+	}
+	return true, nil
+}
+
+// storeIdempotentResponse saves the response of a claimed key so retries can
+// replay it. It must run in the same transaction as claimIdempotencyKey.
+func storeIdempotentResponse(ctx context.Context, repo repository.Repository, key string, response interface{}) error {
+	if key == "" {
+		return nil
+	}
+
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to encode response: %w", err)
+	}
+	if err := repo.SaveIdempotencyResponse(ctx, key, encoded); err != nil {
+		return fmt.Errorf("failed to save idempotent response: %w", err)
+	}
+	return nil
+}
+
+func hashRequest(operation string, request interface{}) (string, error) {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode request: %w", err)
+	}
+	sum := sha256.Sum256(append([]byte(operation+":"), encoded...))
+	return hex.EncodeToString(sum[:]), nil
+}
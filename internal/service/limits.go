@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"sort"
+)
+
+var (
+	ErrLimitExceeded = errors.New("limit exceeded")
+	ErrLimitNotFound = errors.New("limit not found")
+)
+
+// LimitExceededError names the limit an operation would break and what is
+// still allowed within its window. It matches ErrLimitExceeded.
+type LimitExceededError struct {
+	Limit           models.Limit
+	RemainingAmount *models.Money
+	RemainingCount  *int
+}
+
+func (e *LimitExceededError) Error() string {
+	return fmt.Sprintf("%s: %s limit per %s", ErrLimitExceeded, e.Limit.Operation, e.Limit.Window())
+}
+
+func (e *LimitExceededError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+type limitKey struct {
+	operation     models.LimitOperation
+	windowSeconds int
+}
+
+type usageKey struct {
+	userID int
+	limitKey
+}
+
+// limitChecker holds the effective limits and current usage of a set of
+// users. check counts accepted operations, so several operations of the same
+// user in one database transaction see each other.
+type limitChecker struct {
+	limits map[int][]models.Limit
+	usage  map[usageKey]models.LimitUsage
+}
+
+// loadLimits reads the limits and usage of userIDs. The users must already be
+// locked so concurrent operations cannot both pass the check.
+func loadLimits(ctx context.Context, repo repository.Repository, userIDs []int) (*limitChecker, error) {
+	all, err := repo.GetLimits(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	checker := &limitChecker{
+		limits: make(map[int][]models.Limit, len(userIDs)),
+		usage:  make(map[usageKey]models.LimitUsage),
+	}
+	if len(all) == 0 {
+		return checker, nil
+	}
+
+	defaults := make(map[limitKey]models.Limit)
+	overrides := make(map[int]map[limitKey]models.Limit)
+	for _, limit := range all {
+		key := limitKey{limit.Operation, limit.WindowSeconds}
+		if limit.UserID == 0 {
+			defaults[key] = limit
+			continue
+		}
+		if overrides[limit.UserID] == nil {
+			overrides[limit.UserID] = make(map[limitKey]models.Limit)
+		}
+		overrides[limit.UserID][key] = limit
+	}
+
+	windows := make(map[int]bool)
+	for _, userID := range userIDs {
+		effective := make(map[limitKey]models.Limit, len(defaults))
+		for key, limit := range defaults {
+			effective[key] = limit
+		}
+		for key, limit := range overrides[userID] {
+			effective[key] = limit
+		}
+		for key, limit := range effective {
+			if limit.MaxAmount == nil && limit.MaxCount == nil {
+				continue
+			}
+			checker.limits[userID] = append(checker.limits[userID], limit)
+			windows[key.windowSeconds] = true
+		}
+	}
+	if len(windows) == 0 {
+		return checker, nil
+	}
+
+	windowSeconds := make([]int, 0, len(windows))
+	for seconds := range windows {
+		windowSeconds = append(windowSeconds, seconds)
+	}
+	sort.Ints(windowSeconds)
+
+	usage, err := repo.GetLimitUsage(ctx, userIDs, windowSeconds)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range usage {
+		checker.usage[usageKey{u.UserID, limitKey{u.Operation, u.WindowSeconds}}] = u
+	}
+	return checker, nil
+}
+
+// check rejects the operation when it would exceed any of the user's limits
+// and otherwise counts it towards them.
+func (c *limitChecker) check(userID int, operation models.LimitOperation, amount models.Money) error {
+	var matching []models.Limit
+	for _, limit := range c.limits[userID] {
+		if limit.Operation == operation {
+			matching = append(matching, limit)
+		}
+	}
+
+	for _, limit := range matching {
+		used := c.usage[usageKey{userID, limitKey{operation, limit.WindowSeconds}}]
+		amountExceeded := limit.MaxAmount != nil && used.Amount+amount > *limit.MaxAmount
+		countExceeded := limit.MaxCount != nil && used.Count+1 > *limit.MaxCount
+		if !amountExceeded && !countExceeded {
+			continue
+		}
+
+		limitErr := &LimitExceededError{Limit: limit}
+		if limit.MaxAmount != nil {
+			remaining := *limit.MaxAmount - used.Amount
+			if remaining < 0 {
+				remaining = 0
+			}
+			limitErr.RemainingAmount = &remaining
+		}
+		if limit.MaxCount != nil {
+			remaining := *limit.MaxCount - used.Count
+			if remaining < 0 {
+				remaining = 0
+			}
+			limitErr.RemainingCount = &remaining
+		}
+		return limitErr
+	}
+
+	for _, limit := range matching {
+		key := usageKey{userID, limitKey{operation, limit.WindowSeconds}}
+		used := c.usage[key]
+		used.Amount += amount
+		used.Count++
+		c.usage[key] = used
+	}
+	return nil
+}
+
+// checkLimit loads the user's limits and checks a single operation.
+func checkLimit(ctx context.Context, repo repository.Repository, userID int, operation models.LimitOperation, amount models.Money) error {
+	checker, err := loadLimits(ctx, repo, []int{userID})
+	if err != nil {
+		return err
+	}
+	return checker.check(userID, operation, amount)
+}
+
+func (s *service) Limits(ctx context.Context, userID *int) (models.LimitsResponse, error) {
+	var userIDs []int
+	if userID != nil {
+		userIDs = []int{*userID}
+	}
+	limits, err := s.repository.GetLimits(ctx, userIDs)
+	if err != nil {
+		return models.LimitsResponse{}, fmt.Errorf("failed to get limits: %w", err)
+	}
+	return models.LimitsResponse{Limits: limits}, nil
+}
+
+func (s *service) SetLimit(ctx context.Context, limit models.Limit) (models.Limit, error) {
+	if !limit.Operation.Valid() {
+		return models.Limit{}, newValidationError("operation", "must be deposit, transfer or reserve")
+	}
+	if limit.UserID < 0 {
+		return models.Limit{}, newValidationError("user_id", "must not be negative")
+	}
+	if limit.WindowSeconds <= 0 {
+		return models.Limit{}, newValidationError("window_seconds", "must be greater than 0")
+	}
+	if limit.MaxAmount != nil && (*limit.MaxAmount < 0 || !limit.MaxAmount.InRange()) {
+		return models.Limit{}, newValidationError("max_amount", "must not be negative")
+	}
+	if limit.MaxCount != nil && *limit.MaxCount < 0 {
+		return models.Limit{}, newValidationError("max_count", "must not be negative")
+	}
+
+	if err := s.repository.UpsertLimit(ctx, limit); err != nil {
+		return models.Limit{}, fmt.Errorf("failed to save limit: %w", err)
+	}
+	return limit, nil
+}
+
+func (s *service) DeleteLimit(ctx context.Context, limit models.Limit) error {
+	err := s.repository.DeleteLimit(ctx, limit.UserID, limit.Operation, limit.WindowSeconds)
+	if errors.Is(err, repository.ErrNoRows) {
+		return fmt.Errorf("%w: %s per %ds for user %d", ErrLimitNotFound, limit.Operation, limit.WindowSeconds, limit.UserID)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"errors"
+	"internship_backend_2022/internal/models"
+	"testing"
+)
+
+func TestLimitChecker_check(t *testing.T) {
+	maxAmount := models.Money(10000)
+	maxCount := 2
+	checker := &limitChecker{
+		limits: map[int][]models.Limit{
+			1: {
+				{Operation: models.LimitDeposit, WindowSeconds: 86400, MaxAmount: &maxAmount},
+				{Operation: models.LimitReserve, WindowSeconds: 60, MaxCount: &maxCount},
+			},
+		},
+		usage: map[usageKey]models.LimitUsage{
+			{1, limitKey{models.LimitDeposit, 86400}}: {Amount: 7000, Count: 3},
+		},
+	}
+
+	if err := checker.check(1, models.LimitDeposit, 2000); err != nil {
+		t.Fatalf("check() unexpected error = %v", err)
+	}
+
+	err := checker.check(1, models.LimitDeposit, 1500)
+	var limitErr *LimitExceededError
+	if !errors.As(err, &limitErr) || !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("check() error = %v, want LimitExceededError", err)
+	}
+	if limitErr.RemainingAmount == nil || *limitErr.RemainingAmount != 1000 {
+		t.Errorf("RemainingAmount = %v, want 10.00", limitErr.RemainingAmount)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := checker.check(1, models.LimitReserve, 1); err != nil {
+			t.Fatalf("check() reserve %d unexpected error = %v", i, err)
+		}
+	}
+	if err := checker.check(1, models.LimitReserve, 1); !errors.As(err, &limitErr) || *limitErr.RemainingCount != 0 {
+		t.Errorf("check() third reserve error = %v, want count limit", err)
+	}
+
+	if err := checker.check(2, models.LimitDeposit, 1000000); err != nil {
+		t.Errorf("check() user without limits error = %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"time"
+)
+
+var (
+	ErrOrderExists            = errors.New("order already exists")
+	ErrOrderNotFound          = errors.New("order not found")
+	ErrInvalidOrderTransition = errors.New("invalid order status transition")
+)
+
+// CreateOrder reserves every line of the order in one transaction. Each line
+// is held as its own reservation under (service_id, order_id), so /confirm and
+// /unreserve settle lines independently and revenue lands on the line's service.
+func (s *service) CreateOrder(ctx context.Context, orderRequest models.CreateOrderRequest) (models.CreateOrderResponse, error) {
+	total, err := validateOrder(orderRequest)
+	if err != nil {
+		return models.CreateOrderResponse{}, err
+	}
+	now := time.Now()
+
+	var orderResponse models.CreateOrderResponse
+	err = s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "order", orderRequest.IdempotencyKey, orderRequest, &orderResponse)
+		if err != nil || replayed {
+			return err
+		}
+
+		user, err := lockUser(ctx, repo, orderRequest.UserID)
+		if err != nil {
+			return err
+		}
+		if err := ensureCanSpend(user); err != nil {
+			return err
+		}
+		serviceIDs := make([]int, 0, len(orderRequest.Items))
+		for _, line := range orderRequest.Items {
+			serviceIDs = append(serviceIDs, line.ServiceID)
+		}
+		if err := ensureServicesActive(ctx, repo, serviceIDs); err != nil {
+			return err
+		}
+		bonus, err := spendableBonus(ctx, repo, user, now)
+		if err != nil {
+			return err
+		}
+		if user.Balance+bonus < total {
+			return ErrInsufficientFunds
+		}
+
+		// Every line counts as one reservation.
+		limits, err := loadLimits(ctx, repo, []int{orderRequest.UserID})
+		if err != nil {
+			return err
+		}
+		for _, line := range orderRequest.Items {
+			if err := limits.check(orderRequest.UserID, models.LimitReserve, line.Amount); err != nil {
+				return err
+			}
+		}
+
+		order := models.Order{
+			ID:     orderRequest.OrderID,
+			UserID: orderRequest.UserID,
+			Total:  total,
+		}
+		// Lines draw from the buckets in turn, so the priority applies to the
+		// order as a whole.
+		var totalReal, totalBonus models.Money
+		for _, line := range orderRequest.Items {
+			fromReal, fromBonus := s.bonusPriority().Split(line.Amount, user.Balance-totalReal, bonus-totalBonus)
+			totalReal += fromReal
+			totalBonus += fromBonus
+
+			expiresAt := s.reservationExpiry(line.ServiceID, orderRequest.TTLSeconds, now)
+			if _, err := repo.ReserveFunds(ctx, orderRequest.UserID, line.ServiceID, orderRequest.OrderID, line.Amount, fromBonus, expiresAt); err != nil {
+				return fmt.Errorf("failed to reserve funds: %w", err)
+			}
+
+			transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+				UserID:      orderRequest.UserID,
+				ServiceID:   line.ServiceID,
+				OrderID:     orderRequest.OrderID,
+				Amount:      -line.Amount,
+				BonusAmount: -fromBonus,
+				Type:        models.Reserve,
+				Description: "reserve",
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create transaction: %w", err)
+			}
+
+			entry := models.NewBucketJournalEntry(transactionId, "reserve", orderRequest.UserID, models.UserReserved(orderRequest.UserID), -fromReal, -fromBonus)
+			if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+				return fmt.Errorf("failed to create journal entry: %w", err)
+			}
+
+			order.Items = append(order.Items, models.OrderItem{
+				OrderID:       orderRequest.OrderID,
+				UserID:        orderRequest.UserID,
+				ServiceID:     line.ServiceID,
+				Status:        models.OrderReserved,
+				Amount:        line.Amount,
+				Reserved:      line.Amount,
+				TransactionID: transactionId,
+				CreatedAt:     now,
+				UpdatedAt:     now,
+			})
+		}
+
+		created, err := repo.CreateOrder(ctx, order)
+		if err != nil {
+			return err
+		}
+		if !created {
+			return fmt.Errorf("%w: %d of user %d", ErrOrderExists, orderRequest.OrderID, orderRequest.UserID)
+		}
+
+		newBalance, err := repo.UpdateUserBalance(ctx, orderRequest.UserID, -totalReal)
+		if err != nil {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+		if err := spendBonus(ctx, repo, orderRequest.UserID, totalBonus, now); err != nil {
+			return err
+		}
+
+		order.CreatedAt = now
+		orderResponse = models.CreateOrderResponse{
+			Status:  "success",
+			Message: "order reserved successfully",
+			Order:   order,
+			Balance: newBalance,
+		}
+		return storeIdempotentResponse(ctx, repo, orderRequest.IdempotencyKey, orderResponse)
+	})
+	if err != nil {
+		return models.CreateOrderResponse{}, err
+	}
+	return orderResponse, nil
+}
+
+// validateOrder checks the lines and returns the order total.
+func validateOrder(orderRequest models.CreateOrderRequest) (models.Money, error) {
+	if len(orderRequest.Items) == 0 {
+		return 0, newValidationError("items", "must not be empty")
+	}
+	if orderRequest.TTLSeconds < 0 {
+		return 0, newValidationError("ttl_seconds", "must not be negative")
+	}
+
+	var total models.Money
+	services := make(map[int]bool, len(orderRequest.Items))
+	for i, line := range orderRequest.Items {
+		if services[line.ServiceID] {
+			return 0, newValidationError(fmt.Sprintf("items[%d].service_id", i), "duplicate service in order")
+		}
+		services[line.ServiceID] = true
+		if line.Amount <= 0 || !line.Amount.InRange() {
+			return 0, newValidationError(fmt.Sprintf("items[%d].amount", i), "must be greater than 0 and within range")
+		}
+		total += line.Amount
+	}
+	if !total.InRange() {
+		return 0, newValidationError("items", models.ErrAmountRange.Error())
+	}
+	return total, nil
+}
+
+func (s *service) GetOrder(ctx context.Context, userID int, orderID int) (models.Order, error) {
+	order, err := s.repository.GetOrder(ctx, userID, orderID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNoRows) {
+			return models.Order{}, fmt.Errorf("%w: %d of user %d", ErrOrderNotFound, orderID, userID)
+		}
+		return models.Order{}, fmt.Errorf("failed to get order: %w", err)
+	}
+	return order, nil
+}
+
+func (s *service) GetOrderItem(ctx context.Context, serviceID int, orderID int) (models.OrderItemResponse, error) {
+	item, err := s.repository.GetOrderItem(ctx, serviceID, orderID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNoRows) {
+			return models.OrderItemResponse{}, fmt.Errorf("%w: service %d, order %d", ErrOrderNotFound, serviceID, orderID)
+		}
+		return models.OrderItemResponse{}, fmt.Errorf("failed to get order item: %w", err)
+	}
+
+	transactions, err := s.repository.GetOrderTransactions(ctx, item.UserID, serviceID, orderID)
+	if err != nil {
+		return models.OrderItemResponse{}, fmt.Errorf("failed to get order transactions: %w", err)
+	}
+
+	return models.OrderItemResponse{OrderItem: item, Transactions: transactions}, nil
+}
+
+// createOrderLine adds the line of a plain /reserve to the user's order, which
+// makes (service_id, order_id) unique across both endpoints.
+func createOrderLine(ctx context.Context, repo repository.Repository, userID int, serviceID int, orderID int, amount models.Money, transactionID int) error {
+	created, err := repo.AddOrderItem(ctx, userID, orderID, models.OrderItem{
+		ServiceID:     serviceID,
+		Amount:        amount,
+		TransactionID: transactionID,
+	})
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("%w: service %d, order %d", ErrOrderExists, serviceID, orderID)
+	}
+	return nil
+}
+
+// settleOrderItem applies the amounts moved by one operation to the order
+// line and advances its status. The hold of the line must already be locked.
+// Holds made before order lines were tracked have no line and settle without
+// one.
+func settleOrderItem(ctx context.Context, repo repository.Repository, serviceID int, orderID int, expired bool, change func(item *models.OrderItem)) error {
+	item, err := repo.GetOrderItemForUpdate(ctx, serviceID, orderID)
+	if errors.Is(err, repository.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get order item: %w", err)
+	}
+
+	change(&item)
+	next := item.NextStatus(expired)
+	if !item.Status.CanTransitionTo(next) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidOrderTransition, item.Status, next)
+	}
+	item.Status = next
+
+	return repo.UpdateOrderItem(ctx, item)
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestSettleOrderItem_LegacyHold(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM order_items")).
+		WithArgs(1, 5).
+		WillReturnRows(sqlmock.NewRows([]string{"order_id"}))
+
+	changed := false
+	err = settleOrderItem(context.Background(), repository.NewRepository(db), 1, 5, false, func(item *models.OrderItem) {
+		changed = true
+	})
+	if err != nil {
+		t.Fatalf("settleOrderItem() unexpected error = %v", err)
+	}
+	if changed {
+		t.Errorf("settleOrderItem() changed a line that does not exist")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
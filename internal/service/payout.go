@@ -0,0 +1,268 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/payout"
+	"internship_backend_2022/internal/repository"
+)
+
+var ErrPayoutNotFound = errors.New("payout not found")
+
+// payoutBatch bounds how many payouts one ProcessPayouts run handles per state.
+const payoutBatch = 100
+
+func (s *service) Withdraw(ctx context.Context, withdrawRequest models.WithdrawRequest) (models.WithdrawResponse, error) {
+	if err := validateAmount(withdrawRequest.Amount); err != nil {
+		return models.WithdrawResponse{}, err
+	}
+
+	var withdrawResponse models.WithdrawResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "withdraw", withdrawRequest.IdempotencyKey, withdrawRequest, &withdrawResponse)
+		if err != nil || replayed {
+			return err
+		}
+
+		user, err := lockUser(ctx, repo, withdrawRequest.UserID)
+		if err != nil {
+			return err
+		}
+		if err := ensureCanSpend(user); err != nil {
+			return err
+		}
+		if user.Balance < withdrawRequest.Amount {
+			return ErrInsufficientFunds
+		}
+
+		payoutID, transactionId, newBalance, err := createPayout(ctx, repo, withdrawRequest.UserID, withdrawRequest.Amount)
+		if err != nil {
+			return err
+		}
+
+		withdrawResponse = models.WithdrawResponse{
+			Status:        "success",
+			Message:       "withdrawal accepted",
+			Balance:       newBalance,
+			PayoutID:      payoutID,
+			TransactionID: transactionId,
+		}
+		return storeIdempotentResponse(ctx, repo, withdrawRequest.IdempotencyKey, withdrawResponse)
+	})
+	if err != nil {
+		return models.WithdrawResponse{}, err
+	}
+	return withdrawResponse, nil
+}
+
+// createPayout debits amount into a pending payout. The user row must already
+// be locked and hold enough funds.
+func createPayout(ctx context.Context, repo repository.Repository, userID int, amount models.Money) (int, int, models.Money, error) {
+	newBalance, err := repo.UpdateUserBalance(ctx, userID, -amount)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+		UserID:      userID,
+		Amount:      -amount,
+		Type:        models.Withdrawal,
+		Description: "withdrawal",
+	})
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	entry := models.NewJournalEntry(transactionId, "withdrawal", models.UserAvailable(userID), models.PayoutsInTransit, amount)
+	if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	payoutID, err := repo.CreatePayout(ctx, models.Payout{
+		UserID:        userID,
+		Amount:        amount,
+		Status:        models.PayoutPending,
+		TransactionID: transactionId,
+	})
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to create payout: %w", err)
+	}
+
+	return payoutID, transactionId, newBalance, nil
+}
+
+func (s *service) GetPayout(ctx context.Context, payoutID int) (models.Payout, error) {
+	p, err := s.repository.GetPayout(ctx, payoutID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNoRows) {
+			return models.Payout{}, ErrPayoutNotFound
+		}
+		return models.Payout{}, fmt.Errorf("failed to get payout: %w", err)
+	}
+	return p, nil
+}
+
+func (s *service) ProcessPayouts(ctx context.Context) (int, error) {
+	if s.options.PayoutProvider == nil {
+		return 0, nil
+	}
+
+	processed := 0
+	var errs []error
+	for _, step := range []struct {
+		status models.PayoutStatus
+		handle func(ctx context.Context, payoutID int) (bool, error)
+	}{
+		{models.PayoutPending, s.claimPayout},
+		{models.PayoutSending, s.sendPayout},
+		{models.PayoutSent, s.settlePayout},
+	} {
+		payoutIDs, err := s.repository.GetPayoutIDsByStatus(ctx, step.status, payoutBatch)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get %s payouts: %w", step.status, err))
+			continue
+		}
+
+		for _, payoutID := range payoutIDs {
+			changed, err := step.handle(ctx, payoutID)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to process payout %d: %w", payoutID, err))
+				continue
+			}
+			if changed {
+				processed++
+			}
+		}
+	}
+
+	return processed, errors.Join(errs...)
+}
+
+// updatePayout locks the payout and calls change if it is still in status.
+// It reports whether change moved the payout on.
+func (s *service) updatePayout(ctx context.Context, payoutID int, status models.PayoutStatus, change func(repo repository.Repository, p models.Payout) (bool, error)) (bool, error) {
+	changed := false
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		p, err := repo.GetPayoutForUpdate(ctx, payoutID)
+		if err != nil {
+			return fmt.Errorf("failed to get payout: %w", err)
+		}
+		if p.Status != status {
+			return nil
+		}
+		changed, err = change(repo, p)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+// claimPayout commits a pending payout as sending before it is handed to the
+// provider, so a crash after the provider accepted it cannot send it as new.
+func (s *service) claimPayout(ctx context.Context, payoutID int) (bool, error) {
+	return s.updatePayout(ctx, payoutID, models.PayoutPending, func(repo repository.Repository, p models.Payout) (bool, error) {
+		p.Status = models.PayoutSending
+		return true, repo.UpdatePayout(ctx, p)
+	})
+}
+
+// sendPayout hands a sending payout to the provider outside of any database
+// transaction. The idempotency key makes retries after an unknown outcome
+// safe; only a rejection by the provider fails the payout.
+func (s *service) sendPayout(ctx context.Context, payoutID int) (bool, error) {
+	p, err := s.repository.GetPayout(ctx, payoutID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get payout: %w", err)
+	}
+	if p.Status != models.PayoutSending {
+		return false, nil
+	}
+
+	reference, sendErr := s.options.PayoutProvider.Send(ctx, payoutIdempotencyKey(p.ID), p)
+	if sendErr != nil && !errors.Is(sendErr, payout.ErrRejected) {
+		return false, fmt.Errorf("failed to send payout: %w", sendErr)
+	}
+
+	return s.updatePayout(ctx, payoutID, models.PayoutSending, func(repo repository.Repository, p models.Payout) (bool, error) {
+		if sendErr != nil {
+			return true, failPayout(ctx, repo, p, sendErr.Error())
+		}
+		p.Status = models.PayoutSent
+		p.ProviderReference = reference
+		return true, repo.UpdatePayout(ctx, p)
+	})
+}
+
+// payoutIdempotencyKey identifies the payout towards the provider.
+func payoutIdempotencyKey(payoutID int) string {
+	return fmt.Sprintf("payout-%d", payoutID)
+}
+
+// settlePayout asks the provider about a sent payout and books the outcome.
+func (s *service) settlePayout(ctx context.Context, payoutID int) (bool, error) {
+	p, err := s.repository.GetPayout(ctx, payoutID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get payout: %w", err)
+	}
+	if p.Status != models.PayoutSent {
+		return false, nil
+	}
+
+	result, err := s.options.PayoutProvider.Status(ctx, p.ProviderReference)
+	if err != nil {
+		return false, fmt.Errorf("failed to get payout status: %w", err)
+	}
+	if result.Status != models.PayoutCompleted && result.Status != models.PayoutFailed {
+		return false, nil
+	}
+
+	return s.updatePayout(ctx, payoutID, models.PayoutSent, func(repo repository.Repository, p models.Payout) (bool, error) {
+		if result.Status == models.PayoutFailed {
+			return true, failPayout(ctx, repo, p, result.FailureReason)
+		}
+		entry := models.NewJournalEntry(p.TransactionID, "payout completed", models.PayoutsInTransit, models.ExternalFunding, p.Amount)
+		if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+			return false, fmt.Errorf("failed to create journal entry: %w", err)
+		}
+		p.Status = models.PayoutCompleted
+		return true, repo.UpdatePayout(ctx, p)
+	})
+}
+
+// failPayout marks the payout failed and credits the funds back to the user.
+func failPayout(ctx context.Context, repo repository.Repository, p models.Payout, reason string) error {
+	if _, err := lockUser(ctx, repo, p.UserID); err != nil {
+		return err
+	}
+
+	if _, err := repo.UpdateUserBalance(ctx, p.UserID, p.Amount); err != nil {
+		return fmt.Errorf("failed to update user balance: %w", err)
+	}
+
+	description := "payout failed"
+	if reason != "" {
+		description = "payout failed: " + reason
+	}
+	transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+		UserID:      p.UserID,
+		Amount:      p.Amount,
+		Type:        models.PayoutReturn,
+		Description: description,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	entry := models.NewJournalEntry(transactionId, description, models.PayoutsInTransit, models.UserAvailable(p.UserID), p.Amount)
+	if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+		return fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	p.Status = models.PayoutFailed
+	p.FailureReason = reason
+	return repo.UpdatePayout(ctx, p)
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"time"
+)
+
+// Reconcile compares every user's stored balances with the ones derived from
+// the transactions history. With fix set, the history is brought in line with
+// the stored balances by adjustment transactions; users.balance and
+// reserved_funds are what customers see and stay untouched, so no ledger
+// postings are written either. A user that cannot be fixed is reported in the
+// error and does not stop the others.
+func (s *service) Reconcile(ctx context.Context, fix bool) (models.ReconciliationReport, error) {
+	discrepancies, err := s.repository.GetBalanceDiscrepancies(ctx, 0)
+	if err != nil {
+		return models.ReconciliationReport{}, fmt.Errorf("failed to get balance discrepancies: %w", err)
+	}
+
+	report := models.ReconciliationReport{
+		GeneratedAt:   time.Now(),
+		Fix:           fix,
+		Discrepancies: discrepancies,
+	}
+	if !fix {
+		return report, nil
+	}
+
+	var errs []error
+	for _, discrepancy := range discrepancies {
+		var adjustments []models.Transaction
+		err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+			adjustments = nil
+			if _, err := lockUser(ctx, repo, discrepancy.UserID); err != nil {
+				return err
+			}
+
+			// Re-read under the lock so a concurrent fix is not applied twice.
+			current, err := repo.GetBalanceDiscrepancies(ctx, discrepancy.UserID)
+			if err != nil {
+				return fmt.Errorf("failed to get balance discrepancies: %w", err)
+			}
+			if len(current) == 0 {
+				return nil
+			}
+			d := current[0]
+
+			corrections := []struct {
+				diff models.Money
+				kind models.TransactionType
+			}{
+				{d.Balance - d.ExpectedBalance, models.Adjustment},
+				{d.Reserved - d.ExpectedReserved, models.ReservedAdjustment},
+			}
+			for _, correction := range corrections {
+				if correction.diff == 0 {
+					continue
+				}
+				adjustment := models.Transaction{
+					UserID:      d.UserID,
+					Amount:      correction.diff,
+					Type:        correction.kind,
+					Description: "reconciliation adjustment",
+				}
+				adjustment.ID, err = repo.CreateTransaction(ctx, adjustment)
+				if err != nil {
+					return fmt.Errorf("failed to create transaction: %w", err)
+				}
+				adjustments = append(adjustments, adjustment)
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to reconcile user %d: %w", discrepancy.UserID, err))
+			continue
+		}
+		report.Adjustments = append(report.Adjustments, adjustments...)
+	}
+
+	return report, errors.Join(errs...)
+}
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestService_Reconcile_ContinuesAfterFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	svc := NewService(repository.NewRepository(db), Options{})
+	discrepancyColumns := []string{"id", "balance", "expected_balance", "reserved", "expected_reserved"}
+	discrepancies := regexp.QuoteMeta("WITH history AS")
+	lockUser := regexp.QuoteMeta("FROM users WHERE id = $1 FOR UPDATE")
+	lockErr := errors.New("lock timeout")
+
+	mock.ExpectQuery(discrepancies).
+		WithArgs(0).
+		WillReturnRows(sqlmock.NewRows(discrepancyColumns).
+			AddRow(1, "10.00", "5.00", "0.00", "0.00").
+			AddRow(2, "20.00", "15.00", "0.00", "0.00"))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockUser).WithArgs(1).WillReturnError(lockErr)
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockUser).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "balance", "bonus_balance", "debt", "status", "status_reason", "status_changed_at"}).
+			AddRow(2, "20.00", "0.00", "0.00", "active", "", time.Now()))
+	mock.ExpectQuery(discrepancies).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows(discrepancyColumns).
+			AddRow(2, "20.00", "15.00", "0.00", "0.00"))
+	mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO transactions")).
+		ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(9))
+	mock.ExpectCommit()
+
+	report, err := svc.Reconcile(context.Background(), true)
+	if !errors.Is(err, lockErr) {
+		t.Fatalf("Service.Reconcile() error = %v, want %v", err, lockErr)
+	}
+	want := []models.Transaction{{
+		ID:          9,
+		UserID:      2,
+		Amount:      500,
+		Type:        models.Adjustment,
+		Description: "reconciliation adjustment",
+	}}
+	if !reflect.DeepEqual(report.Adjustments, want) {
+		t.Errorf("Service.Reconcile() adjustments = %+v, want %+v", report.Adjustments, want)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+)
+
+var ErrNothingToRefund = errors.New("order has no confirmed revenue left to refund")
+
+func (s *service) Refund(ctx context.Context, refundRequest models.RefundRequest) (models.RefundResponse, error) {
+	if refundRequest.Amount != 0 {
+		if err := validateAmount(refundRequest.Amount); err != nil {
+			return models.RefundResponse{}, err
+		}
+	}
+	description := refundRequest.Reason
+	if description == "" {
+		description = "refund"
+	}
+
+	var refundResponse models.RefundResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "refund", refundRequest.IdempotencyKey, refundRequest, &refundResponse)
+		if err != nil || replayed {
+			return err
+		}
+
+		// The user lock serialises refunds of the same order.
+		user, err := lockUser(ctx, repo, refundRequest.UserID)
+		if err != nil {
+			return err
+		}
+		if err := ensureOpen(user); err != nil {
+			return err
+		}
+
+		confirmTransaction, err := repo.GetLastTransaction(ctx, refundRequest.UserID, refundRequest.ServiceID, refundRequest.OrderID, models.Confirm)
+		if err != nil {
+			if errors.Is(err, repository.ErrNoRows) {
+				return ErrNothingToRefund
+			}
+			return fmt.Errorf("failed to get confirm transaction: %w", err)
+		}
+
+		refundable, err := repo.GetOrderRevenue(ctx, refundRequest.UserID, refundRequest.ServiceID, refundRequest.OrderID)
+		if err != nil {
+			return fmt.Errorf("failed to get order revenue: %w", err)
+		}
+		if refundable <= 0 {
+			return ErrNothingToRefund
+		}
+
+		amount := refundRequest.Amount
+		if amount == 0 {
+			amount = refundable
+		}
+		if amount > refundable {
+			return newValidationError("amount", fmt.Sprintf("exceeds the refundable amount %s", refundable))
+		}
+
+		// Real money is refunded first; bonus comes back only for the part of
+		// the order that was paid with it.
+		orderBonus, err := repo.GetOrderBonus(ctx, refundRequest.UserID, refundRequest.ServiceID, refundRequest.OrderID)
+		if err != nil {
+			return err
+		}
+		realPart := max(min(amount, refundable-orderBonus), 0)
+		bonusPart := amount - realPart
+
+		newBalance, err := repo.UpdateUserBalance(ctx, refundRequest.UserID, realPart)
+		if err != nil {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+		if err := returnBonus(ctx, repo, refundRequest.UserID, bonusPart); err != nil {
+			return err
+		}
+
+		transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+			UserID:               refundRequest.UserID,
+			ServiceID:            refundRequest.ServiceID,
+			OrderID:              refundRequest.OrderID,
+			Amount:               amount,
+			BonusAmount:          bonusPart,
+			Type:                 models.Refund,
+			Description:          description,
+			RelatedTransactionID: confirmTransaction.ID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create transaction: %w", err)
+		}
+
+		entry := models.NewBucketJournalEntry(transactionId, description, refundRequest.UserID, models.CompanyRevenue, realPart, bonusPart)
+		if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+			return fmt.Errorf("failed to create journal entry: %w", err)
+		}
+
+		err = repo.AddRevenueRecord(ctx, refundRequest.UserID, refundRequest.ServiceID, refundRequest.OrderID, -amount)
+		if err != nil {
+			return fmt.Errorf("failed to add revenue record: %w", err)
+		}
+
+		err = settleOrderItem(ctx, repo, refundRequest.ServiceID, refundRequest.OrderID, false, func(item *models.OrderItem) {
+			item.Refunded += amount
+		})
+		if err != nil {
+			return err
+		}
+
+		refundResponse = models.RefundResponse{
+			Status:               "success",
+			Message:              "funds refunded successfully",
+			Balance:              newBalance,
+			Refunded:             amount,
+			RefundedBonus:        bonusPart,
+			Refundable:           refundable - amount,
+			TransactionID:        transactionId,
+			ConfirmTransactionID: confirmTransaction.ID,
+		}
+		return storeIdempotentResponse(ctx, repo, refundRequest.IdempotencyKey, refundResponse)
+	})
+	if err != nil {
+		return models.RefundResponse{}, err
+	}
+	return refundResponse, nil
+}
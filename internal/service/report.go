@@ -0,0 +1,205 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+	"internship_backend_2022/internal/storage"
+	"io"
+	"time"
+)
+
+var (
+	ErrReportNotFound = errors.New("report not found")
+	ErrReportNotReady = errors.New("report not ready")
+	ErrReportExpired  = errors.New("report expired")
+)
+
+// reportBatch bounds how many reports one ProcessReports or CleanupReports
+// run handles.
+const reportBatch = 10
+
+func (s *service) CreateReport(ctx context.Context, request models.MonthlyReportRequest) (models.ReportJob, error) {
+	if request.Year < 1900 {
+		return models.ReportJob{}, newValidationError("year", "must be 1900 or later")
+	}
+	if request.Month < 1 || request.Month > 12 {
+		return models.ReportJob{}, newValidationError("month", "must be between 1 and 12")
+	}
+
+	job, err := s.repository.CreateReportJob(ctx, request.Year, request.Month)
+	if err != nil {
+		return models.ReportJob{}, fmt.Errorf("failed to create report job: %w", err)
+	}
+	return job, nil
+}
+
+func (s *service) GetReport(ctx context.Context, reportID int) (models.ReportJob, error) {
+	job, err := s.repository.GetReportJob(ctx, reportID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNoRows) {
+			return models.ReportJob{}, ErrReportNotFound
+		}
+		return models.ReportJob{}, fmt.Errorf("failed to get report job: %w", err)
+	}
+	return job, nil
+}
+
+func (s *service) OpenReport(ctx context.Context, reportID int) (models.ReportJob, io.ReadCloser, error) {
+	job, err := s.GetReport(ctx, reportID)
+	if err != nil {
+		return models.ReportJob{}, nil, err
+	}
+
+	switch {
+	case job.Status == models.ReportExpired,
+		job.Status == models.ReportCompleted && job.ExpiresAt != nil && !job.ExpiresAt.After(time.Now()):
+		return job, nil, fmt.Errorf("%w: report %d", ErrReportExpired, reportID)
+	case job.Status != models.ReportCompleted || s.options.ReportStorage == nil:
+		return job, nil, fmt.Errorf("%w: report %d is %s", ErrReportNotReady, reportID, job.Status)
+	}
+
+	file, err := s.options.ReportStorage.Open(ctx, job.FileKey)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return job, nil, fmt.Errorf("%w: report %d", ErrReportExpired, reportID)
+		}
+		return job, nil, fmt.Errorf("failed to open report: %w", err)
+	}
+	return job, file, nil
+}
+
+func (s *service) ProcessReports(ctx context.Context) (int, error) {
+	if s.options.ReportStorage == nil {
+		return 0, nil
+	}
+
+	reportIDs, err := s.repository.GetReportJobIDsByStatus(ctx, models.ReportPending, reportBatch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pending reports: %w", err)
+	}
+
+	processed := 0
+	var errs []error
+	for _, reportID := range reportIDs {
+		generated := false
+		err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+			job, err := repo.GetReportJobForUpdate(ctx, reportID)
+			if err != nil {
+				return fmt.Errorf("failed to get report job: %w", err)
+			}
+			if job.Status != models.ReportPending {
+				return nil
+			}
+			generated = true
+			return s.generateReport(ctx, repo, job)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to process report %d: %w", reportID, err))
+			if err := s.failReport(ctx, reportID, err); err != nil {
+				errs = append(errs, fmt.Errorf("failed to mark report %d failed: %w", reportID, err))
+			}
+			continue
+		}
+		if generated {
+			processed++
+		}
+	}
+
+	return processed, errors.Join(errs...)
+}
+
+// failReport marks a pending job failed so that it is not picked up again.
+func (s *service) failReport(ctx context.Context, reportID int, cause error) error {
+	return s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		job, err := repo.GetReportJobForUpdate(ctx, reportID)
+		if err != nil {
+			return fmt.Errorf("failed to get report job: %w", err)
+		}
+		if job.Status != models.ReportPending {
+			return nil
+		}
+		now := time.Now()
+		job.Status = models.ReportFailed
+		job.Error = cause.Error()
+		job.CompletedAt = &now
+		return repo.UpdateReportJob(ctx, job)
+	})
+}
+
+// generateReport writes the report of a pending job to storage. A failure to
+// store the file fails the job instead of retrying it forever.
+func (s *service) generateReport(ctx context.Context, repo repository.Repository, job models.ReportJob) error {
+	var content bytes.Buffer
+	if err := writeMonthlyReport(ctx, repo, &content, job.Year, job.Month); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	job.CompletedAt = &now
+	key := fmt.Sprintf("report-%d.csv", job.ID)
+	if err := s.options.ReportStorage.Put(ctx, key, &content); err != nil {
+		job.Status = models.ReportFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = models.ReportCompleted
+		job.FileKey = key
+		if s.options.ReportTTL > 0 {
+			expiresAt := now.Add(s.options.ReportTTL)
+			job.ExpiresAt = &expiresAt
+		}
+	}
+
+	if err := repo.UpdateReportJob(ctx, job); err != nil {
+		if job.FileKey != "" {
+			_ = s.options.ReportStorage.Delete(ctx, job.FileKey)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *service) CleanupReports(ctx context.Context) (int, error) {
+	if s.options.ReportStorage == nil {
+		return 0, nil
+	}
+
+	reportIDs, err := s.repository.GetExpiredReportJobIDs(ctx, time.Now(), reportBatch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get expired reports: %w", err)
+	}
+
+	removed := 0
+	var errs []error
+	for _, reportID := range reportIDs {
+		expired := false
+		err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+			job, err := repo.GetReportJobForUpdate(ctx, reportID)
+			if err != nil {
+				return fmt.Errorf("failed to get report job: %w", err)
+			}
+			if job.Status != models.ReportCompleted {
+				return nil
+			}
+			if err := s.options.ReportStorage.Delete(ctx, job.FileKey); err != nil {
+				return fmt.Errorf("failed to delete report file: %w", err)
+			}
+			job.Status = models.ReportExpired
+			job.FileKey = ""
+			expired = true
+			return repo.UpdateReportJob(ctx, job)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to clean up report %d: %w", reportID, err))
+			continue
+		}
+		if expired {
+			removed++
+		}
+	}
+
+	return removed, errors.Join(errs...)
+}
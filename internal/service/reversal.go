@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/repository"
+)
+
+var (
+	ErrDepositNotFound        = errors.New("deposit not found")
+	ErrDepositAlreadyReversed = errors.New("deposit already reversed")
+)
+
+// ReverseDeposit takes back a deposit, e.g. after a chargeback. The balance
+// is debited as far as it goes and the rest becomes debt, so the reversal
+// never fails for lack of funds. Frozen and closed accounts are reversed too.
+func (s *service) ReverseDeposit(ctx context.Context, request models.DepositReversalRequest) (models.DepositReversalResponse, error) {
+	description := request.Reason
+	if description == "" {
+		description = "deposit reversal"
+	}
+
+	var response models.DepositReversalResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "reverse_deposit", request.IdempotencyKey, request, &response)
+		if err != nil || replayed {
+			return err
+		}
+
+		deposit, err := repo.GetTransaction(ctx, request.DepositID)
+		if errors.Is(err, repository.ErrNoRows) || (err == nil && deposit.Type != models.Deposit) {
+			return fmt.Errorf("%w: %d", ErrDepositNotFound, request.DepositID)
+		}
+		if err != nil {
+			return err
+		}
+
+		// The user lock serialises reversals of the same deposit.
+		user, err := lockUser(ctx, repo, deposit.UserID)
+		if err != nil {
+			return err
+		}
+		reversalID, err := repo.GetDepositReversal(ctx, deposit.ID)
+		if err == nil {
+			return fmt.Errorf("%w: %d by transaction %d", ErrDepositAlreadyReversed, deposit.ID, reversalID)
+		}
+		if !errors.Is(err, repository.ErrNoRows) {
+			return err
+		}
+
+		transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+			UserID:               user.ID,
+			Amount:               -deposit.Amount,
+			Type:                 models.DepositReversal,
+			Description:          description,
+			RelatedTransactionID: deposit.ID,
+			ExternalPaymentID:    deposit.ExternalPaymentID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create transaction: %w", err)
+		}
+
+		entry := models.NewJournalEntry(transactionId, description, models.UserAvailable(user.ID), models.ExternalFunding, deposit.Amount)
+		if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+			return fmt.Errorf("failed to create journal entry: %w", err)
+		}
+
+		covered := min(deposit.Amount, user.Balance)
+		newBalance, err := repo.UpdateUserBalance(ctx, user.ID, -covered)
+		if err != nil {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+
+		debt := user.Debt
+		var debtTransactionId int
+		if shortfall := deposit.Amount - covered; shortfall > 0 {
+			debtTransactionId, err = repo.CreateTransaction(ctx, models.Transaction{
+				UserID:               user.ID,
+				Amount:               shortfall,
+				Type:                 models.Debt,
+				Description:          "reversal not covered by balance",
+				RelatedTransactionID: transactionId,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create transaction: %w", err)
+			}
+
+			entry := models.NewJournalEntry(debtTransactionId, "reversal not covered by balance", models.UserDebt(user.ID), models.UserAvailable(user.ID), shortfall)
+			if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+				return fmt.Errorf("failed to create journal entry: %w", err)
+			}
+
+			if debt, err = repo.UpdateUserDebt(ctx, user.ID, shortfall); err != nil {
+				return err
+			}
+		}
+
+		response = models.DepositReversalResponse{
+			Status:               "success",
+			Message:              "deposit reversed",
+			Balance:              newBalance,
+			Debt:                 debt,
+			Reversed:             deposit.Amount,
+			TransactionID:        transactionId,
+			DebtTransactionID:    debtTransactionId,
+			DepositTransactionID: deposit.ID,
+		}
+		return storeIdempotentResponse(ctx, repo, request.IdempotencyKey, response)
+	})
+	if err != nil {
+		return models.DepositReversalResponse{}, err
+	}
+	return response, nil
+}
+
+// repayDebt books amount of the deposit depositID towards the locked user's
+// debt. The caller credits the balance with the rest of the deposit only.
+func repayDebt(ctx context.Context, repo repository.Repository, userID int, depositID int, amount models.Money) error {
+	if amount == 0 {
+		return nil
+	}
+
+	transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+		UserID:               userID,
+		Amount:               -amount,
+		Type:                 models.DebtRepayment,
+		Description:          "debt repayment",
+		RelatedTransactionID: depositID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create transaction: %w", err)
+	}
+
+	entry := models.NewJournalEntry(transactionId, "debt repayment", models.UserAvailable(userID), models.UserDebt(userID), amount)
+	if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+		return fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	_, err = repo.UpdateUserDebt(ctx, userID, -amount)
+	return err
+}
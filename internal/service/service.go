@@ -1,318 +1,1063 @@
 package service
 
 import (
+	"bytes"
 	"context"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"internship_backend_2022/internal/models"
+	"internship_backend_2022/internal/payout"
 	"internship_backend_2022/internal/repository"
-	"math/big"
-	"os"
-	"strconv"
+	"internship_backend_2022/internal/storage"
+	"io"
+	"sort"
+	"time"
 )
 
 type Service interface {
-	Deposit(ctx context.Context,request models.DepositRequest) (models.DepositResponse, error)
-	GetUserBalance(ctx context.Context,userID int) (models.BalanceResponse,error)
+	// Deposit, Reserve, Transfer, CreateOrder and Batch enforce the velocity
+	// limits and fail with a *LimitExceededError.
+	Deposit(ctx context.Context, request models.DepositRequest) (models.DepositResponse, error)
+	// BillingDeposit credits a payment reported by the billing webhook once
+	// per external payment id.
+	BillingDeposit(ctx context.Context, request models.BillingDepositRequest) (models.DepositResponse, error)
+	// ReverseDeposit debits a deposit back, turning what the balance cannot
+	// cover into debt that later deposits repay.
+	ReverseDeposit(ctx context.Context, request models.DepositReversalRequest) (models.DepositReversalResponse, error)
+	GetUserBalance(ctx context.Context, userID int) (models.BalanceResponse, error)
+	// GetUserBalanceAt returns the balances as they were at the given moment.
+	GetUserBalanceAt(ctx context.Context, userID int, at time.Time) (models.BalanceResponse, error)
 	Reserve(ctx context.Context, request models.ReserveRequest) (models.ReserveResponse, error)
-	Confirm(ctx context.Context,request models.ConfirmRequest) (models.ConfirmResponse, error)
-	Transfer(ctx context.Context,request models.TransferRequest) (models.TransferResponse,error)
-	MonthlyReport(ctx context.Context,MonthlyReportRequest models.MonthlyReportRequest) (models.MonthlyReportResponse, error)
-	Transactions(ctx context.Context, request models.TransactionRequest) (models.TransactionsResponse,error)
+	// Confirm and Transfer charge the payer the fee of the matching fee rule
+	// on top of the amount.
+	Confirm(ctx context.Context, request models.ConfirmRequest) (models.ConfirmResponse, error)
+	Unreserve(ctx context.Context, request models.UnreserveRequest) (models.UnreserveResponse, error)
+	Captures(ctx context.Context, serviceID int, orderID int) (models.CapturesResponse, error)
+	Refund(ctx context.Context, request models.RefundRequest) (models.RefundResponse, error)
+	Transfer(ctx context.Context, request models.TransferRequest) (models.TransferResponse, error)
+	MonthlyReport(ctx context.Context, MonthlyReportRequest models.MonthlyReportRequest) (models.MonthlyReportResponse, error)
+	// CreateReport queues a monthly report that ProcessReports generates in
+	// the background.
+	CreateReport(ctx context.Context, request models.MonthlyReportRequest) (models.ReportJob, error)
+	GetReport(ctx context.Context, reportID int) (models.ReportJob, error)
+	// OpenReport returns the stored file of a completed report. The caller
+	// closes it.
+	OpenReport(ctx context.Context, reportID int) (models.ReportJob, io.ReadCloser, error)
+	// ProcessReports generates pending reports and returns how many finished.
+	// A report that cannot be generated is marked failed.
+	ProcessReports(ctx context.Context) (int, error)
+	// CleanupReports deletes the files of expired reports and returns how
+	// many were removed.
+	CleanupReports(ctx context.Context) (int, error)
+	Transactions(ctx context.Context, request models.TransactionRequest) (models.TransactionsResponse, error)
+	// VerifyLedger checks that every journal entry balances and that stored
+	// balances match the balances derived from the ledger.
+	VerifyLedger(ctx context.Context) (models.LedgerReport, error)
+	// Reconcile reports users whose balances drift from their transactions
+	// and, when fix is set, writes correcting adjustment transactions.
+	Reconcile(ctx context.Context, fix bool) (models.ReconciliationReport, error)
+	// Reservations lists holds with their age so stuck ones can be found.
+	Reservations(ctx context.Context, filter models.ReservationFilter) (models.ReservationsResponse, error)
+	ExtendReservation(ctx context.Context, request models.ExtendReservationRequest) (models.ExtendReservationResponse, error)
+	// ReleaseExpiredReservations returns expired holds to their users' balances
+	// and reports how many holds were released. An order that fails is
+	// reported in the error and does not stop the others.
+	ReleaseExpiredReservations(ctx context.Context) (int, error)
+	GrantBonus(ctx context.Context, request models.BonusGrantRequest) (models.BonusGrantResponse, error)
+	// ExpireBonuses forfeits the credit left in expired bonus grants and
+	// returns how many users lost some.
+	ExpireBonuses(ctx context.Context) (int, error)
+	Withdraw(ctx context.Context, request models.WithdrawRequest) (models.WithdrawResponse, error)
+	GetPayout(ctx context.Context, payoutID int) (models.Payout, error)
+	// ProcessPayouts sends pending payouts to the provider and settles sent ones,
+	// returning how many payouts changed state.
+	ProcessPayouts(ctx context.Context) (int, error)
+	FreezeAccount(ctx context.Context, request models.AccountStatusRequest) (models.AccountStatusResponse, error)
+	UnfreezeAccount(ctx context.Context, request models.AccountStatusRequest) (models.AccountStatusResponse, error)
+	// CloseAccount requires a zero balance and no open reservations unless
+	// ForcePayout is set, in which case the balance is withdrawn first.
+	CloseAccount(ctx context.Context, request models.AccountStatusRequest) (models.AccountStatusResponse, error)
+	// Batch applies deposits, transfers and reserves in one database
+	// transaction. Atomic batches with failed items return a *BatchError.
+	Batch(ctx context.Context, batchRequest models.BatchRequest) (models.BatchResponse, error)
+	CreateOrder(ctx context.Context, orderRequest models.CreateOrderRequest) (models.CreateOrderResponse, error)
+	// GetOrder returns an order of the user; order ids are scoped to the user
+	// who created the order.
+	GetOrder(ctx context.Context, userID int, orderID int) (models.Order, error)
+	// GetOrderItem returns the state of one (service_id, order_id) line with
+	// its transactions.
+	GetOrderItem(ctx context.Context, serviceID int, orderID int) (models.OrderItemResponse, error)
+	// Limits lists the global limits and, for a non-nil userID, that user's
+	// overrides; nil lists every limit.
+	Limits(ctx context.Context, userID *int) (models.LimitsResponse, error)
+	SetLimit(ctx context.Context, limit models.Limit) (models.Limit, error)
+	DeleteLimit(ctx context.Context, limit models.Limit) error
+	FeeRules(ctx context.Context) (models.FeeRulesResponse, error)
+	SetFeeRule(ctx context.Context, rule models.FeeRule) (models.FeeRule, error)
+	DeleteFeeRule(ctx context.Context, operation models.FeeOperation, serviceID int) error
+	// Reserve, CreateOrder and Batch accept only services of the catalog that
+	// are active. Confirm settles existing holds of deactivated services too.
+	Services(ctx context.Context) (models.ServicesResponse, error)
+	GetService(ctx context.Context, serviceID int) (models.Service, error)
+	CreateService(ctx context.Context, service models.Service) (models.Service, error)
+	UpdateService(ctx context.Context, service models.Service) (models.Service, error)
+	DeleteService(ctx context.Context, serviceID int) error
+}
+
+// Options configures optional service behaviour.
+type Options struct {
+	// DefaultReservationTTL is the lifetime of a hold when neither the request
+	// nor ServiceReservationTTLs sets one. Zero means holds never expire.
+	DefaultReservationTTL  time.Duration
+	ServiceReservationTTLs map[int]time.Duration
+	// PayoutProvider sends withdrawals out of the system.
+	PayoutProvider payout.Provider
+	// BonusPriority decides whether reservations spend bonus or real money
+	// first; it defaults to models.BonusFirst.
+	BonusPriority models.BonusPriority
+	// ReportStorage keeps generated report files; nil disables report jobs.
+	ReportStorage storage.Storage
+	// ReportTTL is how long a generated report can be downloaded. Zero keeps
+	// reports forever.
+	ReportTTL time.Duration
 }
 
 type service struct {
 	repository repository.Repository
+	options    Options
 }
 
-func NewService(repository repository.Repository) Service {
+func NewService(repository repository.Repository, options Options) Service {
 	return &service{
 		repository: repository,
+		options:    options,
 	}
 }
 
 func (s *service) Deposit(ctx context.Context, depositRequest models.DepositRequest) (models.DepositResponse, error) {
-	fmt.Println(depositRequest)
-	if depositRequest.Amount == nil {
-        return models.DepositResponse{}, errors.New("amount is required")
-    }
-
-    if depositRequest.Amount.Cmp(big.NewFloat(0)) <= 0 {
-        return models.DepositResponse{}, errors.New("amount must be greater than 0")
-    }
-	fmt.Println(depositRequest)
-	_, err := s.repository.GetUserBalance(ctx, depositRequest.UserID)
-	if err != nil {
-		if errors.Is(err, repository.ErrNoRows) {
-			err = s.repository.CreateUser(ctx, depositRequest.UserID)
-			if err != nil {
-				return models.DepositResponse{}, fmt.Errorf("failed to create user: %w", err)
-			}
-		} else {
-			return models.DepositResponse{}, fmt.Errorf("failed to get user balance: %w", err)
+	if err := validateAmount(depositRequest.Amount); err != nil {
+		return models.DepositResponse{}, err
+	}
+
+	var depositResponse models.DepositResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "deposit", depositRequest.IdempotencyKey, depositRequest, &depositResponse)
+		if err != nil || replayed {
+			return err
 		}
+
+		user, err := lockOrCreateUser(ctx, repo, depositRequest.UserID)
+		if err != nil {
+			return err
+		}
+		depositResponse, err = deposit(ctx, repo, user, depositRequest.Amount, "")
+		if err != nil {
+			return err
+		}
+		return storeIdempotentResponse(ctx, repo, depositRequest.IdempotencyKey, depositResponse)
+	})
+	if err != nil {
+		return models.DepositResponse{}, err
 	}
+	return depositResponse, nil
+}
 
-	transactionId, err := s.repository.CreateTransaction(
-		ctx,
-		depositRequest.UserID,
-		0,
-		0,
-		depositRequest.Amount,
-		models.Deposit,
-		"deposit",
-	)
+// lockOrCreateUser locks the user, creating the account on its first deposit.
+func lockOrCreateUser(ctx context.Context, repo repository.Repository, userID int) (models.User, error) {
+	user, err := repo.GetUserForUpdate(ctx, userID)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, repository.ErrNoRows) {
+		return models.User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	if err := repo.CreateUser(ctx, userID); err != nil {
+		return models.User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+	return lockUser(ctx, repo, userID)
+}
+
+// deposit credits amount from outside the system to the locked user and
+// repays the user's debt from it first. externalPaymentID is the billing
+// reference, empty for direct deposits.
+func deposit(ctx context.Context, repo repository.Repository, user models.User, amount models.Money, externalPaymentID string) (models.DepositResponse, error) {
+	if err := ensureOpen(user); err != nil {
+		return models.DepositResponse{}, err
+	}
+	if err := checkLimit(ctx, repo, user.ID, models.LimitDeposit, amount); err != nil {
+		return models.DepositResponse{}, err
+	}
+
+	transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+		UserID:            user.ID,
+		Amount:            amount,
+		Type:              models.Deposit,
+		Description:       "deposit",
+		ExternalPaymentID: externalPaymentID,
+	})
 	if err != nil {
 		return models.DepositResponse{}, fmt.Errorf("failed to create transaction: %w", err)
 	}
 
-	newBalance, err := s.repository.UpdateUserBalance(ctx, depositRequest.UserID, depositRequest.Amount)
+	entry := models.NewJournalEntry(transactionId, "deposit", models.ExternalFunding, models.UserAvailable(user.ID), amount)
+	if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+		return models.DepositResponse{}, fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	repaid := min(amount, user.Debt)
+	if err := repayDebt(ctx, repo, user.ID, transactionId, repaid); err != nil {
+		return models.DepositResponse{}, err
+	}
+
+	newBalance, err := repo.UpdateUserBalance(ctx, user.ID, amount-repaid)
 	if err != nil {
 		return models.DepositResponse{}, fmt.Errorf("failed to update user balance: %w", err)
 	}
 
-	depositResponse := models.DepositResponse{
-		Status:        "success",
-		Message:       "funds deposited successfully",
-		Balance:       newBalance,
-		TransactionID: transactionId,
-	}
-	return depositResponse, nil
+	return models.DepositResponse{
+		Status:            "success",
+		Message:           "funds deposited successfully",
+		Balance:           newBalance,
+		TransactionID:     transactionId,
+		ExternalPaymentID: externalPaymentID,
+		DebtRepaid:        repaid,
+		Debt:              user.Debt - repaid,
+	}, nil
 }
 
 func (s *service) GetUserBalance(ctx context.Context, userID int) (models.BalanceResponse, error) {
 
-	balance,err := s.repository.GetUserBalance(ctx, userID)
+	balance, err := s.repository.GetUserBalance(ctx, userID)
 	if err != nil {
+		if errors.Is(err, repository.ErrNoRows) {
+			return models.BalanceResponse{}, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+		}
 		return models.BalanceResponse{}, fmt.Errorf("failed to get user balance: %w", err)
 	}
 
-	reserved,err := s.repository.GetUserReservedFunds(ctx, userID)
+	bonus, err := s.repository.GetUserBonusBalance(ctx, userID)
+	if err != nil {
+		return models.BalanceResponse{}, fmt.Errorf("failed to get user bonus balance: %w", err)
+	}
+
+	debt, err := s.repository.GetUserDebt(ctx, userID)
+	if err != nil {
+		return models.BalanceResponse{}, err
+	}
+
+	reserved, err := s.repository.GetUserReservedFunds(ctx, userID)
 	if err != nil {
 		return models.BalanceResponse{}, fmt.Errorf("failed to get user reserved funds: %w", err)
 	}
 
-	return models.BalanceResponse{Balance: balance, Reserved: reserved},nil 
+	return models.BalanceResponse{Balance: balance, Bonus: bonus, Debt: debt, Reserved: reserved}, nil
 }
 
-func (s *service) Reserve (ctx context.Context, reserveRequest models.ReserveRequest) (models.ReserveResponse, error) {
-	if reserveRequest.Amount == nil {
-        return models.ReserveResponse{}, errors.New("amount is required")
-    }
+func (s *service) GetUserBalanceAt(ctx context.Context, userID int, at time.Time) (models.BalanceResponse, error) {
+	available, bonus, reserved, createdAt, err := s.repository.GetUserBalanceAt(ctx, userID, at)
+	if err != nil {
+		if errors.Is(err, repository.ErrNoRows) {
+			return models.BalanceResponse{}, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+		}
+		return models.BalanceResponse{}, fmt.Errorf("failed to get user balance: %w", err)
+	}
+	if at.Before(createdAt) {
+		return models.BalanceResponse{}, newValidationError("at", fmt.Sprintf("is before the user was created at %s", createdAt.Format(time.RFC3339)))
+	}
 
-    if reserveRequest.Amount.Cmp(big.NewFloat(0)) <= 0 {
-        return models.ReserveResponse{}, errors.New("amount must be greater than 0")
-    }
+	return models.BalanceResponse{Balance: available, Bonus: bonus, Reserved: reserved, At: &at}, nil
+}
 
-	userBalance,err := s.repository.GetUserBalance(ctx,reserveRequest.UserID) 
-	if err != nil {
-		return models.ReserveResponse{}, fmt.Errorf("failed to get user balance: %w", err)
+func (s *service) Reserve(ctx context.Context, reserveRequest models.ReserveRequest) (models.ReserveResponse, error) {
+	if err := validateAmount(reserveRequest.Amount); err != nil {
+		return models.ReserveResponse{}, err
+	}
+	if reserveRequest.TTLSeconds < 0 {
+		return models.ReserveResponse{}, newValidationError("ttl_seconds", "must not be negative")
 	}
+	now := time.Now()
+	expiresAt := s.reservationExpiry(reserveRequest.ServiceID, reserveRequest.TTLSeconds, now)
+
+	var reserveResponse models.ReserveResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "reserve", reserveRequest.IdempotencyKey, reserveRequest, &reserveResponse)
+		if err != nil || replayed {
+			return err
+		}
+
+		user, err := lockUser(ctx, repo, reserveRequest.UserID)
+		if err != nil {
+			return err
+		}
+		if err := ensureCanSpend(user); err != nil {
+			return err
+		}
+		if err := ensureServiceActive(ctx, repo, reserveRequest.ServiceID); err != nil {
+			return err
+		}
+		if err := checkLimit(ctx, repo, reserveRequest.UserID, models.LimitReserve, reserveRequest.Amount); err != nil {
+			return err
+		}
+
+		bonus, err := spendableBonus(ctx, repo, user, now)
+		if err != nil {
+			return err
+		}
+		if user.Balance+bonus < reserveRequest.Amount {
+			return ErrInsufficientFunds
+		}
+		fromReal, fromBonus := s.bonusPriority().Split(reserveRequest.Amount, user.Balance, bonus)
+
+		_, err = repo.ReserveFunds(ctx, reserveRequest.UserID, reserveRequest.ServiceID, reserveRequest.OrderID, reserveRequest.Amount, fromBonus, expiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to reserve funds: %w", err)
+		}
+
+		newUserBalance, err := repo.UpdateUserBalance(ctx, reserveRequest.UserID, -fromReal)
+		if err != nil {
+			return fmt.Errorf("failed to update user balance: %w", err)
+		}
+		if err := spendBonus(ctx, repo, reserveRequest.UserID, fromBonus, now); err != nil {
+			return err
+		}
 
-	if userBalance.Cmp(reserveRequest.Amount) < 0 {
-        return models.ReserveResponse{}, errors.New("insufficient funds")
-    }
+		transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+			UserID:      reserveRequest.UserID,
+			ServiceID:   reserveRequest.ServiceID,
+			OrderID:     reserveRequest.OrderID,
+			Amount:      -reserveRequest.Amount,
+			BonusAmount: -fromBonus,
+			Type:        models.Reserve,
+			Description: "reserve",
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create transaction: %w", err)
+		}
+
+		entry := models.NewBucketJournalEntry(transactionId, "reserve", reserveRequest.UserID, models.UserReserved(reserveRequest.UserID), -fromReal, -fromBonus)
+		if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+			return fmt.Errorf("failed to create journal entry: %w", err)
+		}
+
+		if err := createOrderLine(ctx, repo, reserveRequest.UserID, reserveRequest.ServiceID, reserveRequest.OrderID, reserveRequest.Amount, transactionId); err != nil {
+			return err
+		}
 
-	reservedId,err := s.repository.ReserveFunds(ctx,reserveRequest.UserID,reserveRequest.ServiceID,reserveRequest.OrderID,reserveRequest.Amount)
+		reserveResponse = models.ReserveResponse{
+			Status:        "success",
+			Message:       "funds reserved successfully",
+			Balance:       newUserBalance,
+			Bonus:         bonus - fromBonus,
+			Reserved:      reserveRequest.Amount,
+			ReservedBonus: fromBonus,
+			TransactionID: transactionId,
+			ExpiresAt:     expiresAt,
+		}
+		return storeIdempotentResponse(ctx, repo, reserveRequest.IdempotencyKey, reserveResponse)
+	})
 	if err != nil {
-		return models.ReserveResponse{}, fmt.Errorf("failed to reserve funds: %w", err)
+		return models.ReserveResponse{}, err
 	}
+	return reserveResponse, nil
+}
 
-	NewUserBalance,err := s.repository.UpdateUserBalance(ctx,reserveRequest.UserID,new(big.Float).Neg(reserveRequest.Amount))
-	if err != nil {
-		if err := s.repository.DeleteReservation(ctx, reservedId); err != nil {
-            return models.ReserveResponse{}, fmt.Errorf("failed to rollback reservation after balance update error: %w", err)
-        }
-        return models.ReserveResponse{}, fmt.Errorf("failed to update user balance: %w", err)
-	}
-
-	transactionId, err := s.repository.CreateTransaction(
-		ctx,
-		reserveRequest.UserID,
-		reserveRequest.ServiceID,
-		reserveRequest.OrderID,
-		new(big.Float).Neg(reserveRequest.Amount),
-		models.Reserve,
-		"reserve",
-	)
-	
+func (s *service) Confirm(ctx context.Context, confirmRequest models.ConfirmRequest) (models.ConfirmResponse, error) {
+	if err := validateAmount(confirmRequest.Amount); err != nil {
+		return models.ConfirmResponse{}, err
+	}
+
+	var confirmResponse models.ConfirmResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "confirm", confirmRequest.IdempotencyKey, confirmRequest, &confirmResponse)
+		if err != nil || replayed {
+			return err
+		}
+
+		user, err := lockUser(ctx, repo, confirmRequest.UserID)
+		if err != nil {
+			return err
+		}
+		if err := ensureOpen(user); err != nil {
+			return err
+		}
+
+		reservations, err := repo.GetReservationsForUpdate(ctx, confirmRequest.UserID, confirmRequest.ServiceID, confirmRequest.OrderID)
+		if err != nil {
+			return fmt.Errorf("failed to get reservations: %w", err)
+		}
+		if len(reservations) == 0 {
+			return ErrReservationNotFound
+		}
+		active := activeReservations(reservations, time.Now())
+		if len(active) == 0 {
+			return ErrReservationExpired
+		}
+
+		// The commission comes out of the available balance, not the hold.
+		fee, err := feeFor(ctx, repo, models.FeeConfirm, confirmRequest.ServiceID, confirmRequest.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to get commission: %w", err)
+		}
+		if user.Balance < fee {
+			return ErrInsufficientFunds
+		}
+
+		remaining, capturedBonus, err := captureReservations(ctx, repo, active, confirmRequest.Amount, s.bonusPriority())
+		if err != nil {
+			return err
+		}
+
+		// BonusAmount records how much of the capture was bonus so a refund
+		// can return it to the bonus balance.
+		confirmTransaction := models.Transaction{
+			UserID:      confirmRequest.UserID,
+			ServiceID:   confirmRequest.ServiceID,
+			OrderID:     confirmRequest.OrderID,
+			Amount:      -confirmRequest.Amount,
+			BonusAmount: -capturedBonus,
+			Type:        models.Confirm,
+			Description: "confirm",
+		}
+		transactionId, err := repo.CreateTransaction(ctx, confirmTransaction)
+		if err != nil {
+			return fmt.Errorf("failed to create transaction: %w", err)
+		}
+
+		entry := models.NewJournalEntry(transactionId, "confirm", models.UserReserved(confirmRequest.UserID), models.CompanyRevenue, confirmRequest.Amount)
+		if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+			return fmt.Errorf("failed to create journal entry: %w", err)
+		}
+
+		err = repo.AddRevenueRecord(ctx, confirmRequest.UserID, confirmRequest.ServiceID, confirmRequest.OrderID, confirmRequest.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to add revenue record: %w", err)
+		}
+
+		_, err = repo.CreateCapture(ctx, models.Capture{
+			UserID:        confirmRequest.UserID,
+			ServiceID:     confirmRequest.ServiceID,
+			OrderID:       confirmRequest.OrderID,
+			Amount:        confirmRequest.Amount,
+			TransactionID: transactionId,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create capture: %w", err)
+		}
+
+		err = settleOrderItem(ctx, repo, confirmRequest.ServiceID, confirmRequest.OrderID, false, func(item *models.OrderItem) {
+			item.Captured += confirmRequest.Amount
+		})
+		if err != nil {
+			return err
+		}
+
+		var feeTransactionId int
+		if fee > 0 {
+			confirmTransaction.ID = transactionId
+			if feeTransactionId, err = chargeFee(ctx, repo, confirmTransaction, fee, "service commission"); err != nil {
+				return err
+			}
+		}
+
+		var released models.Money
+		if confirmRequest.ReleaseRemainder && remaining > 0 {
+			released, _, _, err = releaseReservations(ctx, repo, confirmRequest.UserID, confirmRequest.ServiceID, confirmRequest.OrderID, "remainder released after confirm")
+			if err != nil {
+				return err
+			}
+			remaining = 0
+		}
+
+		confirmResponse = models.ConfirmResponse{
+			Status:           "success",
+			Message:          "funds confirmed successfully",
+			TransactionID:    transactionId,
+			Captured:         confirmRequest.Amount,
+			Remaining:        remaining,
+			Released:         released,
+			Fee:              fee,
+			FeeTransactionID: feeTransactionId,
+		}
+		return storeIdempotentResponse(ctx, repo, confirmRequest.IdempotencyKey, confirmResponse)
+	})
 	if err != nil {
-		return models.ReserveResponse{}, fmt.Errorf("failed to create transaction: %w", err)
+		return models.ConfirmResponse{}, err
 	}
+	return confirmResponse, nil
+}
 
-	fmt.Println(transactionId,NewUserBalance,reservedId)
+// activeReservations drops holds that expired but were not swept yet.
+func activeReservations(reservations []models.Reservation, now time.Time) []models.Reservation {
+	var active []models.Reservation
+	for _, res := range reservations {
+		if !res.Expired(now) {
+			active = append(active, res)
+		}
+	}
+	return active
+}
 
-	ReserveResponse := models.ReserveResponse{
-		Status:        "success",
-		Message:       "funds reserved successfully",
-		Balance:       NewUserBalance,
-		Reserved:      reserveRequest.Amount,
-		TransactionID: transactionId,
+// captureReservations takes amount out of the locked holds, oldest first, and
+// returns what is still held afterwards and how much of the capture was bonus.
+// Within a hold the buckets are captured in priority order.
+func captureReservations(ctx context.Context, repo repository.Repository, reservations []models.Reservation, amount models.Money, priority models.BonusPriority) (models.Money, models.Money, error) {
+	var held models.Money
+	for _, res := range reservations {
+		held += res.Amount
+	}
+	if amount > held {
+		return 0, 0, newValidationError("amount", fmt.Sprintf("exceeds the reserved amount %s", held))
+	}
+
+	left := amount
+	var capturedBonus models.Money
+	for _, res := range reservations {
+		if left == 0 {
+			break
+		}
+		take := res.Amount
+		if take > left {
+			take = left
+		}
+		_, takeBonus := priority.Split(take, res.Amount-res.BonusAmount, res.BonusAmount)
+		if take == res.Amount {
+			if err := repo.DeleteReservation(ctx, res.ID); err != nil {
+				return 0, 0, fmt.Errorf("failed to delete reservation: %w", err)
+			}
+		} else {
+			if err := repo.UpdateReservationAmount(ctx, res.ID, res.Amount-take, res.BonusAmount-takeBonus); err != nil {
+				return 0, 0, fmt.Errorf("failed to update reservation: %w", err)
+			}
+		}
+		left -= take
+		capturedBonus += takeBonus
 	}
-	return ReserveResponse, nil
+
+	return held - amount, capturedBonus, nil
 }
 
-func (s *service) Confirm (ctx context.Context, ConfirmRequest models.ConfirmRequest) (models.ConfirmResponse,error) {
-	if ConfirmRequest.Amount == nil {
-        return models.ConfirmResponse{}, errors.New("amount is required")
-    }
+func (s *service) Unreserve(ctx context.Context, unreserveRequest models.UnreserveRequest) (models.UnreserveResponse, error) {
+	description := unreserveRequest.Reason
+	if description == "" {
+		description = "unreserve"
+	}
+
+	var unreserveResponse models.UnreserveResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		user, err := lockUser(ctx, repo, unreserveRequest.UserID)
+		if err != nil {
+			return err
+		}
+		if err := ensureOpen(user); err != nil {
+			return err
+		}
 
-    if ConfirmRequest.Amount.Cmp(big.NewFloat(0)) <= 0 {
-        return models.ConfirmResponse{}, errors.New("amount must be greater than 0")
-    }
+		released, newBalance, transactionId, err := releaseReservations(ctx, repo, unreserveRequest.UserID, unreserveRequest.ServiceID, unreserveRequest.OrderID, description)
+		if err != nil {
+			return err
+		}
 
-	ReserveExist,err := s.repository.GetReserveFundsByServiceAndOrder(ctx,ConfirmRequest.UserID,ConfirmRequest.ServiceID,ConfirmRequest.OrderID,ConfirmRequest.Amount)
+		unreserveResponse = models.UnreserveResponse{
+			Status:        "success",
+			Message:       "funds unreserved successfully",
+			Balance:       newBalance,
+			Released:      released,
+			TransactionID: transactionId,
+		}
+		return nil
+	})
 	if err != nil {
-		return models.ConfirmResponse{}, fmt.Errorf("failed to check reservation existence: %w", err)
+		return models.UnreserveResponse{}, err
 	}
-	if !ReserveExist {
-		return models.ConfirmResponse{}, errors.New("no corresponding reservation found")
+	return unreserveResponse, nil
+}
+
+// releaseReservations returns everything the order still holds to the user's
+// balance and records it as an unreserve transaction. The user row must
+// already be locked.
+func releaseReservations(ctx context.Context, repo repository.Repository, userID int, serviceID int, orderID int, description string) (models.Money, models.Money, int, error) {
+	released, releasedBonus, err := repo.ReleaseReservations(ctx, userID, serviceID, orderID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNoRows) {
+			return 0, 0, 0, ErrReservationNotFound
+		}
+		return 0, 0, 0, fmt.Errorf("failed to release reservation: %w", err)
 	}
 
-	err = s.repository.DeleteReservationByServiceAndOrder(ctx,ConfirmRequest.UserID,ConfirmRequest.ServiceID,ConfirmRequest.OrderID,ConfirmRequest.Amount)
+	newBalance, err := repo.UpdateUserBalance(ctx, userID, released-releasedBonus)
 	if err != nil {
-		return models.ConfirmResponse{}, fmt.Errorf("failed to delete reservation: %w", err)
-	}
-
-	
-	transactionId, err := s.repository.CreateTransaction(
-		ctx,
-		ConfirmRequest.UserID,
-		ConfirmRequest.ServiceID,
-		ConfirmRequest.OrderID,
-		new(big.Float).Neg(ConfirmRequest.Amount),
-		models.Confirm,
-		"confirm",
-	)
+		return 0, 0, 0, fmt.Errorf("failed to update user balance: %w", err)
+	}
+	if err := returnBonus(ctx, repo, userID, releasedBonus); err != nil {
+		return 0, 0, 0, err
+	}
+
+	transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+		UserID:      userID,
+		ServiceID:   serviceID,
+		OrderID:     orderID,
+		Amount:      released,
+		BonusAmount: releasedBonus,
+		Type:        models.Unreserve,
+		Description: description,
+	})
 	if err != nil {
-		return models.ConfirmResponse{}, fmt.Errorf("failed to create transaction: %w", err)
+		return 0, 0, 0, fmt.Errorf("failed to create transaction: %w", err)
 	}
 
-	err = s.repository.AddRevenueRecord(ctx,ConfirmRequest.UserID,ConfirmRequest.ServiceID,ConfirmRequest.OrderID,ConfirmRequest.Amount)
+	entry := models.NewBucketJournalEntry(transactionId, description, userID, models.UserReserved(userID), released-releasedBonus, releasedBonus)
+	if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+		return 0, 0, 0, fmt.Errorf("failed to create journal entry: %w", err)
+	}
+
+	err = settleOrderItem(ctx, repo, serviceID, orderID, false, func(item *models.OrderItem) {
+		item.Released += released
+	})
 	if err != nil {
-		return models.ConfirmResponse{}, fmt.Errorf("failed to add revenue record: %w", err)
+		return 0, 0, 0, err
 	}
 
+	return released, newBalance, transactionId, nil
+}
 
+func (s *service) Captures(ctx context.Context, serviceID int, orderID int) (models.CapturesResponse, error) {
+	captures, err := s.repository.GetCaptures(ctx, serviceID, orderID)
+	if err != nil {
+		return models.CapturesResponse{}, fmt.Errorf("failed to get captures: %w", err)
+	}
 
-	ConfirmResponse := models.ConfirmResponse{
-		Status:        "success",
-		Message:       "funds confirmed successfully",
-		TransactionID: transactionId,
+	var total models.Money
+	for _, capture := range captures {
+		total += capture.Amount
 	}
 
-	
-	return ConfirmResponse, nil
+	return models.CapturesResponse{Captures: captures, TotalCaptured: total}, nil
 }
 
-func (s *service)Transfer(ctx context.Context,transferRequest models.TransferRequest) (models.TransferResponse,error) {
-	if transferRequest.Amount == nil {
-        return models.TransferResponse{}, errors.New("amount is required")
-    }
-
-    if transferRequest.Amount.Cmp(big.NewFloat(0)) <= 0 {
-        return models.TransferResponse{}, errors.New("amount must be greater than 0")
-    }
+func (s *service) Transfer(ctx context.Context, transferRequest models.TransferRequest) (models.TransferResponse, error) {
+	if err := validateAmount(transferRequest.Amount); err != nil {
+		return models.TransferResponse{}, err
+	}
 
 	if transferRequest.FromUserID == transferRequest.ToUserID {
-        return models.TransferResponse{}, errors.New("cannot transfer to self")
-    }
+		return models.TransferResponse{}, newValidationError("to_user_id", "cannot transfer to self")
+	}
+
+	var transferResponse models.TransferResponse
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		replayed, err := claimIdempotencyKey(ctx, repo, "transfer", transferRequest.IdempotencyKey, transferRequest, &transferResponse)
+		if err != nil || replayed {
+			return err
+		}
+
+		// Lock both rows in id order so concurrent opposite transfers cannot deadlock.
+		users := make(map[int]models.User, 2)
+		for _, userID := range lockOrder(transferRequest.FromUserID, transferRequest.ToUserID) {
+			user, err := lockUser(ctx, repo, userID)
+			if err != nil {
+				return err
+			}
+			users[userID] = user
+		}
+		if err := ensureCanSpend(users[transferRequest.FromUserID]); err != nil {
+			return err
+		}
+		if err := ensureOpen(users[transferRequest.ToUserID]); err != nil {
+			return err
+		}
+		if err := checkLimit(ctx, repo, transferRequest.FromUserID, models.LimitTransfer, transferRequest.Amount); err != nil {
+			return err
+		}
+
+		fee, err := feeFor(ctx, repo, models.FeeTransfer, 0, transferRequest.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to get transfer fee: %w", err)
+		}
+		if users[transferRequest.FromUserID].Balance < transferRequest.Amount+fee {
+			return ErrInsufficientFunds
+		}
+
+		err = repo.Transfer(ctx, transferRequest.FromUserID, transferRequest.ToUserID, transferRequest.Amount)
+		if err != nil {
+			if errors.Is(err, repository.ErrNoRows) {
+				return ErrUserNotFound
+			}
+			return fmt.Errorf("failed to transfer funds: %w", err)
+		}
+
+		outgoing := models.Transaction{
+			UserID:             transferRequest.FromUserID,
+			Amount:             -transferRequest.Amount,
+			Type:               models.Transfer,
+			Description:        "outgoing transfer",
+			CounterpartyUserID: transferRequest.ToUserID,
+		}
+		transactionId, err := repo.CreateTransaction(ctx, outgoing)
+		if err != nil {
+			return fmt.Errorf("failed to create transaction: %w", err)
+		}
+
+		incomingTransactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+			UserID:               transferRequest.ToUserID,
+			Amount:               transferRequest.Amount,
+			Type:                 models.Transfer,
+			Description:          "incoming transfer",
+			RelatedTransactionID: transactionId,
+			CounterpartyUserID:   transferRequest.FromUserID,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create transaction: %w", err)
+		}
 
-	FromUserBalance,err := s.repository.GetUserBalance(ctx,transferRequest.FromUserID)
+		entry := models.NewJournalEntry(transactionId, "transfer", models.UserAvailable(transferRequest.FromUserID), models.UserAvailable(transferRequest.ToUserID), transferRequest.Amount)
+		if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+			return fmt.Errorf("failed to create journal entry: %w", err)
+		}
+
+		var feeTransactionId int
+		if fee > 0 {
+			outgoing.ID = transactionId
+			if feeTransactionId, err = chargeFee(ctx, repo, outgoing, fee, "transfer fee"); err != nil {
+				return err
+			}
+		}
+
+		newUserToBalance, err := repo.GetUserBalance(ctx, transferRequest.ToUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get user balance: %w", err)
+		}
+
+		newUserFromBalance, err := repo.GetUserBalance(ctx, transferRequest.FromUserID)
+		if err != nil {
+			return fmt.Errorf("failed to get user balance: %w", err)
+		}
+
+		transferResponse = models.TransferResponse{
+			Status:                "success",
+			Message:               "funds transferred successfully",
+			TransactionID:         transactionId,
+			IncomingTransactionID: incomingTransactionId,
+			UserToBalance:         newUserToBalance,
+			UserFromBalance:       newUserFromBalance,
+			Fee:                   fee,
+			FeeTransactionID:      feeTransactionId,
+		}
+		return storeIdempotentResponse(ctx, repo, transferRequest.IdempotencyKey, transferResponse)
+	})
 	if err != nil {
-		return models.TransferResponse{}, fmt.Errorf("failed to get user balance: %w", err)
+		return models.TransferResponse{}, err
 	}
+	return transferResponse, nil
+}
 
-	if FromUserBalance.Cmp(transferRequest.Amount) < 0 {
-		return models.TransferResponse{}, errors.New("insufficient funds")
+func validateAmount(amount models.Money) error {
+	if amount <= 0 {
+		return newValidationError("amount", "amount must be greater than 0")
+	}
+	if !amount.InRange() {
+		return newValidationError("amount", models.ErrAmountRange.Error())
 	}
+	return nil
+}
 
-	err = s.repository.Transfer(ctx,transferRequest.FromUserID,transferRequest.ToUserID,transferRequest.Amount)
-	if err != nil {
-		return models.TransferResponse{}, fmt.Errorf("failed to transfer funds: %w", err)
-	}
-
-	transactionId, err := s.repository.CreateTransaction(
-		ctx,
-		transferRequest.FromUserID,
-		transferRequest.ToUserID,
-		0,
-		transferRequest.Amount,
-		models.Transfer,
-		"transfer",
-	)
+// lockUser returns the user and locks the row for the rest of the transaction.
+func lockUser(ctx context.Context, repo repository.Repository, userID int) (models.User, error) {
+	user, err := repo.GetUserForUpdate(ctx, userID)
 	if err != nil {
-		return models.TransferResponse{}, fmt.Errorf("failed to create transaction: %w", err)
+		if errors.Is(err, repository.ErrNoRows) {
+			return models.User{}, fmt.Errorf("%w: %d", ErrUserNotFound, userID)
+		}
+		return models.User{}, fmt.Errorf("failed to get user: %w", err)
 	}
+	return user, nil
+}
+
+// lockOrder returns the user ids in the order their rows must be locked.
+func lockOrder(userIDs ...int) []int {
+	ordered := append([]int(nil), userIDs...)
+	sort.Ints(ordered)
+	return ordered
+}
 
-	NewUserToBalance ,err := s.repository.GetUserBalance(ctx,transferRequest.ToUserID)
+func (s *service) MonthlyReport(ctx context.Context, MonthlyReportRequest models.MonthlyReportRequest) (models.MonthlyReportResponse, error) {
+	var content bytes.Buffer
+	if err := writeMonthlyReport(ctx, s.repository, &content, MonthlyReportRequest.Year, MonthlyReportRequest.Month); err != nil {
+		return models.MonthlyReportResponse{}, err
+	}
+	return models.MonthlyReportResponse{Content: content.Bytes()}, nil
+}
+
+// writeMonthlyReport writes the revenue of the month as CSV to w.
+func writeMonthlyReport(ctx context.Context, repo repository.Repository, w io.Writer, year int, month int) error {
+	reportData, err := repo.GetMonthlyReportData(ctx, year, month)
 	if err != nil {
-		return models.TransferResponse{}, fmt.Errorf("failed to get user balance: %w", err)
+		return fmt.Errorf("failed to get monthly report data: %w", err)
 	}
 
-	NewUserFromBalance ,err := s.repository.GetUserBalance(ctx,transferRequest.FromUserID)
+	writer := csv.NewWriter(w)
+	err = writer.Write([]string{"Service Name", "Total Revenue", "Fee Income"})
 	if err != nil {
-		return models.TransferResponse{}, fmt.Errorf("failed to get user balance: %w", err)
+		return fmt.Errorf("failed to write csv header: %w", err)
+	}
+
+	for _, data := range reportData {
+		err = writer.Write([]string{reportServiceName(data), data.TotalRevenue.String(), data.FeeIncome.String()})
+		if err != nil {
+			return fmt.Errorf("failed to write csv row: %w", err)
+		}
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("csv writer error: %w", err)
 	}
+	return nil
+}
+
+// reportServiceName labels a report row. Revenue booked before the service was
+// in the catalog falls back to its id; service 0 carries transfer fees.
+func reportServiceName(data models.MonthlyReportData) string {
+	switch {
+	case data.ServiceName != "":
+		return data.ServiceName
+	case data.ServiceId == "0":
+		return "transfers"
+	default:
+		return "service " + data.ServiceId
+	}
+}
 
-	TransferResponse := models.TransferResponse{
-		Status:        "success",
-		Message:       "funds transferred successfully",
-		TransactionID: transactionId,
-		UserToBalance: NewUserToBalance,
-		UserFromBalance: NewUserFromBalance,
+func (s *service) Transactions(ctx context.Context, TransactionsRequest models.TransactionRequest) (models.TransactionsResponse, error) {
+	if TransactionsRequest.SortBy != "created_at" && TransactionsRequest.SortBy != "amount" {
+		return models.TransactionsResponse{}, newValidationError("sort_by", "must be created_at or amount")
+	}
+	if TransactionsRequest.SortOrder != "asc" && TransactionsRequest.SortOrder != "desc" {
+		return models.TransactionsResponse{}, newValidationError("sort_order", "must be asc or desc")
 	}
 
-	return TransferResponse, nil
+	Transactions, total, err := s.repository.GetTransactions(ctx, TransactionsRequest.UserId, TransactionsRequest.Page, TransactionsRequest.Limit, TransactionsRequest.SortBy, TransactionsRequest.SortOrder)
+	if err != nil {
+		return models.TransactionsResponse{}, fmt.Errorf("failed to get transactions: %w", err)
+	}
 
+	TransactionsResponse := models.TransactionsResponse{
+		Transactions: Transactions,
+		Total:        total,
+		Page:         TransactionsRequest.Page,
+		Limit:        TransactionsRequest.Limit,
+	}
+	return TransactionsResponse, nil
 }
 
-func (s *service) MonthlyReport(ctx context.Context,MonthlyReportRequest models.MonthlyReportRequest) (models.MonthlyReportResponse, error) {
-	reportData,err := s.repository.GetMonthlyReportData(ctx,MonthlyReportRequest.Year,MonthlyReportRequest.Month)
+// maxReservationsPage bounds the limit of GET /reservations.
+const maxReservationsPage = 1000
+
+func (s *service) Reservations(ctx context.Context, filter models.ReservationFilter) (models.ReservationsResponse, error) {
+	if filter.SortBy != "created_at" && filter.SortBy != "expires_at" && filter.SortBy != "amount" {
+		return models.ReservationsResponse{}, newValidationError("sort_by", "must be created_at, expires_at or amount")
+	}
+	if filter.SortOrder != "asc" && filter.SortOrder != "desc" {
+		return models.ReservationsResponse{}, newValidationError("sort_order", "must be asc or desc")
+	}
+	if filter.Limit > maxReservationsPage {
+		return models.ReservationsResponse{}, newValidationError("limit", fmt.Sprintf("must be at most %d", maxReservationsPage))
+	}
+
+	reservations, total, err := s.repository.ListReservations(ctx, filter)
 	if err != nil {
-		return models.MonthlyReportResponse{}, fmt.Errorf("failed to get monthly report data: %w", err)
+		return models.ReservationsResponse{}, fmt.Errorf("failed to list reservations: %w", err)
+	}
+
+	now := time.Now()
+	items := make([]models.ReservationListItem, 0, len(reservations))
+	for _, res := range reservations {
+		items = append(items, models.ReservationListItem{
+			Reservation: res,
+			AgeSeconds:  int64(now.Sub(res.CreatedAt) / time.Second),
+			Expired:     res.Expired(now),
+		})
 	}
 
-	tempFile, err := os.CreateTemp("", "monthly_report_*.csv")
+	return models.ReservationsResponse{
+		Reservations: items,
+		Total:        total,
+		Page:         filter.Page,
+		Limit:        filter.Limit,
+	}, nil
+}
+
+func (s *service) VerifyLedger(ctx context.Context) (models.LedgerReport, error) {
+	accountTotals, err := s.repository.GetLedgerAccountTotals(ctx)
 	if err != nil {
-		return models.MonthlyReportResponse{}, fmt.Errorf("failed to create temp file: %w", err)
+		return models.LedgerReport{}, fmt.Errorf("failed to get account totals: %w", err)
 	}
-	defer os.Remove(tempFile.Name())
 
-	writer := csv.NewWriter(tempFile)
-	defer writer.Flush()
+	unbalancedEntries, err := s.repository.GetUnbalancedJournalEntries(ctx)
+	if err != nil {
+		return models.LedgerReport{}, fmt.Errorf("failed to get unbalanced journal entries: %w", err)
+	}
 
-	err = writer.Write([]string{"Service Name", "Total Revenue"})
+	discrepancies, err := s.repository.GetLedgerDiscrepancies(ctx)
 	if err != nil {
-		return models.MonthlyReportResponse{}, fmt.Errorf("failed to write csv header: %w", err)
+		return models.LedgerReport{}, fmt.Errorf("failed to get ledger discrepancies: %w", err)
 	}
 
-	for _, data := range reportData {
-		err = writer.Write([]string{data.ServiceId, strconv.FormatFloat(data.TotalRevenue, 'f', 2, 64)})
+	var total models.Money
+	for _, accountTotal := range accountTotals {
+		total += accountTotal
+	}
+
+	return models.LedgerReport{
+		Balanced:          total == 0 && len(unbalancedEntries) == 0 && len(discrepancies) == 0,
+		Total:             total,
+		AccountTotals:     accountTotals,
+		UnbalancedEntries: unbalancedEntries,
+		Discrepancies:     discrepancies,
+	}, nil
+}
+
+// reservationExpiry picks the lifetime of a new hold: the request TTL, then the
+// per-service default, then the global default.
+func (s *service) reservationExpiry(serviceID int, ttlSeconds int, now time.Time) *time.Time {
+	ttl := time.Duration(ttlSeconds) * time.Second
+	if ttl == 0 {
+		ttl = s.options.ServiceReservationTTLs[serviceID]
+	}
+	if ttl == 0 {
+		ttl = s.options.DefaultReservationTTL
+	}
+	if ttl == 0 {
+		return nil
+	}
+	expiresAt := now.Add(ttl)
+	return &expiresAt
+}
+
+func (s *service) ExtendReservation(ctx context.Context, request models.ExtendReservationRequest) (models.ExtendReservationResponse, error) {
+	if request.TTLSeconds <= 0 {
+		return models.ExtendReservationResponse{}, newValidationError("ttl_seconds", "must be greater than 0")
+	}
+	expiresAt := time.Now().Add(time.Duration(request.TTLSeconds) * time.Second)
+
+	err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+		user, err := lockUser(ctx, repo, request.UserID)
+		if err != nil {
+			return err
+		}
+		if err := ensureCanSpend(user); err != nil {
+			return err
+		}
+
+		reservations, err := repo.GetReservationsForUpdate(ctx, request.UserID, request.ServiceID, request.OrderID)
 		if err != nil {
-			return models.MonthlyReportResponse{}, fmt.Errorf("failed to write csv row: %w", err)
+			return fmt.Errorf("failed to get reservations: %w", err)
+		}
+		if len(reservations) == 0 {
+			return ErrReservationNotFound
 		}
+
+		extended, err := repo.ExtendReservations(ctx, request.UserID, request.ServiceID, request.OrderID, expiresAt)
+		if err != nil {
+			return fmt.Errorf("failed to extend reservation: %w", err)
+		}
+		if extended == 0 {
+			return ErrReservationExpired
+		}
+		return nil
+	})
+	if err != nil {
+		return models.ExtendReservationResponse{}, err
 	}
 
-	if err := writer.Error(); err != nil {
-		return models.MonthlyReportResponse{}, fmt.Errorf("csv writer error: %w", err)
+	return models.ExtendReservationResponse{
+		Status:    "success",
+		Message:   "reservation extended successfully",
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// expiredSweepBatch bounds how many orders one sweep releases.
+const expiredSweepBatch = 100
+
+func (s *service) ReleaseExpiredReservations(ctx context.Context) (int, error) {
+	now := time.Now()
+	orders, err := s.repository.GetExpiredOrders(ctx, now, expiredSweepBatch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get expired reservations: %w", err)
+	}
+
+	released := 0
+	var errs []error
+	for _, order := range orders {
+		releasedOfOrder := 0
+		err := s.repository.WithTx(ctx, func(repo repository.Repository) error {
+			if _, err := lockUser(ctx, repo, order.UserID); err != nil {
+				return err
+			}
+
+			reservations, err := repo.GetReservationsForUpdate(ctx, order.UserID, order.ServiceID, order.OrderID)
+			if err != nil {
+				return fmt.Errorf("failed to get reservations: %w", err)
+			}
+
+			for _, res := range reservations {
+				if !res.Expired(now) {
+					continue
+				}
+				if err := expireReservation(ctx, repo, res); err != nil {
+					return err
+				}
+				releasedOfOrder++
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to release expired reservations of order %d: %w", order.OrderID, err))
+			if err := s.repository.MarkReleaseFailed(ctx, order.UserID, order.ServiceID, order.OrderID, now); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		released += releasedOfOrder
 	}
 
-	return models.MonthlyReportResponse{FilePath: tempFile.Name()}, nil
+	return released, errors.Join(errs...)
 }
 
-func (s *service) Transactions(ctx context.Context,TransactionsRequest models.TransactionRequest) (models.TransactionsResponse, error) {
-	Transactions,total,err := s.repository.GetTransactions(ctx,TransactionsRequest.UserId,TransactionsRequest.Page,TransactionsRequest.Limit,TransactionsRequest.SortBy,TransactionsRequest.SortOrder)
+// expireReservation returns a single expired hold to the user's balance. The
+// user row and the hold must already be locked.
+func expireReservation(ctx context.Context, repo repository.Repository, res models.Reservation) error {
+	if err := repo.DeleteReservation(ctx, res.ID); err != nil {
+		return fmt.Errorf("failed to delete reservation: %w", err)
+	}
+
+	if _, err := repo.UpdateUserBalance(ctx, res.UserID, res.Amount-res.BonusAmount); err != nil {
+		return fmt.Errorf("failed to update user balance: %w", err)
+	}
+	if err := returnBonus(ctx, repo, res.UserID, res.BonusAmount); err != nil {
+		return err
+	}
+
+	transactionId, err := repo.CreateTransaction(ctx, models.Transaction{
+		UserID:      res.UserID,
+		ServiceID:   res.ServiceID,
+		OrderID:     res.OrderID,
+		Amount:      res.Amount,
+		BonusAmount: res.BonusAmount,
+		Type:        models.Expired,
+		Description: "reservation expired",
+	})
 	if err != nil {
-		return models.TransactionsResponse{},fmt.Errorf("failed to get transactions: %w", err)
+		return fmt.Errorf("failed to create transaction: %w", err)
 	}
 
-	TransactionsResponse := models.TransactionsResponse{
-		Transactions: Transactions,
-		Total:        total,
-		Page:         TransactionsRequest.Page,
-		Limit:        TransactionsRequest.Limit,
+	entry := models.NewBucketJournalEntry(transactionId, "reservation expired", res.UserID, models.UserReserved(res.UserID), res.Amount-res.BonusAmount, res.BonusAmount)
+	if _, err := repo.CreateJournalEntry(ctx, entry); err != nil {
+		return fmt.Errorf("failed to create journal entry: %w", err)
 	}
-	return TransactionsResponse, nil
+
+	return settleOrderItem(ctx, repo, res.ServiceID, res.OrderID, true, func(item *models.OrderItem) {
+		item.Released += res.Amount
+	})
 }
\ No newline at end of file
@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	local, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewLocal() unexpected error = %v", err)
+	}
+
+	if err := local.Put(ctx, "report-1.csv", strings.NewReader("a;1\n")); err != nil {
+		t.Fatalf("Put() unexpected error = %v", err)
+	}
+	if err := local.Put(ctx, "report-1.csv", strings.NewReader("b;2\n")); err != nil {
+		t.Fatalf("Put() unexpected error = %v", err)
+	}
+
+	f, err := local.Open(ctx, "report-1.csv")
+	if err != nil {
+		t.Fatalf("Open() unexpected error = %v", err)
+	}
+	content, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(content) != "b;2\n" {
+		t.Errorf("Open() content = %q, %v, want %q", content, err, "b;2\n")
+	}
+
+	if err := local.Delete(ctx, "report-1.csv"); err != nil {
+		t.Fatalf("Delete() unexpected error = %v", err)
+	}
+	if err := local.Delete(ctx, "report-1.csv"); err != nil {
+		t.Errorf("Delete() of a missing file error = %v, want nil", err)
+	}
+	if _, err := local.Open(ctx, "report-1.csv"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Open() error = %v, want %v", err, ErrNotFound)
+	}
+
+	for _, key := range []string{"", "../escape.csv", "dir/report.csv", ".hidden"} {
+		if err := local.Put(ctx, key, strings.NewReader("x")); err == nil {
+			t.Errorf("Put(%q) error = nil, want invalid key", key)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Package storage keeps generated files such as reports outside the database.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("file not found")
+
+// Storage stores files under flat keys.
+type Storage interface {
+	// Put stores the content of r under key, replacing an existing file.
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Open returns the file stored under key, or ErrNotFound.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the file; deleting a missing file is not an error.
+	Delete(ctx context.Context, key string) error
+}
@@ -0,0 +1,30 @@
+package worker
+
+import (
+	"context"
+	"internship_backend_2022/internal/service"
+	"log"
+	"time"
+)
+
+// RunReservationSweeper periodically releases expired reservations.
+func RunReservationSweeper(ctx context.Context, svc service.Service, interval time.Duration) {
+	Run(ctx, "reservation sweeper", interval, func(ctx context.Context) error {
+		released, err := svc.ReleaseExpiredReservations(ctx)
+		if released > 0 {
+			log.Printf("reservation sweeper: released %d expired reservations", released)
+		}
+		return err
+	})
+}
+
+// RunBonusExpirer periodically forfeits the bonus left in expired grants.
+func RunBonusExpirer(ctx context.Context, svc service.Service, interval time.Duration) {
+	Run(ctx, "bonus expirer", interval, func(ctx context.Context) error {
+		expired, err := svc.ExpireBonuses(ctx)
+		if expired > 0 {
+			log.Printf("bonus expirer: expired bonus of %d users", expired)
+		}
+		return err
+	})
+}
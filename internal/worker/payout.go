@@ -0,0 +1,19 @@
+package worker
+
+import (
+	"context"
+	"internship_backend_2022/internal/service"
+	"log"
+	"time"
+)
+
+// RunPayoutProcessor periodically moves payouts through their lifecycle.
+func RunPayoutProcessor(ctx context.Context, svc service.Service, interval time.Duration) {
+	Run(ctx, "payout processor", interval, func(ctx context.Context) error {
+		processed, err := svc.ProcessPayouts(ctx)
+		if processed > 0 {
+			log.Printf("payout processor: processed %d payouts", processed)
+		}
+		return err
+	})
+}
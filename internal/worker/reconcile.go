@@ -0,0 +1,24 @@
+package worker
+
+import (
+	"context"
+	"internship_backend_2022/internal/reconcile"
+	"internship_backend_2022/internal/service"
+	"log"
+	"time"
+)
+
+// RunReconciler periodically checks balances against the transactions
+// history and logs the discrepancy report when drift is found.
+func RunReconciler(ctx context.Context, svc service.Service, interval time.Duration, fix bool) {
+	Run(ctx, "reconciler", interval, func(ctx context.Context) error {
+		report, err := svc.Reconcile(ctx, fix)
+		if len(report.Discrepancies) > 0 {
+			log.Printf("reconciler: %d discrepancies, %d adjustments", len(report.Discrepancies), len(report.Adjustments))
+			if err := reconcile.Write(log.Writer(), report, reconcile.FormatJSON); err != nil {
+				log.Printf("reconciler: %v", err)
+			}
+		}
+		return err
+	})
+}
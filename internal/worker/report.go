@@ -0,0 +1,30 @@
+package worker
+
+import (
+	"context"
+	"internship_backend_2022/internal/service"
+	"log"
+	"time"
+)
+
+// RunReportGenerator periodically generates pending report jobs.
+func RunReportGenerator(ctx context.Context, svc service.Service, interval time.Duration) {
+	Run(ctx, "report generator", interval, func(ctx context.Context) error {
+		generated, err := svc.ProcessReports(ctx)
+		if generated > 0 {
+			log.Printf("report generator: generated %d reports", generated)
+		}
+		return err
+	})
+}
+
+// RunReportCleaner periodically deletes the files of expired reports.
+func RunReportCleaner(ctx context.Context, svc service.Service, interval time.Duration) {
+	Run(ctx, "report cleaner", interval, func(ctx context.Context) error {
+		removed, err := svc.CleanupReports(ctx)
+		if removed > 0 {
+			log.Printf("report cleaner: removed %d expired reports", removed)
+		}
+		return err
+	})
+}
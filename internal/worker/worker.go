@@ -0,0 +1,30 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Run calls job every interval until ctx is cancelled. Errors are logged and
+// do not stop the loop. A zero interval disables the job.
+func Run(ctx context.Context, name string, interval time.Duration, job func(ctx context.Context) error) {
+	if interval <= 0 {
+		log.Printf("%s: disabled", name)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := job(ctx); err != nil {
+				log.Printf("%s: %v", name, err)
+			}
+		}
+	}
+}
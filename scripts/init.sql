@@ -2,7 +2,15 @@
 
 CREATE TABLE users (
     id INT PRIMARY KEY,
-    balance DECIMAL(15, 2) NOT NULL DEFAULT 0.00
+    balance DECIMAL(15, 2) NOT NULL DEFAULT 0.00 CHECK (balance >= 0),
+    -- promotional credit: spendable on services, never transferred or withdrawn
+    bonus_balance DECIMAL(15, 2) NOT NULL DEFAULT 0.00 CHECK (bonus_balance >= 0),
+    -- owed after a deposit reversal the balance could not cover
+    debt DECIMAL(15, 2) NOT NULL DEFAULT 0.00 CHECK (debt >= 0),
+    status VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'frozen', 'closed')),
+    status_reason TEXT,
+    status_changed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
 );
 
 CREATE TABLE transactions (
@@ -11,30 +19,224 @@ CREATE TABLE transactions (
     service_id INT DEFAULT 0,
     order_id INT DEFAULT 0,
     amount DECIMAL(15, 2) NOT NULL,
+    -- the part of amount that moved in the bonus bucket, with the same sign
+    bonus_amount DECIMAL(15, 2) NOT NULL DEFAULT 0.00,
     type VARCHAR(255) NOT NULL, 
     description TEXT,
+    related_transaction_id INT REFERENCES transactions(id),
+    counterparty_user_id INT REFERENCES users(id),
+    -- the billing service's payment id of a deposit made through its webhook
+    external_payment_id VARCHAR(255),
     created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+CREATE INDEX transactions_order_idx ON transactions (service_id, order_id);
+-- An external payment credits a user at most once.
+CREATE UNIQUE INDEX transactions_external_payment_idx ON transactions (external_payment_id) WHERE type = 'deposit';
+-- A deposit is reversed at most once.
+CREATE UNIQUE INDEX transactions_deposit_reversal_idx ON transactions (related_transaction_id) WHERE type = 'deposit_reversal';
+-- Covers point-in-time balance lookups without touching the heap.
+CREATE INDEX transactions_user_created_idx ON transactions (user_id, created_at) INCLUDE (type, amount, bonus_amount);
+
 CREATE TABLE reserved_funds (
     id SERIAL PRIMARY KEY,
     user_id INT NOT NULL,
     service_id INT NOT NULL,
     order_id INT NOT NULL,
     amount DECIMAL(15, 2) NOT NULL,
+    -- the part of amount drawn from the bonus bucket
+    bonus_amount DECIMAL(15, 2) NOT NULL DEFAULT 0.00,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    -- last time the expiry sweeper failed to release the hold
+    release_failed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    CHECK (bonus_amount BETWEEN 0 AND amount)
+);
+
+CREATE INDEX reserved_funds_expires_at_idx ON reserved_funds (expires_at) WHERE expires_at IS NOT NULL;
+CREATE INDEX reserved_funds_user_idx ON reserved_funds (user_id, created_at);
+
+CREATE TABLE reservation_captures (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    service_id INT NOT NULL,
+    order_id INT NOT NULL,
+    amount DECIMAL(15, 2) NOT NULL,
+    transaction_id INT NOT NULL REFERENCES transactions(id),
     created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+CREATE INDEX reservation_captures_order_idx ON reservation_captures (service_id, order_id);
+
+CREATE TABLE services (
+    id INT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    category VARCHAR(64) NOT NULL DEFAULT '',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
 CREATE TABLE revenue_report (
     id SERIAL PRIMARY KEY,
     user_id INT NOT NULL,
     service_id INT NOT NULL,
     order_id INT NOT NULL,
+    -- refunds are stored as negative revenue so monthly sums net them out
     revenue DECIMAL(15, 2) NOT NULL,
+    -- service rows are what the service earned, fee rows are fee income
+    -- charged on top; transfer fees use service_id 0
+    source VARCHAR(16) NOT NULL DEFAULT 'service' CHECK (source IN ('service', 'fee')),
+    -- the catalog name when the row was booked, so renames keep old reports
+    service_name VARCHAR(255),
     created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (user_id) REFERENCES users(id)
 );
 
+CREATE TABLE journal_entries (
+    id SERIAL PRIMARY KEY,
+    transaction_id INT REFERENCES transactions(id),
+    description TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- account is one of user_available, user_bonus, user_reserved, user_debt,
+-- company_revenue, fee_income, bonus_funding, external_funding,
+-- payouts_in_transit; company accounts use user_id 0.
+CREATE TABLE postings (
+    id SERIAL PRIMARY KEY,
+    entry_id INT NOT NULL REFERENCES journal_entries(id),
+    account VARCHAR(64) NOT NULL,
+    user_id INT NOT NULL DEFAULT 0,
+    amount DECIMAL(15, 2) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX postings_account_user_idx ON postings (account, user_id, created_at);
+CREATE INDEX postings_entry_idx ON postings (entry_id);
+
+CREATE FUNCTION check_journal_entry_balanced() RETURNS TRIGGER AS $$
+BEGIN
+    IF (SELECT COALESCE(SUM(amount), 0) FROM postings WHERE entry_id = NEW.entry_id) <> 0 THEN
+        RAISE EXCEPTION 'journal entry % does not balance', NEW.entry_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE CONSTRAINT TRIGGER postings_balanced
+    AFTER INSERT OR UPDATE ON postings
+    DEFERRABLE INITIALLY DEFERRED
+    FOR EACH ROW EXECUTE FUNCTION check_journal_entry_balanced();
+
+CREATE TABLE idempotency_keys (
+    key VARCHAR(255) PRIMARY KEY,
+    request_hash CHAR(64) NOT NULL,
+    response JSONB,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE payouts (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    amount DECIMAL(15, 2) NOT NULL CHECK (amount > 0),
+    status VARCHAR(32) NOT NULL DEFAULT 'pending',
+    provider_reference VARCHAR(255),
+    failure_reason TEXT,
+    transaction_id INT NOT NULL REFERENCES transactions(id),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX payouts_status_idx ON payouts (status, id);
+
+CREATE TABLE report_jobs (
+    id SERIAL PRIMARY KEY,
+    year INT NOT NULL,
+    month INT NOT NULL CHECK (month BETWEEN 1 AND 12),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'completed', 'failed', 'expired')),
+    -- storage key of the generated file while it is kept
+    file_key VARCHAR(255),
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX report_jobs_status_idx ON report_jobs (status, id);
+CREATE INDEX report_jobs_expires_idx ON report_jobs (expires_at) WHERE status = 'completed';
+
+-- An order groups line items of several services under an order_id chosen by
+-- its user; other users may use the same order_id. Each item is held by its own
+-- reserved_funds row keyed by (service_id, order_id), and the primary key of
+-- order_items is what makes that pair unique.
+CREATE TABLE orders (
+    user_id INT NOT NULL REFERENCES users(id),
+    id INT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, id)
+);
+
+CREATE TABLE order_items (
+    order_id INT NOT NULL,
+    user_id INT NOT NULL,
+    service_id INT NOT NULL,
+    amount DECIMAL(15, 2) NOT NULL CHECK (amount > 0),
+    status VARCHAR(32) NOT NULL DEFAULT 'reserved'
+        CHECK (status IN ('reserved', 'partially_confirmed', 'confirmed', 'released', 'refunded', 'expired')),
+    captured DECIMAL(15, 2) NOT NULL DEFAULT 0.00,
+    released DECIMAL(15, 2) NOT NULL DEFAULT 0.00,
+    refunded DECIMAL(15, 2) NOT NULL DEFAULT 0.00,
+    transaction_id INT NOT NULL REFERENCES transactions(id),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (order_id, service_id),
+    FOREIGN KEY (user_id, order_id) REFERENCES orders (user_id, id),
+    CHECK (captured + released <= amount AND refunded <= captured)
+);
+
+-- Velocity limits. user_id 0 holds the global defaults; a row for a user
+-- replaces the default with the same operation and window, and a row without
+-- max_amount and max_count exempts the user from it.
+CREATE TABLE limits (
+    user_id INT NOT NULL DEFAULT 0,
+    operation VARCHAR(32) NOT NULL CHECK (operation IN ('deposit', 'transfer', 'reserve')),
+    window_seconds INT NOT NULL CHECK (window_seconds > 0),
+    max_amount DECIMAL(15, 2) CHECK (max_amount >= 0),
+    max_count INT CHECK (max_count >= 0),
+    PRIMARY KEY (user_id, operation, window_seconds)
+);
+
+-- Fees charged to the payer on top of an operation: rate_bps basis points of
+-- the amount, raised to min_fee and capped at max_fee. service_id 0 holds the
+-- default for the operation; a row for a service replaces it.
+CREATE TABLE fee_rules (
+    operation VARCHAR(32) NOT NULL CHECK (operation IN ('transfer', 'confirm')),
+    service_id INT NOT NULL DEFAULT 0,
+    rate_bps INT NOT NULL DEFAULT 0 CHECK (rate_bps BETWEEN 0 AND 10000),
+    min_fee DECIMAL(15, 2) NOT NULL DEFAULT 0.00 CHECK (min_fee >= 0),
+    max_fee DECIMAL(15, 2) CHECK (max_fee >= min_fee),
+    PRIMARY KEY (operation, service_id)
+);
+
+-- Bonus credit granted to a user. remaining is what is left of the grant;
+-- spending draws from the grants that expire first and returned bonus refills
+-- them in the same order. Expired grants forfeit their remaining credit.
+CREATE TABLE bonus_grants (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users(id),
+    amount DECIMAL(15, 2) NOT NULL CHECK (amount > 0),
+    remaining DECIMAL(15, 2) NOT NULL CHECK (remaining BETWEEN 0 AND amount),
+    expires_at TIMESTAMP WITH TIME ZONE,
+    -- last time the bonus expirer failed to forfeit the grant
+    expiry_failed_at TIMESTAMP WITH TIME ZONE,
+    transaction_id INT NOT NULL REFERENCES transactions(id),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
 
+CREATE INDEX bonus_grants_user_idx ON bonus_grants (user_id, expires_at);
+CREATE INDEX bonus_grants_expires_at_idx ON bonus_grants (expires_at) WHERE remaining > 0;